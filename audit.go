@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// auditDefaultLimit is the number of entries /api/audit returns when no
+	// limit is given
+	auditDefaultLimit = 100
+	// auditMaxLimit bounds the limit of /api/audit
+	auditMaxLimit = 10000
+	// auditMaxLine bounds the size of an entry read back from the log
+	auditMaxLine = 1 << 20
+)
+
+// AuditEntry is a mutating operation and its outcome
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Principal is empty when authentication is disabled
+	Principal string `json:"principal,omitempty"`
+	ClientIP  string `json:"client_ip"`
+	// Backend is the rTorrent instance the operation was sent to
+	Backend string `json:"backend,omitempty"`
+	// Action is load, erase, set_priority or a torrent action
+	Action string                 `json:"action"`
+	Hash   string                 `json:"hash,omitempty"`
+	Name   string                 `json:"name,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	// Result is ok or error
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+type AuditConfig struct {
+	// Path of the log, the rotated files are Path.1 (newest) to
+	// Path.MaxFiles (oldest)
+	Path string `yaml:"file"`
+	// MaxSize is the size in bytes above which the log is rotated, zero
+	// disables rotation
+	MaxSize int64 `yaml:"max_size"`
+	// MaxFiles is the number of rotated files kept
+	MaxFiles int `yaml:"max_files"`
+}
+
+// AuditLog writes entries as JSON lines to a file that is rotated by size
+type AuditLog struct {
+	config AuditConfig
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Opens the audit log, appending to an existing file
+func NewAuditLog(config AuditConfig) (*AuditLog, error) {
+	a := &AuditLog{config: config}
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// Returns the path of the nth rotated file, the log itself for 0
+func (a *AuditLog) rotated(n int) string {
+	if n == 0 {
+		return a.config.Path
+	}
+	return fmt.Sprintf("%s.%d", a.config.Path, n)
+}
+
+// Shifts the rotated files by one, dropping the oldest, and starts a new
+// log. The log is reopened even when a file could not be shifted.
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	os.Remove(a.rotated(a.config.MaxFiles))
+
+	var err error
+	for n := a.config.MaxFiles - 1; n >= 0; n-- {
+		err = os.Rename(a.rotated(n), a.rotated(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			break
+		}
+		err = nil
+	}
+
+	openErr := a.open()
+	if openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Appends an entry, a nil log records nothing
+func (a *AuditLog) Record(e AuditEntry) {
+	if a == nil {
+		return
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("error encoding audit entry: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		log.Printf("dropped audit entry after the log was closed: %s", line)
+		return
+	}
+	if a.config.MaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.config.MaxSize {
+		err := a.rotate()
+		if err != nil {
+			log.Printf("error rotating audit log: %s", err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("error writing audit entry: %s", err)
+	}
+}
+
+// Flushes and closes the log, entries recorded afterwards are dropped
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := errors.Join(a.file.Sync(), a.file.Close())
+	a.file = nil
+	return err
+}
+
+// AuditQuery selects entries, zero values match everything
+type AuditQuery struct {
+	Since time.Time
+	Until time.Time
+	Hash  string
+	// Limit keeps the newest entries
+	Limit int
+}
+
+func (q AuditQuery) match(e AuditEntry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return q.Hash == "" || strings.EqualFold(q.Hash, e.Hash)
+}
+
+// Returns the entries matching the query, oldest first
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	// rotation renames files under the lock, so they are read under it too
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries := []AuditEntry{}
+	for n := a.config.MaxFiles; n >= 0; n-- {
+		f, err := os.Open(a.rotated(n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, auditMaxLine)
+		for scanner.Scan() {
+			var e AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				// a torn line from a crash is skipped
+				continue
+			}
+			if q.match(e) {
+				entries = append(entries, e)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return entries, nil
+}
+
+// auditor records the operations of one principal and client
+type auditor struct {
+	rt        *Rtorrent
+	principal string
+	clientIP  string
+}
+
+// Returns an auditor for principal connected from remoteAddr
+func newAuditor(rt *Rtorrent, principal *Principal, remoteAddr string) auditor {
+	a := auditor{rt: rt, clientIP: remoteAddr}
+	if principal != nil {
+		a.principal = principal.Name
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		a.clientIP = host
+	}
+	return a
+}
+
+// Returns an auditor for the request's principal and client
+func (rt *Rtorrent) auditorFor(r *http.Request) auditor {
+	return newAuditor(rt, PrincipalFrom(r.Context()), r.RemoteAddr)
+}
+
+// Returns the names of the torrents by upper case hash. They are looked up
+// before an operation so that erased torrents keep their name, and only
+// when the audit log is enabled. A single torrent is looked up with d.name,
+// several in batched system.multicall calls.
+func (a auditor) names(ctx context.Context, hashes ...string) map[string]string {
+	if a.rt.audit == nil || len(hashes) == 0 {
+		return nil
+	}
+
+	names := make(map[string]string, len(hashes))
+	if len(hashes) == 1 {
+		var name string
+		err := a.rt.client.Call(ctx, "d.name", hashes[0], &name)
+		if err != nil {
+			// the entry is still written, without the name
+			log.Printf("error looking up torrent names for the audit log: %s", err)
+			return nil
+		}
+		names[strings.ToUpper(hashes[0])] = name
+		return names
+	}
+
+	for start := 0; start < len(hashes); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		batch := hashes[start:end]
+
+		calls := make([]interface{}, 0, len(batch))
+		for _, hash := range batch {
+			calls = append(calls, SystemCall{
+				MethodName: "d.name",
+				Params:     []string{hash},
+			})
+		}
+
+		var result interface{}
+		err := a.rt.client.Call(ctx, "system.multicall", []interface{}{calls}, &result)
+		values, ok := result.([]interface{})
+		if err == nil && (!ok || len(values) != len(batch)) {
+			err = fmt.Errorf("expected %d results from system.multicall, got %s", len(batch), xmlrpcType(result))
+		}
+		if err != nil {
+			log.Printf("error looking up torrent names for the audit log: %s", err)
+			continue
+		}
+		for i, hash := range batch {
+			// unknown torrents are written without a name
+			value, err := multicallValue(values[i])
+			if name, ok := value.(string); err == nil && ok {
+				names[strings.ToUpper(hash)] = name
+			}
+		}
+	}
+	return names
+}
+
+// Records action on torrent hash with its outcome
+func (a auditor) record(action, hash, name string, params map[string]interface{}, err error) {
+	e := AuditEntry{
+		Time:      time.Now().UTC(),
+		Principal: a.principal,
+		ClientIP:  a.clientIP,
+		Backend:   a.rt.name,
+		Action:    action,
+		Hash:      hash,
+		Name:      name,
+		Params:    params,
+		Result:    "ok",
+	}
+	if err != nil {
+		e.Result = "error"
+		e.Error = err.Error()
+	}
+	a.rt.audit.Record(e)
+}
+
+// Records action on each torrent of a bulk operation with its own outcome
+func (a auditor) recordResults(action string, names map[string]string, params map[string]interface{}, results []ActionResult) {
+	for _, result := range results {
+		var err error
+		if result.Status != "ok" {
+			err = fmt.Errorf("%s", result.Message)
+		}
+		a.record(action, result.Hash, names[strings.ToUpper(result.Hash)], params, err)
+	}
+}
+
+// Returns the info hash and display name of a magnet link, when it has them
+func magnetTorrent(uri string) (string, string) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "magnet" {
+		return "", ""
+	}
+	query := u.Query()
+
+	hash := ""
+	for _, xt := range query["xt"] {
+		if v, ok := strings.CutPrefix(xt, "urn:btih:"); ok {
+			hash = strings.ToUpper(v)
+			break
+		}
+	}
+	return hash, query.Get("dn")
+}
+
+// Returns the load options as audit parameters
+func (o LoadOptions) auditParams() map[string]interface{} {
+	params := map[string]interface{}{}
+	if o.Paused {
+		params["paused"] = true
+	}
+	if o.Directory != "" {
+		params["directory"] = o.Directory
+	}
+	if o.Label != "" {
+		params["label"] = o.Label
+	}
+	if o.Priority != nil {
+		params["priority"] = *o.Priority
+	}
+	if len(o.Commands) > 0 {
+		params["commands"] = o.Commands
+	}
+	return params
+}
+
+type AuditResponse struct {
+	Status  string       `json:"status"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+// Returns the audit entries selected by the since and until (RFC 3339),
+// hash and limit query parameters
+func AuditHandler(rt *Rtorrent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rt.audit == nil {
+			respond(Response{
+				Status:  "error",
+				Message: "the audit log is not enabled",
+			}, http.StatusNotFound, w)
+			return
+		}
+
+		query, err := auditQuery(r.URL.Query())
+		if err != nil {
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, http.StatusBadRequest, w)
+			return
+		}
+
+		entries, err := rt.audit.Query(query)
+		if err != nil {
+			log.Printf("error in audit handler: %s", err)
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, http.StatusInternalServerError, w)
+			return
+		}
+		respond(AuditResponse{
+			Status:  "ok",
+			Entries: entries,
+		}, http.StatusOK, w)
+	}
+}
+
+func auditQuery(values url.Values) (AuditQuery, error) {
+	q := AuditQuery{
+		Hash:  values.Get("hash"),
+		Limit: auditDefaultLimit,
+	}
+
+	var err error
+	if v := values.Get("since"); v != "" {
+		q.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid since value: %s", v)
+		}
+	}
+	if v := values.Get("until"); v != "" {
+		q.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid until value: %s", v)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 1 || q.Limit > auditMaxLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", auditMaxLimit)
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns an audit log in a temporary directory
+func newTestAuditLog(t *testing.T, maxSize int64, maxFiles int) *AuditLog {
+	t.Helper()
+
+	audit, err := NewAuditLog(AuditConfig{
+		Path:     filepath.Join(t.TempDir(), "audit.log"),
+		MaxSize:  maxSize,
+		MaxFiles: maxFiles,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+	return audit
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	audit := newTestAuditLog(t, 300, 2)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		audit.Record(AuditEntry{
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Action: "start",
+			Hash:   string(rune('A' + i)),
+			Result: "ok",
+		})
+	}
+
+	if _, err := os.Stat(audit.rotated(3)); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files, got %v", err)
+	}
+	for n := 0; n <= 2; n++ {
+		info, err := os.Stat(audit.rotated(n))
+		if err != nil || info.Size() > 300 {
+			t.Errorf("%d: expected a file of at most 300 bytes, got %v", n, err)
+		}
+	}
+
+	entries, err := audit.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || len(entries) == 10 || entries[len(entries)-1].Hash != "J" {
+		t.Fatalf("expected the newest entries to be kept, got %+v", entries)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Time.Before(entries[i-1].Time) {
+			t.Errorf("expected the entries oldest first, got %+v", entries)
+		}
+	}
+
+	entries, _ = audit.Query(AuditQuery{Since: start.Add(8 * time.Minute), Limit: 1})
+	if len(entries) != 1 || entries[0].Hash != "J" {
+		t.Errorf("expected the newest entry since the time, got %+v", entries)
+	}
+	entries, _ = audit.Query(AuditQuery{Hash: "i"})
+	if len(entries) != 1 || entries[0].Hash != "I" {
+		t.Errorf("expected the entry of the hash, got %+v", entries)
+	}
+}
+
+func TestAuditHandlers(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	rtorrent.audit = newTestAuditLog(t, 0, 0)
+	addTestTorrent(fake, "A", "a")
+	addTestTorrent(fake, "B", "b")
+
+	auth := NewAuth(NewAPIKeys(map[string]string{"ops": "key1"}))
+	srv := httptest.NewServer(newRouter(rtorrent, auth))
+	defer srv.Close()
+
+	magnet := "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=c"
+	form := "application/x-www-form-urlencoded"
+	for _, r := range []struct{ method, path, contentType, body string }{
+		{"POST", "/api/torrent/A/stop", "", ""},
+		{"DELETE", "/api/torrent/B", "", ""},
+		{"POST", "/api/load", form, url.Values{"uri": {magnet}, "label": {"tv"}}.Encode()},
+		{"POST", "/api/torrents/actions", "", `{"action": "start", "hashes": ["A", "X"]}`},
+	} {
+		code, body := doAs(t, "key1", r.method, srv.URL+r.path, r.contentType, r.body)
+		if code != http.StatusOK {
+			t.Fatalf("%s %s: expected 200, got %d %s", r.method, r.path, code, body)
+		}
+	}
+	for _, call := range fake.Calls() {
+		if call == "d.multicall2" {
+			t.Error("expected the names to be looked up for the torrents acted on only")
+		}
+	}
+
+	code, _ := doAs(t, "key1", "GET", srv.URL+"/api/audit", "", "")
+	if code != http.StatusOK {
+		t.Errorf("expected the audit log, got %d", code)
+	}
+	var resp Response
+	code = doJSON(t, "GET", srv.URL+"/api/audit", nil, "", &resp)
+	if code != http.StatusUnauthorized {
+		t.Errorf("expected the audit log to require authentication, got %d", code)
+	}
+
+	entries, err := rtorrent.audit.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ action, hash, name, result string }{
+		{"stop", "A", "a", "ok"},
+		{"erase", "B", "b", "ok"},
+		{"load", "0123456789ABCDEF0123456789ABCDEF01234567", "c", "ok"},
+		{"start", "A", "a", "ok"},
+		{"start", "X", "", "error"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %+v", len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Action != w.action || e.Hash != w.hash || e.Name != w.name || e.Result != w.result {
+			t.Errorf("%d: expected %+v, got %+v", i, w, e)
+		}
+		if e.Principal != "ops" || e.ClientIP != "127.0.0.1" {
+			t.Errorf("%d: expected ops from 127.0.0.1, got %s from %s", i, e.Principal, e.ClientIP)
+		}
+	}
+	if entries[1].Params["with_data"] != false || entries[2].Params["label"] != "tv" {
+		t.Errorf("expected the parameters to be recorded, got %+v %+v", entries[1].Params, entries[2].Params)
+	}
+}
+
+func TestAuditHandlerQuery(t *testing.T) {
+	rtorrent, _ := newTestRtorrent(t)
+	srv := httptest.NewServer(newRouter(rtorrent, nil))
+	defer srv.Close()
+
+	var resp Response
+	code := doJSON(t, "GET", srv.URL+"/api/audit", nil, "", &resp)
+	if code != http.StatusNotFound {
+		t.Errorf("expected 404 without an audit log, got %d", code)
+	}
+
+	rtorrent.audit = newTestAuditLog(t, 0, 0)
+	rtorrent.audit.Record(AuditEntry{Time: time.Now().UTC(), Action: "stop", Hash: "A", Result: "ok"})
+
+	for _, query := range []string{"since=yesterday", "limit=0", "limit=x"} {
+		code := doJSON(t, "GET", srv.URL+"/api/audit?"+query, nil, "", &resp)
+		if code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+
+	var audit AuditResponse
+	since := url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339))
+	code = doJSON(t, "GET", srv.URL+"/api/audit?hash=a&since="+since, nil, "", &audit)
+	if code != http.StatusOK || len(audit.Entries) != 1 || !strings.EqualFold(audit.Entries[0].Hash, "a") {
+		t.Errorf("expected the entry, got %d %+v", code, audit)
+	}
+}
+
+func TestAuditLogClose(t *testing.T) {
+	audit := newTestAuditLog(t, 0, 0)
+	audit.Record(AuditEntry{Action: "stop", Hash: "A", Result: "ok"})
+
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	audit.Record(AuditEntry{Action: "stop", Hash: "B", Result: "ok"})
+	if err := audit.Close(); err != nil {
+		t.Errorf("expected closing twice to be harmless, got %s", err)
+	}
+
+	entries, err := audit.Query(AuditQuery{})
+	if err != nil || len(entries) != 1 || entries[0].Hash != "A" {
+		t.Errorf("expected the entry recorded before closing, got %+v %v", entries, err)
+	}
+}
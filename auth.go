@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrNoCredentials      = errors.New("authentication required")
+)
+
+// sessionCookie is the name of the cookie holding a signed session
+const sessionCookie = "rtw_session"
+
+// Principal is who a request is made by
+type Principal struct {
+	Name string `json:"name"`
+	// Method is how the principal authenticated: api_key, basic, session or
+	// client_cert
+	Method string `json:"method"`
+	// Scopes, Views and Labels are what the principal was granted
+	Scopes []string `json:"scopes"`
+	Views  []string `json:"views,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// Authenticator checks one kind of credentials on a request. A request that
+// carries none of its kind gets a nil principal and no error, so that the
+// next authenticator can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+type principalKey struct{}
+
+// Returns the principal the request was authenticated as, nil when
+// authentication is disabled
+func PrincipalFrom(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// Reads the non-empty, non-comment lines of a file as name:value pairs
+func readPairs(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pairs := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, ":")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:value", path, line)
+		}
+		if _, ok := pairs[name]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate name %s", path, line, name)
+		}
+		pairs[name] = value
+	}
+	return pairs, scanner.Err()
+}
+
+// APIKeys authenticates requests with static bearer keys
+type APIKeys struct {
+	// names by the SHA-256 of the key, so that looking a key up does not
+	// compare it byte by byte
+	names map[[32]byte]string
+}
+
+// Creates API keys from names and their keys
+func NewAPIKeys(keys map[string]string) *APIKeys {
+	a := &APIKeys{names: make(map[[32]byte]string, len(keys))}
+	for name, key := range keys {
+		a.names[sha256.Sum256([]byte(key))] = name
+	}
+	return a
+}
+
+// Loads API keys from a file with a name:key line for each key
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	keys, err := readPairs(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewAPIKeys(keys), nil
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+	name, ok := a.names[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: name, Method: "api_key"}, nil
+}
+
+// ClientCerts authenticates requests with the TLS client certificate that was
+// verified against the client CA bundle. The principal is named after the
+// certificate's subject common name, or its whole subject.
+type ClientCerts struct {
+	// Subject names principals after the whole subject, e.g.
+	// CN=backup,O=example
+	Subject bool
+}
+
+func (c *ClientCerts) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+
+	name := subject.CommonName
+	if c.Subject {
+		name = subject.String()
+	}
+	if name == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: name, Method: "client_cert"}, nil
+}
+
+// Users authenticates requests with HTTP basic auth against bcrypt hashed
+// passwords
+type Users struct {
+	hashes map[string][]byte
+}
+
+// Loads users from a file with a name:bcrypt-hash line for each user, as
+// written by htpasswd -B
+func LoadUsers(path string) (*Users, error) {
+	pairs, err := readPairs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Users{hashes: make(map[string][]byte, len(pairs))}
+	for name, hash := range pairs {
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %s: %w", path, name, err)
+		}
+		u.hashes[name] = []byte(hash)
+	}
+	return u, nil
+}
+
+// unknownUserHash is compared against for unknown users so that they take
+// as long to refuse as wrong passwords
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("rtw"), bcrypt.DefaultCost)
+
+// Reports whether password is the password of user name
+func (u *Users) Check(name, password string) bool {
+	hash, ok := u.hashes[name]
+	if !ok {
+		bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+func (u *Users) exists(name string) bool {
+	_, ok := u.hashes[name]
+	return ok
+}
+
+func (u *Users) Authenticate(r *http.Request) (*Principal, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	if !u.Check(name, password) {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: name, Method: "basic"}, nil
+}
+
+// Sessions authenticates the HTML UI with signed cookies issued by the
+// login page
+type Sessions struct {
+	users  *Users
+	secret []byte
+	ttl    time.Duration
+}
+
+// Creates sessions for users signed with secret that last ttl
+func NewSessions(users *Users, secret []byte, ttl time.Duration) *Sessions {
+	if ttl <= 0 {
+		ttl = 12 * time.Hour
+	}
+	return &Sessions{users: users, secret: secret, ttl: ttl}
+}
+
+func (s *Sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the cookie value of a session of name, the user name and the
+// expiry signed together
+func (s *Sessions) token(name string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(name + "|" + strconv.FormatInt(expires.Unix(), 10)))
+	return payload + "." + s.sign(payload)
+}
+
+// Returns the user of a valid token
+func (s *Sessions) verify(token string) (string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return "", ErrInvalidCredentials
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+	i := strings.LastIndex(string(data), "|")
+	if i < 0 {
+		return "", ErrInvalidCredentials
+	}
+	name := string(data[:i])
+	expires, err := strconv.ParseInt(string(data[i+1:]), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return "", errors.New("session expired")
+	}
+	// users removed from the file lose their sessions
+	if !s.users.exists(name) {
+		return "", ErrInvalidCredentials
+	}
+	return name, nil
+}
+
+func (s *Sessions) Authenticate(r *http.Request) (*Principal, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	name, err := s.verify(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{Name: name, Method: "session"}, nil
+}
+
+// Sets the session cookie of user name
+func (s *Sessions) start(w http.ResponseWriter, r *http.Request, name string) {
+	expires := time.Now().Add(s.ttl)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.token(name, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (s *Sessions) end(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// AuthConfig selects how requests are authenticated
+type AuthConfig struct {
+	// APIKeysFile has a name:key line for each API key
+	APIKeysFile string `yaml:"api_keys_file"`
+	// UsersFile has a name:bcrypt-hash line for each user
+	UsersFile string `yaml:"users_file"`
+	// SessionSecret signs session cookies, random when empty
+	SessionSecret string        `yaml:"session_secret"`
+	SessionTTL    time.Duration `yaml:"session_ttl"`
+	// PermissionsFile grants scopes to principals, every principal is an
+	// admin when empty
+	PermissionsFile string `yaml:"permissions_file"`
+	// ClientCertPrincipal names principals after verified TLS client
+	// certificates, by common_name or subject. Other credentials are tried
+	// first.
+	ClientCertPrincipal string `yaml:"client_cert_principal"`
+}
+
+// Auth authenticates requests with the first authenticator that finds
+// credentials of its kind. A nil Auth lets every request through.
+type Auth struct {
+	// mu guards the fields below, which are replaced on reload
+	mu             sync.RWMutex
+	authenticators []Authenticator
+	// sessions is set when the login page is enabled
+	sessions *Sessions
+	// basic is set when basic auth is accepted, so that clients are asked
+	// for it
+	basic bool
+	// permissions grant scopes to principals, every principal is an admin
+	// when nil
+	permissions *Permissions
+}
+
+// Creates an Auth that tries the authenticators in order
+func NewAuth(authenticators ...Authenticator) *Auth {
+	a := &Auth{authenticators: authenticators}
+	for _, authenticator := range authenticators {
+		switch authenticator := authenticator.(type) {
+		case *Sessions:
+			a.sessions = authenticator
+		case *Users:
+			a.basic = true
+		}
+	}
+	return a
+}
+
+// Creates an Auth from the configured files, nil when there are no API keys,
+// users or client certificates
+func newAuthFromConfig(config AuthConfig) (*Auth, error) {
+	authenticators := []Authenticator{}
+
+	if config.APIKeysFile != "" {
+		keys, err := LoadAPIKeys(config.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, keys)
+	}
+
+	if config.UsersFile != "" {
+		users, err := LoadUsers(config.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+
+		secret := []byte(config.SessionSecret)
+		if len(secret) == 0 {
+			secret = make([]byte, 32)
+			_, err := rand.Read(secret)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("SESSION_SECRET is not set, sessions end when rtw restarts")
+		}
+
+		authenticators = append(authenticators, users, NewSessions(users, secret, config.SessionTTL))
+	}
+
+	if config.ClientCertPrincipal != "" {
+		authenticators = append(authenticators, &ClientCerts{Subject: config.ClientCertPrincipal == "subject"})
+	}
+
+	if len(authenticators) == 0 {
+		if config.PermissionsFile != "" {
+			return nil, errors.New("PERMISSIONS_FILE requires API_KEYS_FILE, USERS_FILE or CLIENT_CERT_PRINCIPAL")
+		}
+		return nil, nil
+	}
+	auth := NewAuth(authenticators...)
+
+	if config.PermissionsFile != "" {
+		permissions, err := LoadPermissions(config.PermissionsFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.permissions = permissions
+	}
+	return auth, nil
+}
+
+// Rereads the API keys, users and permissions. Sessions stay valid unless
+// the secret changes. Authentication cannot be turned on or off without a
+// restart, as the routes were set up with or without it.
+func (a *Auth) reload(config AuthConfig) error {
+	a.mu.RLock()
+	sessions := a.sessions
+	a.mu.RUnlock()
+
+	// a random secret is kept so that logins survive the reload
+	if config.SessionSecret == "" && sessions != nil {
+		config.SessionSecret = string(sessions.secret)
+	}
+
+	next, err := newAuthFromConfig(config)
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		return errors.New("authentication cannot be disabled without a restart")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.authenticators = next.authenticators
+	a.sessions = next.sessions
+	a.basic = next.basic
+	a.permissions = next.permissions
+	return nil
+}
+
+// Returns the sessions of the login page, nil when there is none
+func (a *Auth) loginSessions() *Sessions {
+	if a == nil {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.sessions
+}
+
+func (a *Auth) authenticate(r *http.Request) (*Principal, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, authenticator := range a.authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if principal == nil {
+			continue
+		}
+		if a.permissions != nil {
+			a.permissions.apply(principal)
+		} else {
+			principal.Scopes = []string{ScopeAdmin}
+		}
+		return principal, nil
+	}
+	return nil, ErrNoCredentials
+}
+
+// Wraps next so that it is only reached by authenticated requests,
+// unauthenticated ones are answered by refuse
+func (a *Auth) require(next http.Handler, refuse func(http.ResponseWriter, *http.Request, error)) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.authenticate(r)
+		if err != nil {
+			if !errors.Is(err, ErrNoCredentials) {
+				log.Printf("refused %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+			}
+			refuse(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// API is middleware answering unauthenticated API requests with 401
+func (a *Auth) API(next http.Handler) http.Handler {
+	return a.require(next, func(w http.ResponseWriter, r *http.Request, err error) {
+		a.challenge(w)
+		respond(Response{
+			Status:  "error",
+			Message: err.Error(),
+		}, http.StatusUnauthorized, w)
+	})
+}
+
+// UI is middleware sending unauthenticated browsers to the login page, or
+// asking for basic auth when there is none
+func (a *Auth) UI(next http.Handler) http.Handler {
+	return a.require(next, func(w http.ResponseWriter, r *http.Request, err error) {
+		if a.loginSessions() != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		a.challenge(w)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	})
+}
+
+func (a *Auth) challenge(w http.ResponseWriter) {
+	a.mu.RLock()
+	basic := a.basic
+	a.mu.RUnlock()
+
+	if basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="rtw", charset="UTF-8"`)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="rtw"`)
+}
+
+func LoginHandler(auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessions := auth.loginSessions()
+		if sessions == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		tpl := template.Must(template.ParseFiles("templates/login.html"))
+
+		if r.Method != http.MethodPost {
+			tpl.Execute(w, nil)
+			return
+		}
+
+		name := r.PostFormValue("username")
+		if !sessions.users.Check(name, r.PostFormValue("password")) {
+			log.Printf("failed login of %q from %s", name, r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			tpl.Execute(w, "Invalid username or password")
+			return
+		}
+
+		sessions.start(w, r, name)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func LogoutHandler(auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessions := auth.loginSessions()
+		if sessions == nil {
+			http.NotFound(w, r)
+			return
+		}
+		sessions.end(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+}
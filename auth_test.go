@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Writes a users file with user alice whose password is secret
+func writeTestUsers(t *testing.T) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	err = os.WriteFile(path, []byte("# users\nalice:"+string(hash)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Returns a server requiring an API key, basic auth or a session
+func newTestAuthServer(t *testing.T) (*httptest.Server, *Sessions) {
+	t.Helper()
+
+	users, err := LoadUsers(writeTestUsers(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := NewSessions(users, []byte("test"), time.Hour)
+	auth := NewAuth(NewAPIKeys(map[string]string{"scripts": "key1"}), users, sessions)
+
+	rtorrent, _ := newTestRtorrent(t)
+	srv := httptest.NewServer(newRouter(rtorrent, auth))
+	t.Cleanup(srv.Close)
+	return srv, sessions
+}
+
+// Returns a client that does not follow redirects
+func noRedirectClient() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestAuthAPI(t *testing.T) {
+	srv, _ := newTestAuthServer(t)
+
+	tests := []struct {
+		name   string
+		header func(*http.Request)
+		code   int
+	}{
+		{"none", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"api key", func(r *http.Request) { r.Header.Set("Authorization", "Bearer key1") }, http.StatusOK},
+		{"wrong api key", func(r *http.Request) { r.Header.Set("Authorization", "Bearer key2") }, http.StatusUnauthorized},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("bob", "secret") }, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		for _, path := range []string{"/api/hello", "/metrics"} {
+			req, _ := http.NewRequest("GET", srv.URL+path, nil)
+			tt.header(req)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Errorf("%s %s: expected %d, got %d", tt.name, path, tt.code, resp.StatusCode)
+			}
+			if resp.StatusCode == http.StatusUnauthorized && !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic") {
+				t.Errorf("%s %s: expected a basic auth challenge, got %q", tt.name, path, resp.Header.Get("WWW-Authenticate"))
+			}
+		}
+	}
+}
+
+func TestAuthPreflight(t *testing.T) {
+	srv, _ := newTestAuthServer(t)
+	SetCORS(CORSConfig{Origin: "https://example.com"})
+	t.Cleanup(func() { SetCORS(CORSConfig{}) })
+
+	for _, path := range []string{"/api/view/main", "/api/torrents/actions", "/api/torrent/A/stop"} {
+		req, _ := http.NewRequest("OPTIONS", srv.URL+path, nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "authorization")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://example.com" {
+			t.Errorf("%s: expected the preflight to be answered, got %d %v", path, resp.StatusCode, resp.Header)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/api/view/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected other requests to require authentication, got %d", resp.StatusCode)
+	}
+}
+
+func TestAuthSessions(t *testing.T) {
+	srv, sessions := newTestAuthServer(t)
+	client := noRedirectClient()
+
+	resp, err := client.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login" {
+		t.Fatalf("expected a redirect to the login page, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, err = client.Get(srv.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the login page, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.PostForm(srv.URL+"/login", url.Values{"username": {"alice"}, "password": {"wrong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || len(resp.Cookies()) != 0 {
+		t.Errorf("expected login to fail, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.PostForm(srv.URL+"/login", url.Values{"username": {"alice"}, "password": {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cookies := resp.Cookies()
+	if resp.StatusCode != http.StatusSeeOther || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("expected a session cookie, got %d %v", resp.StatusCode, cookies)
+	}
+	session := cookies[0]
+
+	for _, path := range []string{"/", "/api/hello"} {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.AddCookie(session)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected the session to be accepted, got %d", path, resp.StatusCode)
+		}
+	}
+
+	forged := []string{
+		session.Value + "x",
+		strings.Replace(session.Value, ".", "x.", 1),
+		sessions.token("mallory", time.Now().Add(time.Hour)),
+		sessions.token("alice", time.Now().Add(-time.Minute)),
+	}
+	for _, value := range forged {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/hello", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected the session to be refused, got %d", value, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", srv.URL+"/logout", nil)
+	req.AddCookie(session)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if cookies := resp.Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("expected the session cookie to be cleared, got %v", cookies)
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(path, []byte("alice:plaintext\n"), 0600)
+	_, err := LoadUsers(path)
+	if err == nil {
+		t.Error("expected passwords that are not bcrypt hashes to be refused")
+	}
+
+	os.WriteFile(path, []byte("alice\n"), 0600)
+	_, err = LoadAPIKeys(path)
+	if err == nil {
+		t.Error("expected lines without a key to be refused")
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	rtorrent, _ := newTestRtorrent(t)
+	srv := httptest.NewServer(newRouter(rtorrent, nil))
+	defer srv.Close()
+
+	var resp Response
+	code := doJSON(t, "GET", srv.URL+"/api/hello", nil, "", &resp)
+	if code != http.StatusOK {
+		t.Errorf("expected the API to be open without auth, got %d", code)
+	}
+
+	r, err := http.Get(srv.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusNotFound {
+		t.Errorf("expected no login page without sessions, got %d", r.StatusCode)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Scopes a principal can be granted
+const (
+	// ScopeRead reads views, torrents, system information and events
+	ScopeRead = "read"
+	// ScopeLoad loads torrents
+	ScopeLoad = "load"
+	// ScopeControl starts, stops and otherwise changes torrents
+	ScopeControl = "control"
+	// ScopeDelete erases torrents and their data
+	ScopeDelete = "delete"
+	// ScopeRaw runs commands other than the fields rtw knows, e.g. custom
+	// view args and load commands
+	ScopeRaw = "raw"
+	// ScopeAdmin grants every scope and the administrative endpoints
+	ScopeAdmin = "admin"
+)
+
+var allScopes = map[string]bool{
+	ScopeRead: true, ScopeLoad: true, ScopeControl: true,
+	ScopeDelete: true, ScopeRaw: true, ScopeAdmin: true,
+}
+
+// Roles every permissions file can use
+var builtinRoles = map[string][]string{
+	"viewer":   {ScopeRead},
+	"uploader": {ScopeLoad},
+	"operator": {ScopeRead, ScopeLoad, ScopeControl},
+	"admin":    {ScopeAdmin},
+}
+
+var ErrForbidden = errors.New("forbidden")
+
+// Commands of the Torrent fields, anything else in view args is raw
+var torrentCommands = func() map[string]bool {
+	commands := map[string]bool{}
+	t := reflect.TypeOf(Torrent{})
+	for i := 0; i < t.NumField(); i++ {
+		if command := t.Field(i).Tag.Get("rtw"); command != "" {
+			commands[command] = true
+		}
+	}
+	return commands
+}()
+
+// Grant is what a principal may do, the scopes of its roles and its own
+// scopes. Views and labels restrict it to the torrents in those views and
+// with those labels (d.custom1) when not empty.
+type Grant struct {
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+	Views  []string `json:"views"`
+	Labels []string `json:"labels"`
+}
+
+// Permissions are the grants of principals by name. Principals without a
+// grant may do nothing.
+type Permissions struct {
+	// Roles adds to or overrides the built-in roles
+	Roles      map[string][]string `json:"roles"`
+	Principals map[string]Grant    `json:"principals"`
+}
+
+// Loads permissions from a JSON file
+func LoadPermissions(path string) (*Permissions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Permissions{}
+	err = json.Unmarshal(data, p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	err = p.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p *Permissions) role(name string) ([]string, bool) {
+	if scopes, ok := p.Roles[name]; ok {
+		return scopes, true
+	}
+	scopes, ok := builtinRoles[name]
+	return scopes, ok
+}
+
+func (p *Permissions) validate() error {
+	for role, scopes := range p.Roles {
+		for _, scope := range scopes {
+			if !allScopes[scope] {
+				return fmt.Errorf("role %s: unknown scope %s", role, scope)
+			}
+		}
+	}
+	for name, grant := range p.Principals {
+		for _, role := range grant.Roles {
+			if _, ok := p.role(role); !ok {
+				return fmt.Errorf("principal %s: unknown role %s", name, role)
+			}
+		}
+		for _, scope := range grant.Scopes {
+			if !allScopes[scope] {
+				return fmt.Errorf("principal %s: unknown scope %s", name, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// Sets the scopes, views and labels of the principal from its grant
+func (p *Permissions) apply(principal *Principal) {
+	grant := p.Principals[principal.Name]
+
+	scopes := map[string]bool{}
+	for _, role := range grant.Roles {
+		roleScopes, _ := p.role(role)
+		for _, scope := range roleScopes {
+			scopes[scope] = true
+		}
+	}
+	for _, scope := range grant.Scopes {
+		scopes[scope] = true
+	}
+
+	principal.Scopes = make([]string, 0, len(scopes))
+	for scope := range scopes {
+		principal.Scopes = append(principal.Scopes, scope)
+	}
+	principal.Views = grant.Views
+	principal.Labels = grant.Labels
+}
+
+// Reports whether the principal has scope, a nil principal (authentication
+// disabled) has every scope
+func (p *Principal) Can(scope string) bool {
+	if p == nil {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the principal may use view
+func (p *Principal) CanView(view string) bool {
+	if p == nil || len(p.Views) == 0 {
+		return true
+	}
+	for _, v := range p.Views {
+		if v == view {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the principal may see torrents labelled label
+func (p *Principal) CanLabel(label string) bool {
+	if p == nil || len(p.Labels) == 0 {
+		return true
+	}
+	for _, l := range p.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the principal is restricted to some torrents
+func (p *Principal) restricted() bool {
+	return p != nil && (len(p.Views) > 0 || len(p.Labels) > 0)
+}
+
+// Returns the views the principal's torrents are looked up in
+func (p *Principal) views() []string {
+	if p == nil || len(p.Views) == 0 {
+		return []string{"main"}
+	}
+	return p.Views
+}
+
+// Returns args with the label command added when the principal is
+// restricted to labels, so that filterTorrents can tell the labels
+func (p *Principal) labelArgs(args []interface{}) []interface{} {
+	if p == nil || len(p.Labels) == 0 {
+		return args
+	}
+	for _, arg := range args[2:] {
+		if arg == "d.custom1=" {
+			return args
+		}
+	}
+	return append(args, "d.custom1=")
+}
+
+// Returns the torrents, and their fields when not nil, with the labels the
+// principal may see
+func (p *Principal) filterTorrents(torrents []Torrent, fields []map[string]interface{}) ([]Torrent, []map[string]interface{}) {
+	if p == nil || len(p.Labels) == 0 {
+		return torrents, fields
+	}
+
+	keptTorrents := make([]Torrent, 0, len(torrents))
+	var keptFields []map[string]interface{}
+	if fields != nil {
+		keptFields = make([]map[string]interface{}, 0, len(fields))
+	}
+	for i, torrent := range torrents {
+		if !p.CanLabel(torrent.Custom1) {
+			continue
+		}
+		keptTorrents = append(keptTorrents, torrent)
+		if fields != nil {
+			keptFields = append(keptFields, fields[i])
+		}
+	}
+	return keptTorrents, keptFields
+}
+
+// Responds with 403 and reports false when the request's principal lacks
+// scope
+func authorize(w http.ResponseWriter, r *http.Request, scope string) bool {
+	if PrincipalFrom(r.Context()).Can(scope) {
+		return true
+	}
+	respond(Response{
+		Status:  "error",
+		Message: fmt.Sprintf("%s: requires the %s scope", ErrForbidden, scope),
+	}, http.StatusForbidden, w)
+	return false
+}
+
+// Wraps next so that it is only reached by principals with scope
+func scoped(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize(w, r, scope) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Responds with 403 and reports false when the principal may not use view
+func authorizeView(w http.ResponseWriter, r *http.Request, view string) bool {
+	if PrincipalFrom(r.Context()).CanView(view) {
+		return true
+	}
+	respond(Response{
+		Status:  "error",
+		Message: fmt.Sprintf("%s: view %s is not allowed", ErrForbidden, view),
+	}, http.StatusForbidden, w)
+	return false
+}
+
+// Returns the hashes, in upper case, of the torrents the principal may act
+// on, nil when it is not restricted
+func allowedHashes(ctx context.Context, rt *Rtorrent, p *Principal) (map[string]bool, error) {
+	if !p.restricted() {
+		return nil, nil
+	}
+
+	allowed := map[string]bool{}
+	for _, view := range p.views() {
+		torrents, err := rt.DMulticall(ctx, view, []interface{}{"", view, "d.hash=", "d.custom1="})
+		if err != nil {
+			return nil, err
+		}
+		for _, torrent := range torrents {
+			if p.CanLabel(torrent.Custom1) {
+				allowed[strings.ToUpper(torrent.Hash)] = true
+			}
+		}
+	}
+	return allowed, nil
+}
+
+// Returns ErrForbidden when the principal may not act on torrent hash
+func authorizeTorrent(ctx context.Context, rt *Rtorrent, p *Principal, hash string) error {
+	allowed, err := allowedHashes(ctx, rt, p)
+	if err != nil {
+		return err
+	}
+	if allowed != nil && !allowed[strings.ToUpper(hash)] {
+		return fmt.Errorf("%w: torrent %s is not allowed", ErrForbidden, hash)
+	}
+	return nil
+}
+
+// Responds with 403 and reports false when the request's principal may not
+// act on torrent hash
+func authorizeTorrentRequest(w http.ResponseWriter, r *http.Request, rt *Rtorrent, hash string) bool {
+	err := authorizeTorrent(r.Context(), rt, PrincipalFrom(r.Context()), hash)
+	if err == nil {
+		return true
+	}
+
+	statusCode := http.StatusInternalServerError
+	if errors.Is(err, ErrForbidden) {
+		statusCode = http.StatusForbidden
+	}
+	respond(Response{
+		Status:  "error",
+		Message: err.Error(),
+	}, statusCode, w)
+	return false
+}
+
+// eventGate passes the events of the torrents a principal may see. A label
+// is only known from events carrying the torrent's state, so the hashes seen
+// with an allowed label are remembered for the events without one.
+type eventGate struct {
+	principal *Principal
+	allowed   map[string]bool
+}
+
+func newEventGate(p *Principal) *eventGate {
+	return &eventGate{principal: p, allowed: map[string]bool{}}
+}
+
+func (g *eventGate) pass(e Event) bool {
+	if g.principal == nil || len(g.principal.Labels) == 0 || e.Hash == "" {
+		return true
+	}
+	if e.Torrent != nil {
+		g.allowed[e.Hash] = g.principal.CanLabel(e.Torrent.Label)
+	}
+	pass := g.allowed[e.Hash]
+	if e.Type == EventTorrentRemoved {
+		delete(g.allowed, e.Hash)
+	}
+	return pass
+}
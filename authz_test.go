@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
+)
+
+const testPermissions = `{
+	"roles": {"scripts": ["read", "raw"]},
+	"principals": {
+		"media": {"roles": ["viewer"]},
+		"raw": {"roles": ["scripts"]},
+		"bot": {"roles": ["uploader"]},
+		"ops": {"roles": ["operator"]},
+		"friend": {"roles": ["viewer"], "scopes": ["control"], "views": ["friends"], "labels": ["friends"]},
+		"root": {"roles": ["admin"]}
+	}
+}`
+
+// Returns a server with an API key for each principal of testPermissions,
+// the key is the principal's name
+func newTestAuthzServer(t *testing.T) (*httptest.Server, *rtorrenttest.Server) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "permissions.json")
+	os.WriteFile(path, []byte(testPermissions), 0600)
+	permissions, err := LoadPermissions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]string{}
+	for _, name := range []string{"media", "raw", "bot", "ops", "friend", "root", "nobody"} {
+		keys[name] = name
+	}
+	auth := NewAuth(NewAPIKeys(keys))
+	auth.permissions = permissions
+
+	rtorrent, fake := newTestRtorrent(t)
+	addTestTorrent(fake, "A", "a")
+	b := addTestTorrent(fake, "B", "b")
+	b.Fields["d.custom1"] = "friends"
+	b.Views = []string{"friends"}
+	c := addTestTorrent(fake, "C", "c")
+	c.Views = []string{"friends"}
+
+	srv := httptest.NewServer(newRouter(rtorrent, auth))
+	t.Cleanup(srv.Close)
+	return srv, fake
+}
+
+// Makes a request with the key of principal and returns the status code
+// and body
+func doAs(t *testing.T, principal, method, url, contentType, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+principal)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	buffer := bytes.NewBuffer(nil)
+	buffer.ReadFrom(resp.Body)
+	return resp.StatusCode, buffer.String()
+}
+
+func TestAuthzScopes(t *testing.T) {
+	srv, _ := newTestAuthzServer(t)
+	form := "application/x-www-form-urlencoded"
+	magnet := url.Values{"uri": {"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"}}.Encode()
+
+	tests := []struct {
+		principal   string
+		method      string
+		path        string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"nobody", "GET", "/api/hello", "", "", http.StatusForbidden},
+		{"media", "GET", "/api/view/main", "", "", http.StatusOK},
+		{"media", "GET", "/api/view/main?args=d.name,d.custom=addtime", "", "", http.StatusOK},
+		{"media", "GET", "/api/view/main?args=d.name,execute.throw=rm", "", "", http.StatusForbidden},
+		// allowed by the scope, but not a getter
+		{"raw", "GET", "/api/view/main?args=d.name,execute.throw=rm", "", "", http.StatusBadRequest},
+		{"media", "GET", "/api/torrent/A/files", "", "", http.StatusOK},
+		{"media", "POST", "/api/torrent/A/start", "", "", http.StatusForbidden},
+		{"media", "DELETE", "/api/torrent/A", "", "", http.StatusForbidden},
+		{"media", "POST", "/api/load", form, magnet, http.StatusForbidden},
+		{"media", "GET", "/metrics", "", "", http.StatusForbidden},
+		{"bot", "GET", "/api/view/main", "", "", http.StatusForbidden},
+		{"bot", "POST", "/api/load", form, magnet + "&command=d.custom2.set=x", http.StatusForbidden},
+		{"bot", "POST", "/api/load", form, magnet, http.StatusOK},
+		{"ops", "POST", "/api/torrent/A/start", "", "", http.StatusOK},
+		{"ops", "POST", "/api/torrents/actions", "", `{"action": "erase", "hashes": ["A"]}`, http.StatusForbidden},
+		{"ops", "POST", "/api/torrents/actions", "", `{"action": "stop", "hashes": ["A"]}`, http.StatusOK},
+		{"root", "GET", "/metrics", "", "", http.StatusOK},
+		{"root", "DELETE", "/api/torrent/A", "", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		code, body := doAs(t, tt.principal, tt.method, srv.URL+tt.path, tt.contentType, tt.body)
+		if code != tt.code {
+			t.Errorf("%s %s %s: expected %d, got %d: %s", tt.principal, tt.method, tt.path, tt.code, code, body)
+		}
+	}
+}
+
+func TestAuthzRestrictions(t *testing.T) {
+	srv, fake := newTestAuthzServer(t)
+
+	code, body := doAs(t, "friend", "GET", srv.URL+"/api/view/main", "", "")
+	if code != http.StatusForbidden {
+		t.Errorf("expected the main view to be forbidden, got %d", code)
+	}
+
+	code, body = doAs(t, "friend", "GET", srv.URL+"/api/view/friends?args=d.hash", "", "")
+	if code != http.StatusOK || !strings.Contains(body, `"hash":"B"`) || strings.Contains(body, `"hash":"C"`) {
+		t.Errorf("expected only torrents labelled friends, got %d %s", code, body)
+	}
+
+	code, body = doAs(t, "friend", "GET", srv.URL+"/api/view/friends?map=true&args=d.hash&sort=name", "", "")
+	if code != http.StatusOK || !strings.Contains(body, `"d.hash":"B"`) || strings.Contains(body, "d.custom1") || strings.Contains(body, "d.name") {
+		t.Errorf("expected only the selected fields, got %d %s", code, body)
+	}
+
+	for _, hash := range []string{"A", "C"} {
+		code, _ = doAs(t, "friend", "GET", srv.URL+"/api/torrent/"+hash+"/files", "", "")
+		if code != http.StatusForbidden {
+			t.Errorf("%s: expected the files to be forbidden, got %d", hash, code)
+		}
+	}
+	code, _ = doAs(t, "friend", "POST", srv.URL+"/api/torrent/B/start", "", "")
+	if code != http.StatusOK {
+		t.Errorf("expected to start an allowed torrent, got %d", code)
+	}
+
+	code, body = doAs(t, "friend", "POST", srv.URL+"/api/torrents/actions", "", `{"action": "start", "hashes": ["A", "B"]}`)
+	if code != http.StatusOK || !strings.Contains(body, `"succeeded":1,"failed":1`) {
+		t.Errorf("expected the action to be refused for A, got %d %s", code, body)
+	}
+	if torrent, _ := fake.Torrent("A"); torrent.Fields["d.state"] != int64(0) {
+		t.Error("expected A not to be started")
+	}
+
+	code, _ = doAs(t, "friend", "GET", srv.URL+"/api/events?view=main", "", "")
+	if code != http.StatusForbidden {
+		t.Errorf("expected events of the main view to be forbidden, got %d", code)
+	}
+}
+
+func TestEventGate(t *testing.T) {
+	gate := newEventGate(&Principal{Labels: []string{"friends"}})
+
+	tests := []struct {
+		event Event
+		pass  bool
+	}{
+		{Event{Type: EventStreamOpen}, true},
+		{Event{Type: EventTorrentAdded, Hash: "A", Torrent: &TorrentState{Label: "other"}}, false},
+		{Event{Type: EventTorrentAdded, Hash: "B", Torrent: &TorrentState{Label: "friends"}}, true},
+		{Event{Type: EventTorrentRemoved, Hash: "A"}, false},
+		{Event{Type: EventTorrentRemoved, Hash: "B"}, true},
+		{Event{Type: EventTorrentRemoved, Hash: "B"}, false},
+	}
+	for _, tt := range tests {
+		if got := gate.pass(tt.event); got != tt.pass {
+			t.Errorf("%+v: expected %v, got %v", tt.event, tt.pass, got)
+		}
+	}
+}
+
+func TestLoadPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "permissions.json")
+
+	for _, data := range []string{
+		`{"principals": {"a": {"scopes": ["write"]}}}`,
+		`{"principals": {"a": {"roles": ["superuser"]}}}`,
+		`{"roles": {"r": ["everything"]}}`,
+		`not json`,
+	} {
+		os.WriteFile(path, []byte(data), 0600)
+		_, err := LoadPermissions(path)
+		if err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+}
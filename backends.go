@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Backends are the rTorrent instances served by one rtw, in configuration
+// order. The first one is also served on the /api routes.
+type Backends struct {
+	list []*Rtorrent
+}
+
+var errArgsAcrossBackends = errors.New("args and map are not supported across backends")
+
+// Creates backends of the instances, at least one is required
+func NewBackends(backends ...*Rtorrent) *Backends {
+	return &Backends{list: backends}
+}
+
+// Returns the backend served on the /api routes
+func (b *Backends) Default() *Rtorrent {
+	return b.list[0]
+}
+
+// Ends the event streams and WebSocket connections of every backend
+func (b *Backends) closeStreams() {
+	b.each(func(i int, rt *Rtorrent) {
+		rt.closeStreams()
+	})
+}
+
+// Closes the XML-RPC clients of every backend
+func (b *Backends) Close() {
+	for _, rt := range b.list {
+		rt.client.Close()
+	}
+}
+
+// Calls fn for each backend concurrently and waits for all of them
+func (b *Backends) each(fn func(i int, rt *Rtorrent)) {
+	var wg sync.WaitGroup
+	for i, rt := range b.list {
+		wg.Add(1)
+		go func(i int, rt *Rtorrent) {
+			defer wg.Done()
+			fn(i, rt)
+		}(i, rt)
+	}
+	wg.Wait()
+}
+
+// BackendStatus is the outcome of an aggregated call for one backend
+type BackendStatus struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	// Total is the number of torrents in the backend's view
+	Total int `json:"total"`
+}
+
+// BackendTorrent is a torrent tagged with its backend
+type BackendTorrent struct {
+	Backend string `json:"backend"`
+	Torrent
+}
+
+type AggregateViewResponse struct {
+	Status   string           `json:"status"`
+	Total    int              `json:"total"`
+	Filtered int              `json:"filtered"`
+	Backends []BackendStatus  `json:"backends"`
+	Torrents []BackendTorrent `json:"torrents"`
+}
+
+// BackendSystem is the system information of one backend
+type BackendSystem struct {
+	Backend string  `json:"backend"`
+	Status  string  `json:"status"`
+	Message string  `json:"message,omitempty"`
+	System  *System `json:"system,omitempty"`
+}
+
+type AggregateSystemResponse struct {
+	Status  string          `json:"status"`
+	Systems []BackendSystem `json:"systems"`
+}
+
+type BackendsResponse struct {
+	Status   string   `json:"status"`
+	Backends []string `json:"backends"`
+}
+
+// Lists the names of the backends
+func BackendsHandler(backends *Backends) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := BackendsResponse{
+			Status:   "ok",
+			Backends: make([]string, 0, len(backends.list)),
+		}
+		for _, rt := range backends.list {
+			response.Backends = append(response.Backends, rt.name)
+		}
+		respond(response, http.StatusOK, w)
+	}
+}
+
+// Returns the default fields of the torrents in a view of every backend,
+// filtered, sorted and paginated together as by the view handler. A
+// backend that fails is reported in backends, the response only fails
+// when all of them do.
+func AggregateViewHandler(backends *Backends) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		view := mux.Vars(r)["view"]
+		principal := PrincipalFrom(r.Context())
+
+		if !authorizeView(w, r, view) {
+			return
+		}
+
+		query, err := parseViewQuery(r.URL.RawQuery)
+		if err == nil && (query.asMap || r.URL.Query().Has("args")) {
+			err = errArgsAcrossBackends
+		}
+		if err != nil {
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, http.StatusBadRequest, w)
+			return
+		}
+		args := query.addCommands(principal.labelArgs(viewArgs(view)))
+
+		statuses := make([]BackendStatus, len(backends.list))
+		results := make([][]Torrent, len(backends.list))
+		backends.each(func(i int, rt *Rtorrent) {
+			statuses[i] = BackendStatus{Name: rt.name, Status: "ok"}
+			torrents, err := rt.DMulticall(r.Context(), view, args)
+			if err != nil {
+				log.Printf("error in aggregate view handler for backend %s: %s", rt.name, err)
+				statuses[i].Status = "error"
+				statuses[i].Message = err.Error()
+				return
+			}
+			results[i], _ = principal.filterTorrents(torrents, nil)
+			statuses[i].Total = len(results[i])
+		})
+
+		// merged in backend order, names is the backend of each torrent
+		torrents := []Torrent{}
+		names := []string{}
+		failed := 0
+		for i, status := range statuses {
+			if status.Status != "ok" {
+				failed++
+				continue
+			}
+			torrents = append(torrents, results[i]...)
+			for range results[i] {
+				names = append(names, status.Name)
+			}
+		}
+
+		if failed == len(statuses) {
+			respond(AggregateViewResponse{
+				Status:   "error",
+				Backends: statuses,
+				Torrents: []BackendTorrent{},
+			}, http.StatusBadGateway, w)
+			return
+		}
+
+		page, filtered := query.apply(torrents)
+		response := AggregateViewResponse{
+			Status:   "ok",
+			Total:    len(torrents),
+			Filtered: filtered,
+			Backends: statuses,
+			Torrents: make([]BackendTorrent, 0, len(page)),
+		}
+		for _, i := range page {
+			response.Torrents = append(response.Torrents, BackendTorrent{Backend: names[i], Torrent: torrents[i]})
+		}
+		respond(response, http.StatusOK, w)
+	}
+}
+
+// Returns the system information of every backend, a backend that fails
+// is reported in its entry
+func AggregateSystemHandler(backends *Backends) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		systems := make([]BackendSystem, len(backends.list))
+		backends.each(func(i int, rt *Rtorrent) {
+			systems[i] = BackendSystem{Backend: rt.name, Status: "ok"}
+			system, err := rt.SystemMulticall(r.Context(), systemArgs())
+			if err != nil {
+				log.Printf("error in aggregate system handler for backend %s: %s", rt.name, err)
+				systems[i].Status = "error"
+				systems[i].Message = err.Error()
+				return
+			}
+			systems[i].System = &system
+		})
+
+		response := AggregateSystemResponse{
+			Status:  "error",
+			Systems: systems,
+		}
+		statusCode := http.StatusBadGateway
+		for _, system := range systems {
+			if system.Status == "ok" {
+				response.Status = "ok"
+				statusCode = http.StatusOK
+				break
+			}
+		}
+		respond(response, statusCode, w)
+	}
+}
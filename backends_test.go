@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
+)
+
+// Returns a server with two named backends, a and b
+func newTestBackendsServer(t *testing.T) (*httptest.Server, *rtorrenttest.Server, *rtorrenttest.Server) {
+	t.Helper()
+
+	a, fakeA := newTestRtorrent(t)
+	a.name = "a"
+	addTestTorrent(fakeA, "A1", "a1")
+	addTestTorrent(fakeA, "A2", "a2")
+
+	b, fakeB := newTestRtorrent(t)
+	b.name = "b"
+	addTestTorrent(fakeB, "B1", "b1")
+
+	srv := httptest.NewServer(newBackendsRouter(NewBackends(a, b), nil))
+	t.Cleanup(srv.Close)
+	return srv, fakeA, fakeB
+}
+
+// Makes a fake fail the calls of the aggregate handlers
+func failTestBackend(fake *rtorrenttest.Server) {
+	fail := func(params []interface{}) (interface{}, error) {
+		return nil, errors.New("unavailable")
+	}
+	fake.Handle("d.multicall2", fail)
+	fake.Handle("system.multicall", fail)
+}
+
+func TestBackendRoutes(t *testing.T) {
+	srv, _, _ := newTestBackendsServer(t)
+
+	var backends BackendsResponse
+	code := doJSON(t, "GET", srv.URL+"/api/backends", nil, "", &backends)
+	if code != http.StatusOK || len(backends.Backends) != 2 || backends.Backends[0] != "a" || backends.Backends[1] != "b" {
+		t.Errorf("expected the backends in order, got %d %+v", code, backends)
+	}
+
+	tests := []struct {
+		path  string
+		total int
+	}{
+		{"/api/view/main", 2},
+		{"/api/backends/a/view/main", 2},
+		{"/api/backends/b/view/main", 1},
+	}
+	for _, tt := range tests {
+		var view ViewResponse
+		code := doJSON(t, "GET", srv.URL+tt.path, nil, "", &view)
+		if code != http.StatusOK || view.Total != tt.total {
+			t.Errorf("%s: expected %d torrents, got %d %+v", tt.path, tt.total, code, view)
+		}
+	}
+
+	for path, want := range map[string]string{
+		"/metrics":                `rtorrent_torrents{view="main",state="stopped"} 2`,
+		"/api/backends/a/metrics": `rtorrent_torrents{view="main",state="stopped"} 2`,
+		"/api/backends/b/metrics": `rtorrent_torrents{view="main",state="stopped"} 1`,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+			t.Errorf("%s: expected the metrics of the backend, got %d:\n%s", path, resp.StatusCode, body)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/api/backends/c/view/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an unknown backend to be 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestAggregateView(t *testing.T) {
+	srv, _, fakeB := newTestBackendsServer(t)
+
+	var view AggregateViewResponse
+	code := doJSON(t, "GET", srv.URL+"/api/aggregate/view/main?offset=1&limit=2", nil, "", &view)
+	if code != http.StatusOK || view.Total != 3 || view.Filtered != 3 || len(view.Torrents) != 2 {
+		t.Fatalf("expected a page of the merged torrents, got %d %+v", code, view)
+	}
+	if view.Torrents[0].Backend != "a" || view.Torrents[0].Hash != "A2" || view.Torrents[1].Backend != "b" || view.Torrents[1].Hash != "B1" {
+		t.Errorf("expected the torrents tagged with their backend, got %+v", view.Torrents)
+	}
+
+	var resp Response
+	for _, query := range []string{"args=d.name=", "map=true"} {
+		code = doJSON(t, "GET", srv.URL+"/api/aggregate/view/main?"+query, nil, "", &resp)
+		if code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+
+	failTestBackend(fakeB)
+	view = AggregateViewResponse{}
+	code = doJSON(t, "GET", srv.URL+"/api/aggregate/view/main", nil, "", &view)
+	if code != http.StatusOK || view.Total != 2 || len(view.Backends) != 2 {
+		t.Fatalf("expected the torrents of the working backend, got %d %+v", code, view)
+	}
+	if view.Backends[0].Status != "ok" || view.Backends[0].Total != 2 || view.Backends[1].Status != "error" || view.Backends[1].Message == "" {
+		t.Errorf("expected the failing backend to be reported, got %+v", view.Backends)
+	}
+}
+
+func TestAggregateAllFailing(t *testing.T) {
+	srv, fakeA, fakeB := newTestBackendsServer(t)
+
+	var system AggregateSystemResponse
+	code := doJSON(t, "GET", srv.URL+"/api/aggregate/system", nil, "", &system)
+	if code != http.StatusOK || len(system.Systems) != 2 || system.Systems[1].Backend != "b" || system.Systems[1].System == nil {
+		t.Errorf("expected the system of each backend, got %d %+v", code, system)
+	}
+
+	failTestBackend(fakeA)
+	failTestBackend(fakeB)
+
+	var view AggregateViewResponse
+	code = doJSON(t, "GET", srv.URL+"/api/aggregate/view/main", nil, "", &view)
+	if code != http.StatusBadGateway || view.Status != "error" {
+		t.Errorf("expected 502 when all backends fail, got %d %+v", code, view)
+	}
+	system = AggregateSystemResponse{}
+	code = doJSON(t, "GET", srv.URL+"/api/aggregate/system", nil, "", &system)
+	if code != http.StatusBadGateway || system.Status != "error" || system.Systems[0].Message == "" {
+		t.Errorf("expected 502 when all backends fail, got %d %+v", code, system)
+	}
+}
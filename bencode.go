@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// maxBencodeDepth bounds nesting so hostile input cannot exhaust the stack,
+// v2 file trees nest one level per directory
+const maxBencodeDepth = 256
+
+// BencodeError describes malformed bencoded data
+type BencodeError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *BencodeError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+}
+
+// Decodes bencoded data. Integers decode to int64, byte strings to string,
+// lists to []interface{} and dictionaries to map[string]interface{}.
+func bencodeDecode(data []byte) (interface{}, error) {
+	d := &bdecoder{data: data}
+	value, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, d.error("trailing data")
+	}
+	return value, nil
+}
+
+// Returns the raw encoded value of each key of the top level dictionary, the
+// info hash has to be computed over the bytes exactly as they were sent
+func bencodeRawDict(data []byte) (map[string][]byte, error) {
+	d := &bdecoder{data: data}
+	if d.peek() != 'd' {
+		return nil, d.error("expected dictionary")
+	}
+	d.pos++
+
+	raw := map[string][]byte{}
+	for d.peek() != 'e' {
+		key, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		start := d.pos
+		if _, err := d.value(1); err != nil {
+			return nil, err
+		}
+		raw[key] = d.data[start:d.pos]
+	}
+	d.pos++
+
+	if d.pos != len(d.data) {
+		return nil, d.error("trailing data")
+	}
+	return raw, nil
+}
+
+type bdecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *bdecoder) error(msg string) error {
+	return &BencodeError{Offset: d.pos, Msg: msg}
+}
+
+// Returns the next byte or 0 at the end of data
+func (d *bdecoder) peek() byte {
+	if d.pos >= len(d.data) {
+		return 0
+	}
+	return d.data[d.pos]
+}
+
+func (d *bdecoder) value(depth int) (interface{}, error) {
+	if depth > maxBencodeDepth {
+		return nil, d.error("nesting too deep")
+	}
+
+	switch c := d.peek(); {
+	case c == 'i':
+		return d.integer()
+	case c == 'l':
+		d.pos++
+		list := []interface{}{}
+		for d.peek() != 'e' {
+			if d.peek() == 0 {
+				return nil, d.error("unterminated list")
+			}
+			value, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		d.pos++
+		return list, nil
+	case c == 'd':
+		d.pos++
+		dict := map[string]interface{}{}
+		for d.peek() != 'e' {
+			if d.peek() == 0 {
+				return nil, d.error("unterminated dictionary")
+			}
+			key, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := dict[key]; ok {
+				return nil, d.error(fmt.Sprintf("duplicate key %q", key))
+			}
+			value, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = value
+		}
+		d.pos++
+		return dict, nil
+	case c >= '0' && c <= '9':
+		return d.string()
+	case c == 0:
+		return nil, d.error("unexpected end of data")
+	default:
+		return nil, d.error(fmt.Sprintf("invalid type %q", c))
+	}
+}
+
+func (d *bdecoder) integer() (int64, error) {
+	// skip 'i'
+	d.pos++
+	start := d.pos
+	for d.peek() != 'e' {
+		if d.peek() == 0 {
+			return 0, d.error("unterminated integer")
+		}
+		d.pos++
+	}
+	digits := string(d.data[start:d.pos])
+	d.pos++
+
+	if digits == "" || digits == "-" || digits == "-0" ||
+		(len(digits) > 1 && digits[0] == '0') ||
+		(len(digits) > 2 && digits[0] == '-' && digits[1] == '0') {
+		return 0, &BencodeError{Offset: start, Msg: fmt.Sprintf("invalid integer %q", digits)}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, &BencodeError{Offset: start, Msg: fmt.Sprintf("invalid integer %q", digits)}
+	}
+	return n, nil
+}
+
+func (d *bdecoder) string() (string, error) {
+	start := d.pos
+	for d.peek() >= '0' && d.peek() <= '9' {
+		d.pos++
+	}
+	if d.pos == start || d.peek() != ':' {
+		return "", d.error("expected string")
+	}
+	digits := string(d.data[start:d.pos])
+	if len(digits) > 1 && digits[0] == '0' {
+		return "", &BencodeError{Offset: start, Msg: "string length has leading zeros"}
+	}
+	length, err := strconv.Atoi(digits)
+	if err != nil || length > len(d.data)-d.pos-1 {
+		return "", &BencodeError{Offset: start, Msg: "string length exceeds data"}
+	}
+	d.pos++
+
+	s := string(d.data[d.pos : d.pos+length])
+	d.pos += length
+	return s, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBencodeDecode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{"i42e", int64(42)},
+		{"i-7e", int64(-7)},
+		{"i0e", int64(0)},
+		{"4:spam", "spam"},
+		{"0:", ""},
+		{"le", []interface{}{}},
+		{"l4:spami1ee", []interface{}{"spam", int64(1)}},
+		{"d3:bar4:spam3:fooi42ee", map[string]interface{}{"bar": "spam", "foo": int64(42)}},
+		{"d1:ld1:xi1eee", map[string]interface{}{"l": map[string]interface{}{"x": int64(1)}}},
+	}
+
+	for _, tt := range tests {
+		got, err := bencodeDecode([]byte(tt.input))
+		if err != nil {
+			t.Errorf("%q: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: expected %#v, got %#v", tt.input, tt.want, got)
+		}
+	}
+}
+
+func TestBencodeDecodeInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"i42",
+		"ie",
+		"i-e",
+		"i-0e",
+		"i03e",
+		"i1.5e",
+		"i99999999999999999999e",
+		"5:spam",
+		"05:spams",
+		"4spam",
+		"l4:spam",
+		"d3:foo",
+		"di1ei2ee",
+		"d3:fooi1e3:fooi2ee",
+		"i1ei2e",
+		"x",
+		strings.Repeat("l", maxBencodeDepth+2) + strings.Repeat("e", maxBencodeDepth+2),
+	}
+
+	for _, input := range tests {
+		_, err := bencodeDecode([]byte(input))
+		var bencodeErr *BencodeError
+		if !errors.As(err, &bencodeErr) {
+			t.Errorf("%q: expected bencode error, got %v", input, err)
+		}
+	}
+}
+
+func TestBencodeRawDict(t *testing.T) {
+	raw, err := bencodeRawDict([]byte("d8:announce3:url4:infod4:name1:xee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw["info"]) != "d4:name1:xe" || string(raw["announce"]) != "3:url" {
+		t.Errorf("unexpected raw values: %q", raw)
+	}
+
+	for _, input := range []string{"l1:xe", "d4:infod4:name1:xe", "d4:infoi1eeextra"} {
+		_, err := bencodeRawDict([]byte(input))
+		if err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
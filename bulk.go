@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// bulkBatchSize is the number of calls sent in one system.multicall
+const bulkBatchSize = 100
+
+// Commands of the actions that can be applied to many torrents at once
+var bulkCommands = map[string]string{
+	"start":      "d.start",
+	"stop":       "d.stop",
+	"pause":      "d.pause",
+	"resume":     "d.resume",
+	"open":       "d.open",
+	"close":      "d.close",
+	"check_hash": "d.check_hash",
+	"erase":      "d.erase",
+}
+
+// ActionResult is the outcome of an action for one torrent
+type ActionResult struct {
+	Hash    string `json:"hash"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// Runs command for each hash in batched system.multicall calls. A failure is
+// reported in the result of the torrent it belongs to, a failed batch marks
+// all of its torrents failed and the remaining batches are still sent.
+func (rt *Rtorrent) Bulk(ctx context.Context, command string, hashes []string) []ActionResult {
+	results := make([]ActionResult, 0, len(hashes))
+
+	for start := 0; start < len(hashes); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		batch := hashes[start:end]
+
+		calls := make([]interface{}, 0, len(batch))
+		for _, hash := range batch {
+			calls = append(calls, SystemCall{
+				MethodName: command,
+				Params:     []string{hash},
+			})
+		}
+
+		var result interface{}
+		err := rt.client.Call(ctx, "system.multicall", []interface{}{calls}, &result)
+		for _, hash := range batch {
+			rt.cache.invalidate(hash)
+		}
+		values, ok := result.([]interface{})
+		if err == nil && (!ok || len(values) != len(batch)) {
+			err = fmt.Errorf("expected %d results from system.multicall, got %s", len(batch), xmlrpcType(result))
+		}
+
+		for i, hash := range batch {
+			r := ActionResult{Hash: hash, Status: "ok"}
+			if err != nil {
+				r.Status = "error"
+				r.Message = err.Error()
+			} else if _, err := multicallValue(values[i]); err != nil {
+				r.Status = "error"
+				r.Message = err.Error()
+			}
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+// Returns the hashes of the torrents in view that match the filter. The
+// view is read past the cache since the hashes are acted on.
+func (rt *Rtorrent) FilterHashes(ctx context.Context, view string, filter Filter) ([]string, error) {
+	args := []interface{}{"", view, "d.hash="}
+	for _, command := range filter.Commands() {
+		args = append(args, command)
+	}
+
+	torrents, err := rt.DMulticall(withoutCache(ctx), view, args)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := []string{}
+	for _, torrent := range torrents {
+		if filter.Match(torrent) {
+			hashes = append(hashes, torrent.Hash)
+		}
+	}
+	return hashes, nil
+}
+
+// Returns the hashes without duplicates, keeping the first occurrence
+func uniqueHashes(hashes []string) []string {
+	seen := map[string]bool{}
+	unique := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		key := strings.ToUpper(hash)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, hash)
+	}
+	return unique
+}
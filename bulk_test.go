@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
+)
+
+func TestBulk(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+
+	hashes := []string{}
+	for i := 0; i < bulkBatchSize+5; i++ {
+		hash := fmt.Sprintf("%040X", i)
+		addTestTorrent(fake, hash, fmt.Sprintf("torrent %d", i))
+		hashes = append(hashes, hash)
+	}
+	hashes = append(hashes, "MISSING")
+
+	results := rtorrent.Bulk(context.Background(), "d.stop", hashes)
+	if len(results) != len(hashes) {
+		t.Fatalf("expected %d results, got %d", len(hashes), len(results))
+	}
+	for i, result := range results[:len(results)-1] {
+		if result.Hash != hashes[i] || result.Status != "ok" {
+			t.Errorf("unexpected result: %+v", result)
+		}
+	}
+	if missing := results[len(results)-1]; missing.Status != "error" || missing.Message == "" {
+		t.Errorf("expected missing torrent to fail, got %+v", missing)
+	}
+
+	torrent, _ := fake.Torrent(hashes[0])
+	if torrent.Fields["d.state"] != int64(0) {
+		t.Errorf("expected torrent to be stopped")
+	}
+
+	multicalls := 0
+	for _, call := range fake.Calls() {
+		if call == "system.multicall" {
+			multicalls++
+		}
+	}
+	if multicalls != 2 {
+		t.Errorf("expected 2 batches, got %d", multicalls)
+	}
+}
+
+func TestBulkContextCancelled(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	addTestTorrent(fake, "A", "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results := rtorrent.Bulk(ctx, "d.stop", []string{"A"})
+	if len(results) != 1 || results[0].Status != "error" {
+		t.Errorf("expected failed result, got %+v", results)
+	}
+}
+
+func TestFilterHashes(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	addTestTorrent(fake, "A", "a").Fields["d.message"] = "Unregistered torrent"
+	addTestTorrent(fake, "B", "b")
+
+	filter, err := ParseFilter([]string{"message~=unregistered"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := rtorrent.FilterHashes(context.Background(), "main", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || hashes[0] != "A" {
+		t.Errorf("unexpected hashes %v", hashes)
+	}
+}
+
+func TestFilterHashesUncached(t *testing.T) {
+	rtorrent, fake := newTestCache(t)
+	addTestTorrent(fake, "A", "a")
+	addTestTorrent(fake, "B", "b")
+
+	filter, err := ParseFilter([]string{"message~=unregistered"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	args := []interface{}{"", "main", "d.hash="}
+	for _, command := range filter.Commands() {
+		args = append(args, command)
+	}
+	rtorrent.DMulticall(ctx, "main", args)
+
+	fake.Update("B", rtorrenttest.Item{"d.message": "Unregistered torrent"})
+	hashes, err := rtorrent.FilterHashes(ctx, "main", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || hashes[0] != "B" {
+		t.Errorf("expected the current torrents to be matched, got %v", hashes)
+	}
+}
+
+func TestUniqueHashes(t *testing.T) {
+	unique := uniqueHashes([]string{"a", "B", "A", "b", "c"})
+	if fmt.Sprint(unique) != "[a B c]" {
+		t.Errorf("unexpected hashes %v", unique)
+	}
+}
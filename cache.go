@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig sets how long results of each kind of call are reused, zero
+// disables caching of that kind
+type CacheConfig struct {
+	// ViewTTL applies to d.multicall2
+	ViewTTL time.Duration `yaml:"view_ttl"`
+	// SystemTTL applies to system.multicall
+	SystemTTL time.Duration `yaml:"system_ttl"`
+	// TorrentTTL applies to the f.multicall, p.multicall and t.multicall of
+	// one torrent
+	TorrentTTL time.Duration `yaml:"torrent_ttl"`
+}
+
+type cacheKind int
+
+const (
+	cacheView cacheKind = iota
+	cacheSystem
+	cacheTorrent
+)
+
+type cacheEntry struct {
+	kind    cacheKind
+	hash    string
+	result  interface{}
+	fetched time.Time
+}
+
+// cacheCall is a call in flight that identical calls wait for
+type cacheCall struct {
+	kind cacheKind
+	hash string
+	done chan struct{}
+
+	result  interface{}
+	err     error
+	fetched time.Time
+	// abandoned is set when the caller that made the call went away, the
+	// callers waiting for it make their own
+	abandoned bool
+	// stale is set when a write invalidates the call while it is in flight,
+	// its result is returned but not kept
+	stale bool
+}
+
+// rpcCache reuses the raw results of read calls and collapses identical
+// calls in flight into one, so that many clients polling the same view cost
+// rTorrent one call. Results are decoded by every caller, nothing decoded is
+// shared.
+type rpcCache struct {
+	config CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	calls   map[string]*cacheCall
+}
+
+func newRPCCache(config CacheConfig) *rpcCache {
+	return &rpcCache{
+		config:  config,
+		entries: map[string]cacheEntry{},
+		calls:   map[string]*cacheCall{},
+	}
+}
+
+// Sets the TTLs, results already cached expire by the new ones
+func (c *rpcCache) setConfig(config CacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = config
+}
+
+// Returns the TTL of kind, mu must be held
+func (c *rpcCache) ttl(kind cacheKind) time.Duration {
+	switch kind {
+	case cacheView:
+		return c.config.ViewTTL
+	case cacheSystem:
+		return c.config.SystemTTL
+	case cacheTorrent:
+		return c.config.TorrentTTL
+	}
+	return 0
+}
+
+// Returns the result of method with args, from the cache when it is younger
+// than the TTL of kind, otherwise from fetch. hash is the torrent the result
+// belongs to for torrent calls. The age of the result is recorded in the
+// context's cache age.
+func (c *rpcCache) get(ctx context.Context, kind cacheKind, hash string, method string, args interface{}, fetch func(context.Context) (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	ttl := c.ttl(kind)
+	c.mu.Unlock()
+	if ttl <= 0 || ctx.Value(noCacheKey{}) != nil {
+		return fetch(ctx)
+	}
+
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return fetch(ctx)
+	}
+	key := method + " " + string(encoded)
+
+	for {
+		c.mu.Lock()
+		if entry, ok := c.entries[key]; ok {
+			age := time.Since(entry.fetched)
+			if age < ttl {
+				c.mu.Unlock()
+				recordCacheAge(ctx, age)
+				return entry.result, nil
+			}
+			delete(c.entries, key)
+		}
+
+		call, ok := c.calls[key]
+		if !ok {
+			call = &cacheCall{kind: kind, hash: hash, done: make(chan struct{})}
+			c.calls[key] = call
+			c.mu.Unlock()
+
+			c.fetch(ctx, key, call, fetch)
+			return call.result, call.err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.abandoned {
+			continue
+		}
+		if call.err == nil {
+			recordCacheAge(ctx, time.Since(call.fetched))
+		}
+		return call.result, call.err
+	}
+}
+
+// Makes the call for everyone waiting on it and keeps the result
+func (c *rpcCache) fetch(ctx context.Context, key string, call *cacheCall, fetch func(context.Context) (interface{}, error)) {
+	defer close(call.done)
+
+	call.result, call.err = fetch(ctx)
+	call.fetched = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	call.abandoned = call.err != nil && ctx.Err() != nil
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	if call.err != nil || call.stale {
+		return
+	}
+
+	c.prune(call.fetched)
+	c.entries[key] = cacheEntry{
+		kind:    call.kind,
+		hash:    call.hash,
+		result:  call.result,
+		fetched: call.fetched,
+	}
+}
+
+// Drops expired entries so that results of calls that are not repeated do
+// not pile up
+func (c *rpcCache) prune(now time.Time) {
+	for key, entry := range c.entries {
+		if now.Sub(entry.fetched) >= c.ttl(entry.kind) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Forgets what a write to torrent hash may have changed, the views and the
+// calls of the torrent. An empty hash only forgets the views, e.g. after a
+// torrent is loaded.
+func (c *rpcCache) invalidate(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	affected := func(kind cacheKind, h string) bool {
+		return kind == cacheView || (kind == cacheTorrent && hash != "" && strings.EqualFold(h, hash))
+	}
+
+	for key, entry := range c.entries {
+		if affected(entry.kind, entry.hash) {
+			delete(c.entries, key)
+		}
+	}
+	// calls in flight may have been answered before the write, later
+	// callers make a new one
+	for key, call := range c.calls {
+		if affected(call.kind, call.hash) {
+			call.stale = true
+			delete(c.calls, key)
+		}
+	}
+}
+
+type noCacheKey struct{}
+
+// Returns a context whose calls bypass the cache, for reads that must see
+// the current state
+func withoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+type cacheAgeKey struct{}
+
+// CacheAge is the age of the oldest cached result served to a request
+type CacheAge struct {
+	age time.Duration
+}
+
+// Returns a context that records the age of the cached results its calls are
+// served
+func withCacheAge(ctx context.Context) (context.Context, *CacheAge) {
+	age := &CacheAge{}
+	return context.WithValue(ctx, cacheAgeKey{}, age), age
+}
+
+func recordCacheAge(ctx context.Context, age time.Duration) {
+	recorder, ok := ctx.Value(cacheAgeKey{}).(*CacheAge)
+	if ok && age > recorder.age {
+		recorder.age = age
+	}
+}
+
+// Milliseconds returns the age in milliseconds, zero when every result was
+// fetched for the request
+func (a *CacheAge) Milliseconds() int64 {
+	return a.age.Milliseconds()
+}
+
+// Returns the first argument of a torrent call, the hash
+func argsHash(args interface{}) string {
+	values, ok := args.([]interface{})
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	hash, _ := values[0].(string)
+	return hash
+}
+
+// Calls a read method through the cache
+func (rt *Rtorrent) cachedCall(ctx context.Context, kind cacheKind, hash string, method string, args interface{}) (interface{}, error) {
+	return rt.cache.get(ctx, kind, hash, method, args, func(ctx context.Context) (interface{}, error) {
+		var result interface{}
+		err := rt.client.Call(ctx, method, args, &result)
+		return result, err
+	})
+}
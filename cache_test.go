@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
+)
+
+// Returns an Rtorrent that caches every kind of call for a minute
+func newTestCache(t *testing.T) (*Rtorrent, *rtorrenttest.Server) {
+	t.Helper()
+
+	rtorrent, fake := newTestRtorrent(t)
+	rtorrent.cache = newRPCCache(CacheConfig{
+		ViewTTL:    time.Minute,
+		SystemTTL:  time.Minute,
+		TorrentTTL: time.Minute,
+	})
+	return rtorrent, fake
+}
+
+// Counts the calls of method made to the fake
+func countCalls(fake *rtorrenttest.Server, method string) int {
+	n := 0
+	for _, call := range fake.Calls() {
+		if call == method {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCacheCollapsesCalls(t *testing.T) {
+	cache := newRPCCache(CacheConfig{ViewTTL: time.Minute})
+
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return "result", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = cache.get(context.Background(), cacheView, "", "d.multicall2", []interface{}{"", "main"}, fetch)
+		}(i)
+	}
+
+	// wait for the callers to queue up behind the first one
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&fetches) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected one fetch, got %d", n)
+	}
+	for i, result := range results {
+		if result != "result" {
+			t.Errorf("%d: unexpected result %v", i, result)
+		}
+	}
+}
+
+func TestCacheAbandonedCall(t *testing.T) {
+	cache := newRPCCache(CacheConfig{ViewTTL: time.Minute})
+	args := []interface{}{"", "main"}
+
+	started := make(chan struct{})
+	leader, cancel := context.WithCancel(context.Background())
+	go cache.get(leader, cacheView, "", "d.multicall2", args, func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+
+	done := make(chan interface{})
+	go func() {
+		result, _ := cache.get(context.Background(), cacheView, "", "d.multicall2", args, func(ctx context.Context) (interface{}, error) {
+			return "retried", nil
+		})
+		done <- result
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case result := <-done:
+		if result != "retried" {
+			t.Errorf("expected the waiting caller to retry, got %v", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiting caller did not return")
+	}
+}
+
+func TestCacheErrorsNotKept(t *testing.T) {
+	cache := newRPCCache(CacheConfig{SystemTTL: time.Minute})
+	args := []interface{}{"system.pid"}
+
+	_, err := cache.get(context.Background(), cacheSystem, "", "system.multicall", args, func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("down")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	result, err := cache.get(context.Background(), cacheSystem, "", "system.multicall", args, func(ctx context.Context) (interface{}, error) {
+		return "up", nil
+	})
+	if err != nil || result != "up" {
+		t.Errorf("expected the call to be made again, got %v %v", result, err)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	rtorrent, fake := newTestCache(t)
+	addTestTorrent(fake, "A", "a")
+	addTestTorrent(fake, "B", "b")
+	ctx := context.Background()
+	args := []interface{}{"", "main", "d.hash=", "d.state="}
+
+	for i := 0; i < 3; i++ {
+		_, err := rtorrent.DMulticall(ctx, "main", args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rtorrent.FMulticall(ctx, fileArgs("A"))
+		rtorrent.FMulticall(ctx, fileArgs("B"))
+	}
+	if n := countCalls(fake, "d.multicall2"); n != 1 {
+		t.Fatalf("expected one d.multicall2, got %d", n)
+	}
+	if n := countCalls(fake, "f.multicall"); n != 2 {
+		t.Fatalf("expected two f.multicall, got %d", n)
+	}
+
+	err := rtorrent.Start(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrents, err := rtorrent.DMulticall(ctx, "main", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countCalls(fake, "d.multicall2"); n != 2 || torrents[0].State != 1 {
+		t.Errorf("expected the view to be fetched again after a write, %d calls, state %d", n, torrents[0].State)
+	}
+
+	rtorrent.FMulticall(ctx, fileArgs("A"))
+	rtorrent.FMulticall(ctx, fileArgs("B"))
+	if n := countCalls(fake, "f.multicall"); n != 3 {
+		t.Errorf("expected only the files of A to be fetched again, got %d f.multicall", n)
+	}
+
+	rtorrent.DMulticall(withoutCache(ctx), "main", args)
+	if n := countCalls(fake, "d.multicall2"); n != 3 {
+		t.Errorf("expected a call bypassing the cache, got %d d.multicall2", n)
+	}
+}
+
+func TestCacheAge(t *testing.T) {
+	rtorrent, fake := newTestCache(t)
+	addTestTorrent(fake, "A", "a")
+	srv := httptest.NewServer(newRouter(rtorrent, nil))
+	defer srv.Close()
+
+	var first ViewResponse
+	doJSON(t, "GET", srv.URL+"/api/view/main", nil, "", &first)
+	if first.CacheAge != 0 {
+		t.Errorf("expected a fresh result, got age %d", first.CacheAge)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	var second ViewResponse
+	doJSON(t, "GET", srv.URL+"/api/view/main", nil, "", &second)
+	if second.CacheAge < 20 {
+		t.Errorf("expected a cached result at least 20ms old, got %d", second.CacheAge)
+	}
+	if n := countCalls(fake, "d.multicall2"); n != 1 {
+		t.Errorf("expected one d.multicall2, got %d", n)
+	}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of rtw. It is read from a YAML file,
+// environment variables and flags, each overriding the one before.
+type Config struct {
+	// BindAddress is the IP:port the server listens on
+	BindAddress string `yaml:"bind_address"`
+	// PProf registers the pprof routes
+	PProf bool `yaml:"pprof"`
+	// ShutdownTimeout is how long in-flight requests are waited for on
+	// SIGINT or SIGTERM
+	ShutdownTimeout time.Duration  `yaml:"shutdown_timeout"`
+	Rtorrent        UpstreamConfig `yaml:"rtorrent"`
+	// Backends are more rTorrent instances, each served on
+	// /api/backends/{name}
+	Backends []BackendConfig `yaml:"backends"`
+	// EventInterval is how often views are polled for event streams
+	EventInterval time.Duration `yaml:"event_interval"`
+	Cache         CacheConfig   `yaml:"cache"`
+	Metrics       MetricsConfig `yaml:"metrics"`
+	Auth          AuthConfig    `yaml:"auth"`
+	Audit         AuditConfig   `yaml:"audit"`
+	CORS          CORSConfig    `yaml:"cors"`
+	TLS           TLSConfig     `yaml:"tls"`
+}
+
+// UpstreamConfig is how rTorrent is reached
+type UpstreamConfig struct {
+	// URL is the XML-RPC endpoint or the scgi:// address of rTorrent
+	URL string `yaml:"url"`
+	// Username and Password are sent with basic auth when both are set
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Auth is how the username and password are sent, basic or digest
+	Auth string `yaml:"auth"`
+	// BearerToken is sent as Authorization: Bearer
+	BearerToken string `yaml:"bearer_token"`
+	// Headers are set on every request, only by the file
+	Headers map[string]string `yaml:"headers"`
+	// CAFile is a PEM bundle verifying https:// endpoints instead of the
+	// system roots
+	CAFile string `yaml:"ca_file"`
+	// ClientCertFile and ClientKeyFile are presented to https:// endpoints,
+	// reloaded when they change
+	ClientCertFile     string `yaml:"client_cert_file"`
+	ClientKeyFile      string `yaml:"client_key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// Proxy is the URL of a http(s) or socks5 proxy, direct for none. The
+	// proxy of the environment is used when empty.
+	Proxy string `yaml:"proxy"`
+	// Timeout limits a single XML-RPC call, zero disables it
+	Timeout time.Duration `yaml:"timeout"`
+	// DownloadRoots are the directories torrent data may be deleted from
+	DownloadRoots []string `yaml:"download_roots"`
+}
+
+// BackendConfig is a named rTorrent instance
+type BackendConfig struct {
+	Name           string `yaml:"name"`
+	UpstreamConfig `yaml:",inline"`
+}
+
+// defaultBackend is the name of the instance set by rtorrent
+const defaultBackend = "default"
+
+// validBackendName matches names that can be used in a path
+var validBackendName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Returns the instances to serve, the one set by rtorrent first when it
+// has a URL. Backends without a timeout use the one of rtorrent.
+func (c Config) backends() []BackendConfig {
+	backends := []BackendConfig{}
+	if c.Rtorrent.URL != "" {
+		backends = append(backends, BackendConfig{Name: defaultBackend, UpstreamConfig: c.Rtorrent})
+	}
+	for _, backend := range c.Backends {
+		if backend.Timeout == 0 {
+			backend.Timeout = c.Rtorrent.Timeout
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// Returns the configuration used for what is not set
+func defaultConfig() Config {
+	return Config{
+		BindAddress:     "127.0.0.1:8080",
+		ShutdownTimeout: 30 * time.Second,
+		Rtorrent:        UpstreamConfig{Timeout: 10 * time.Second},
+		EventInterval:   2 * time.Second,
+		Cache: CacheConfig{
+			ViewTTL:    time.Second,
+			SystemTTL:  time.Second,
+			TorrentTTL: time.Second,
+		},
+		Metrics: MetricsConfig{
+			Views:       []string{"main"},
+			MaxTorrents: 1000,
+		},
+		Auth: AuthConfig{SessionTTL: 12 * time.Hour},
+		TLS:  TLSConfig{ClientAuth: "require"},
+		Audit: AuditConfig{
+			MaxSize:  10 << 20,
+			MaxFiles: 5,
+		},
+	}
+}
+
+// setting is a configuration value that can be set by an environment
+// variable and a flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	// sep splits list values
+	sep   string
+	value func(*Config) interface{}
+}
+
+var settings = []setting{
+	{flag: "bind-address", env: "BIND_ADDRESS", usage: "server IP:port",
+		value: func(c *Config) interface{} { return &c.BindAddress }},
+	{flag: "pprof", env: "PPROF", usage: "register pprof routes",
+		value: func(c *Config) interface{} { return &c.PProf }},
+	{flag: "url", env: "URL", usage: "rTorrent XML-RPC endpoint or scgi:// address",
+		value: func(c *Config) interface{} { return &c.Rtorrent.URL }},
+	{flag: "basic-username", env: "BASIC_USERNAME", usage: "rTorrent basic auth username",
+		value: func(c *Config) interface{} { return &c.Rtorrent.Username }},
+	{flag: "basic-password", env: "BASIC_PASSWORD", usage: "rTorrent basic auth password",
+		value: func(c *Config) interface{} { return &c.Rtorrent.Password }},
+	{flag: "rpc-auth", env: "RPC_AUTH", usage: "how the username and password are sent, basic or digest",
+		value: func(c *Config) interface{} { return &c.Rtorrent.Auth }},
+	{flag: "rpc-bearer-token", env: "RPC_BEARER_TOKEN", usage: "token sent to rTorrent as Authorization: Bearer",
+		value: func(c *Config) interface{} { return &c.Rtorrent.BearerToken }},
+	{flag: "rpc-ca-file", env: "RPC_CA_FILE", usage: "PEM bundle verifying rTorrent's https endpoint",
+		value: func(c *Config) interface{} { return &c.Rtorrent.CAFile }},
+	{flag: "rpc-client-cert-file", env: "RPC_CLIENT_CERT_FILE", usage: "PEM client certificate presented to rTorrent",
+		value: func(c *Config) interface{} { return &c.Rtorrent.ClientCertFile }},
+	{flag: "rpc-client-key-file", env: "RPC_CLIENT_KEY_FILE", usage: "PEM private key of the client certificate",
+		value: func(c *Config) interface{} { return &c.Rtorrent.ClientKeyFile }},
+	{flag: "rpc-insecure-skip-verify", env: "RPC_INSECURE_SKIP_VERIFY", usage: "do not verify rTorrent's https certificate",
+		value: func(c *Config) interface{} { return &c.Rtorrent.InsecureSkipVerify }},
+	{flag: "rpc-proxy", env: "RPC_PROXY", usage: "proxy URL for rTorrent, direct for none",
+		value: func(c *Config) interface{} { return &c.Rtorrent.Proxy }},
+	{flag: "rpc-timeout", env: "RPC_TIMEOUT", usage: "timeout of a single XML-RPC call",
+		value: func(c *Config) interface{} { return &c.Rtorrent.Timeout }},
+	{flag: "download-roots", env: "DOWNLOAD_ROOTS", usage: "directories torrent data may be deleted from",
+		sep:   string(filepath.ListSeparator),
+		value: func(c *Config) interface{} { return &c.Rtorrent.DownloadRoots }},
+	{flag: "shutdown-timeout", env: "SHUTDOWN_TIMEOUT", usage: "how long in-flight requests are waited for on shutdown",
+		value: func(c *Config) interface{} { return &c.ShutdownTimeout }},
+	{flag: "event-interval", env: "EVENT_INTERVAL", usage: "how often views are polled for events",
+		value: func(c *Config) interface{} { return &c.EventInterval }},
+	{flag: "cache-view-ttl", env: "CACHE_VIEW_TTL", usage: "how long view results are shared",
+		value: func(c *Config) interface{} { return &c.Cache.ViewTTL }},
+	{flag: "cache-system-ttl", env: "CACHE_SYSTEM_TTL", usage: "how long system results are shared",
+		value: func(c *Config) interface{} { return &c.Cache.SystemTTL }},
+	{flag: "cache-torrent-ttl", env: "CACHE_TORRENT_TTL", usage: "how long files, peers and trackers results are shared",
+		value: func(c *Config) interface{} { return &c.Cache.TorrentTTL }},
+	{flag: "metrics-views", env: "METRICS_VIEWS", usage: "views counted by /metrics", sep: ",",
+		value: func(c *Config) interface{} { return &c.Metrics.Views }},
+	{flag: "metrics-torrents", env: "METRICS_TORRENTS", usage: "export per-torrent series on /metrics",
+		value: func(c *Config) interface{} { return &c.Metrics.Torrents }},
+	{flag: "metrics-trackers", env: "METRICS_TRACKERS", usage: "export tracker series on /metrics",
+		value: func(c *Config) interface{} { return &c.Metrics.Trackers }},
+	{flag: "metrics-max-torrents", env: "METRICS_MAX_TORRENTS", usage: "number of torrents above which per-torrent and tracker series are left out",
+		value: func(c *Config) interface{} { return &c.Metrics.MaxTorrents }},
+	{flag: "api-keys-file", env: "API_KEYS_FILE", usage: "file of name:key API keys",
+		value: func(c *Config) interface{} { return &c.Auth.APIKeysFile }},
+	{flag: "users-file", env: "USERS_FILE", usage: "file of name:bcrypt-hash users",
+		value: func(c *Config) interface{} { return &c.Auth.UsersFile }},
+	{flag: "session-secret", env: "SESSION_SECRET", usage: "key signing session cookies",
+		value: func(c *Config) interface{} { return &c.Auth.SessionSecret }},
+	{flag: "session-ttl", env: "SESSION_TTL", usage: "how long a login lasts",
+		value: func(c *Config) interface{} { return &c.Auth.SessionTTL }},
+	{flag: "permissions-file", env: "PERMISSIONS_FILE", usage: "JSON file of roles and grants",
+		value: func(c *Config) interface{} { return &c.Auth.PermissionsFile }},
+	{flag: "client-cert-principal", env: "CLIENT_CERT_PRINCIPAL", usage: "name principals after TLS client certificates by common_name or subject",
+		value: func(c *Config) interface{} { return &c.Auth.ClientCertPrincipal }},
+	{flag: "tls-cert-file", env: "TLS_CERT_FILE", usage: "PEM certificate enabling HTTPS",
+		value: func(c *Config) interface{} { return &c.TLS.CertFile }},
+	{flag: "tls-key-file", env: "TLS_KEY_FILE", usage: "PEM private key of the certificate",
+		value: func(c *Config) interface{} { return &c.TLS.KeyFile }},
+	{flag: "tls-client-ca-file", env: "TLS_CLIENT_CA_FILE", usage: "PEM bundle client certificates are verified against",
+		value: func(c *Config) interface{} { return &c.TLS.ClientCAFile }},
+	{flag: "tls-client-auth", env: "TLS_CLIENT_AUTH", usage: "require or optional client certificates",
+		value: func(c *Config) interface{} { return &c.TLS.ClientAuth }},
+	{flag: "tls-redirect-address", env: "TLS_REDIRECT_ADDRESS", usage: "IP:port redirecting plain HTTP to HTTPS",
+		value: func(c *Config) interface{} { return &c.TLS.RedirectAddress }},
+	{flag: "audit-file", env: "AUDIT_FILE", usage: "file mutating operations are recorded in",
+		value: func(c *Config) interface{} { return &c.Audit.Path }},
+	{flag: "audit-max-size", env: "AUDIT_MAX_SIZE", usage: "size in bytes above which the audit log is rotated",
+		value: func(c *Config) interface{} { return &c.Audit.MaxSize }},
+	{flag: "audit-max-files", env: "AUDIT_MAX_FILES", usage: "number of rotated audit logs kept",
+		value: func(c *Config) interface{} { return &c.Audit.MaxFiles }},
+	{flag: "cors-origin", env: "CORS_ORIGIN", usage: "origin allowed to make cross origin requests",
+		value: func(c *Config) interface{} { return &c.CORS.Origin }},
+	{flag: "cors-age", env: "CORS_AGE", usage: "seconds browsers may cache preflight results",
+		value: func(c *Config) interface{} { return &c.CORS.MaxAge }},
+}
+
+// Parses v into the configuration value of s
+func (s setting) set(c *Config, v string) error {
+	var err error
+	switch p := s.value(c).(type) {
+	case *string:
+		*p = v
+	case *bool:
+		// a variable that is set but empty enables, as PPROF always did
+		if v == "" {
+			*p = true
+			return nil
+		}
+		*p, err = strconv.ParseBool(v)
+	case *int:
+		*p, err = strconv.Atoi(v)
+	case *int64:
+		*p, err = strconv.ParseInt(v, 10, 64)
+	case *time.Duration:
+		*p, err = time.ParseDuration(v)
+	case *[]string:
+		*p = nil
+		if v != "" {
+			*p = strings.Split(v, s.sep)
+		}
+	default:
+		panic(fmt.Sprintf("setting %s has an unsupported type %T", s.flag, p))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", v)
+	}
+	return nil
+}
+
+// settingFlag is the value of a setting given on the command line
+type settingFlag struct {
+	setting setting
+	value   string
+	isSet   bool
+}
+
+func (f *settingFlag) String() string {
+	return f.value
+}
+
+func (f *settingFlag) Set(v string) error {
+	// checked on a scratch config so that errors are reported by flag
+	err := f.setting.set(&Config{}, v)
+	if err != nil {
+		return err
+	}
+	f.value = v
+	f.isSet = true
+	return nil
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	_, ok := f.setting.value(&Config{}).(*bool)
+	return ok
+}
+
+// ConfigSource is where the configuration is read from, it is read again
+// on reload
+type ConfigSource struct {
+	// Path of the YAML file, none when empty
+	Path  string
+	flags []*settingFlag
+}
+
+// Parses the command line. PrintConfig reports whether --print-config was
+// given.
+func ParseFlags(args []string) (source *ConfigSource, printConfig bool, err error) {
+	fs := flag.NewFlagSet("rtw", flag.ContinueOnError)
+	source = &ConfigSource{}
+	fs.StringVar(&source.Path, "config", os.Getenv("CONFIG_FILE"), "YAML configuration file (CONFIG_FILE)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the configuration with secrets redacted and exit")
+	for _, s := range settings {
+		f := &settingFlag{setting: s}
+		fs.Var(f, s.flag, fmt.Sprintf("%s (%s)", s.usage, s.env))
+		source.flags = append(source.flags, f)
+	}
+
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return source, printConfig, nil
+}
+
+// Reads the defaults, the file, the environment and the flags in order and
+// validates the result
+func (s *ConfigSource) Load() (Config, error) {
+	c := defaultConfig()
+
+	if s.Path != "" {
+		data, err := os.ReadFile(s.Path)
+		if err != nil {
+			return c, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		// a file without a document leaves the defaults
+		if err := decoder.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+			return c, fmt.Errorf("%s: %w", s.Path, err)
+		}
+	}
+
+	for _, setting := range settings {
+		v, ok := os.LookupEnv(setting.env)
+		if !ok {
+			continue
+		}
+		err := setting.set(&c, v)
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", setting.env, err)
+		}
+	}
+
+	for _, f := range s.flags {
+		if !f.isSet {
+			continue
+		}
+		err := f.setting.set(&c, f.value)
+		if err != nil {
+			return c, fmt.Errorf("--%s: %w", f.setting.flag, err)
+		}
+	}
+
+	return c, c.validate()
+}
+
+// Returns every problem of the configuration, naming the file key,
+// environment variable and flag of each
+func (c Config) validate() error {
+	var errs []error
+	problem := func(key, env, flag, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s (%s, --%s): %s", key, env, flag, fmt.Sprintf(format, args...)))
+	}
+	// names the settings of rtorrent by their key, variable and flag
+	upstream := map[string][3]string{
+		"url":              {"rtorrent.url", "URL", "url"},
+		"username":         {"rtorrent.username", "BASIC_USERNAME", "basic-username"},
+		"auth":             {"rtorrent.auth", "RPC_AUTH", "rpc-auth"},
+		"bearer_token":     {"rtorrent.bearer_token", "RPC_BEARER_TOKEN", "rpc-bearer-token"},
+		"client_cert_file": {"rtorrent.client_cert_file", "RPC_CLIENT_CERT_FILE", "rpc-client-cert-file"},
+		"proxy":            {"rtorrent.proxy", "RPC_PROXY", "rpc-proxy"},
+		"timeout":          {"rtorrent.timeout", "RPC_TIMEOUT", "rpc-timeout"},
+		"download_roots":   {"rtorrent.download_roots", "DOWNLOAD_ROOTS", "download-roots"},
+	}
+
+	if _, _, err := net.SplitHostPort(c.BindAddress); err != nil {
+		problem("bind_address", "BIND_ADDRESS", "bind-address", "must be IP:port: %s", err)
+	}
+
+	switch {
+	case c.Rtorrent.URL == "" && len(c.Backends) == 0:
+		problem("rtorrent.url", "URL", "url", "is required unless there are backends")
+	case c.Rtorrent.URL != "":
+		c.Rtorrent.validate(func(field, format string, args ...interface{}) {
+			names := upstream[field]
+			problem(names[0], names[1], names[2], format, args...)
+		})
+	}
+
+	// backends are only set by the file
+	names := map[string]bool{}
+	if c.Rtorrent.URL != "" {
+		names[defaultBackend] = true
+	}
+	for i, backend := range c.Backends {
+		backendProblem := func(field, format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("backends[%d].%s: %s", i, field, fmt.Sprintf(format, args...)))
+		}
+		switch {
+		case !validBackendName.MatchString(backend.Name):
+			backendProblem("name", "%q must be letters, digits, _, - and .", backend.Name)
+		case names[backend.Name]:
+			backendProblem("name", "%s is already used", backend.Name)
+		}
+		names[backend.Name] = true
+		if backend.URL == "" {
+			backendProblem("url", "is required")
+			continue
+		}
+		backend.validate(backendProblem)
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		problem("shutdown_timeout", "SHUTDOWN_TIMEOUT", "shutdown-timeout", "must be positive")
+	}
+	if c.EventInterval <= 0 {
+		problem("event_interval", "EVENT_INTERVAL", "event-interval", "must be positive")
+	}
+	if c.Cache.ViewTTL < 0 || c.Cache.SystemTTL < 0 || c.Cache.TorrentTTL < 0 {
+		problem("cache", "CACHE_*_TTL", "cache-*-ttl", "TTLs must not be negative")
+	}
+
+	if len(c.Metrics.Views) == 0 {
+		problem("metrics.views", "METRICS_VIEWS", "metrics-views", "at least one view is required")
+	}
+	if c.Metrics.MaxTorrents < 0 {
+		problem("metrics.max_torrents", "METRICS_MAX_TORRENTS", "metrics-max-torrents", "must not be negative")
+	}
+
+	if c.Auth.SessionTTL <= 0 {
+		problem("auth.session_ttl", "SESSION_TTL", "session-ttl", "must be positive")
+	}
+	if c.Auth.PermissionsFile != "" && c.Auth.APIKeysFile == "" && c.Auth.UsersFile == "" && c.Auth.ClientCertPrincipal == "" {
+		problem("auth.permissions_file", "PERMISSIONS_FILE", "permissions-file", "requires API keys, users or client certificates")
+	}
+	switch {
+	case c.Auth.ClientCertPrincipal != "" && c.Auth.ClientCertPrincipal != "common_name" && c.Auth.ClientCertPrincipal != "subject":
+		problem("auth.client_cert_principal", "CLIENT_CERT_PRINCIPAL", "client-cert-principal", "must be common_name or subject")
+	case c.Auth.ClientCertPrincipal != "" && c.TLS.ClientCAFile == "":
+		problem("auth.client_cert_principal", "CLIENT_CERT_PRINCIPAL", "client-cert-principal", "requires tls.client_ca_file")
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problem("tls.cert_file", "TLS_CERT_FILE", "tls-cert-file", "requires tls.key_file and the other way round")
+	}
+	if c.TLS.ClientCAFile != "" && !c.TLS.enabled() {
+		problem("tls.client_ca_file", "TLS_CLIENT_CA_FILE", "tls-client-ca-file", "requires tls.cert_file")
+	}
+	if c.TLS.ClientAuth != "require" && c.TLS.ClientAuth != "optional" {
+		problem("tls.client_auth", "TLS_CLIENT_AUTH", "tls-client-auth", "must be require or optional")
+	}
+	if c.TLS.RedirectAddress != "" {
+		if !c.TLS.enabled() {
+			problem("tls.redirect_address", "TLS_REDIRECT_ADDRESS", "tls-redirect-address", "requires tls.cert_file")
+		}
+		if _, _, err := net.SplitHostPort(c.TLS.RedirectAddress); err != nil {
+			problem("tls.redirect_address", "TLS_REDIRECT_ADDRESS", "tls-redirect-address", "must be IP:port: %s", err)
+		}
+	}
+
+	if c.Audit.MaxSize < 0 {
+		problem("audit.max_size", "AUDIT_MAX_SIZE", "audit-max-size", "must not be negative")
+	}
+	if c.Audit.MaxFiles < 0 {
+		problem("audit.max_files", "AUDIT_MAX_FILES", "audit-max-files", "must not be negative")
+	}
+
+	if c.CORS.MaxAge < 0 {
+		problem("cors.max_age", "CORS_AGE", "cors-age", "must not be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+// Reports the problems of the settings of an instance with a URL by the
+// key of the setting
+func (u UpstreamConfig) validate(problem func(field, format string, args ...interface{})) {
+	switch parsed, err := url.Parse(u.URL); {
+	case err != nil:
+		problem("url", "%s", err)
+	case parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != "scgi":
+		problem("url", "must be a http(s):// or scgi:// url")
+	case parsed.Scheme != "scgi" && parsed.Host == "":
+		problem("url", "has no host")
+	case parsed.Scheme == "scgi" && u.overHTTP():
+		problem("url", "scgi:// does not support credentials, headers, TLS or proxy settings")
+	}
+	if (u.Username == "") != (u.Password == "") {
+		problem("username", "requires a password and the other way round")
+	}
+	if u.Auth != "" && u.Auth != "basic" && u.Auth != "digest" {
+		problem("auth", "must be basic or digest")
+	}
+	if u.BearerToken != "" && u.Username != "" {
+		problem("bearer_token", "cannot be used with a username")
+	}
+	if (u.ClientCertFile == "") != (u.ClientKeyFile == "") {
+		problem("client_cert_file", "requires client_key_file and the other way round")
+	}
+	if u.Proxy != "" && u.Proxy != proxyDirect {
+		proxy, err := url.Parse(u.Proxy)
+		if err != nil || (proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5") || proxy.Host == "" {
+			problem("proxy", "must be %s or a http(s):// or socks5:// url", proxyDirect)
+		}
+	}
+	if u.Timeout < 0 {
+		problem("timeout", "must not be negative")
+	}
+	for _, root := range u.DownloadRoots {
+		if !filepath.IsAbs(root) {
+			problem("download_roots", "%s is not an absolute path", root)
+		}
+	}
+}
+
+// Returns whether settings that only apply to http(s):// are set
+func (u UpstreamConfig) overHTTP() bool {
+	return u.Username != "" || u.Auth != "" || u.BearerToken != "" || len(u.Headers) > 0 ||
+		u.CAFile != "" || u.ClientCertFile != "" || u.InsecureSkipVerify || u.Proxy != ""
+}
+
+// Returns a copy with the password, token and header values replaced
+func (u UpstreamConfig) redacted() UpstreamConfig {
+	if u.Password != "" {
+		u.Password = "REDACTED"
+	}
+	if u.BearerToken != "" {
+		u.BearerToken = "REDACTED"
+	}
+	if u.Headers != nil {
+		headers := make(map[string]string, len(u.Headers))
+		for name := range u.Headers {
+			headers[name] = "REDACTED"
+		}
+		u.Headers = headers
+	}
+	return u
+}
+
+// Returns the configuration as YAML with the secrets replaced
+func (c Config) redacted() ([]byte, error) {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "REDACTED"
+		}
+	}
+	c.Rtorrent = c.Rtorrent.redacted()
+	c.Backends = append([]BackendConfig(nil), c.Backends...)
+	for i := range c.Backends {
+		c.Backends[i].UpstreamConfig = c.Backends[i].redacted()
+	}
+	redact(&c.Auth.SessionSecret)
+
+	buffer := bytes.NewBuffer(nil)
+	encoder := yaml.NewEncoder(buffer)
+	encoder.SetIndent(2)
+	err := encoder.Encode(c)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), encoder.Close()
+}
+
+// Returns the settings that differ in next and only take effect after a
+// restart
+func (c Config) restartRequired(next Config) []string {
+	changed := []string{}
+	for name, values := range map[string][2]interface{}{
+		"bind_address":     {c.BindAddress, next.BindAddress},
+		"pprof":            {c.PProf, next.PProf},
+		"shutdown_timeout": {c.ShutdownTimeout, next.ShutdownTimeout},
+		"rtorrent":         {c.Rtorrent, next.Rtorrent},
+		"backends":         {c.Backends, next.Backends},
+		"event_interval":   {c.EventInterval, next.EventInterval},
+		"audit":            {c.Audit, next.Audit},
+		"tls":              {c.TLS, next.TLS},
+	} {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Reads the configuration again on SIGHUP and applies it
+func reloadOnHangup(source *ConfigSource, current Config, backends *Backends, auth *Auth) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		next, err := source.Load()
+		if err != nil {
+			log.Printf("not reloading, invalid configuration:\n%s", err)
+			continue
+		}
+		current = applyConfig(current, next, backends, auth)
+	}
+}
+
+// Applies the settings of next that can change while rtw runs, the CORS,
+// cache, metrics and authentication settings, and returns the configuration
+// in effect. The others are logged as needing a restart.
+func applyConfig(current, next Config, backends *Backends, auth *Auth) Config {
+	for _, name := range current.restartRequired(next) {
+		log.Printf("%s changed, it takes effect after a restart", name)
+	}
+	applied := current
+
+	SetCORS(next.CORS)
+	applied.CORS = next.CORS
+	for _, rt := range backends.list {
+		rt.reconfigure(next.Cache, next.Metrics)
+	}
+	applied.Cache = next.Cache
+	applied.Metrics = next.Metrics
+
+	switch {
+	case auth == nil && (next.Auth.APIKeysFile != "" || next.Auth.UsersFile != ""):
+		log.Printf("authentication takes effect after a restart")
+	case auth != nil:
+		err := auth.reload(next.Auth)
+		if err != nil {
+			log.Printf("not reloading authentication: %s", err)
+			break
+		}
+		applied.Auth = next.Auth
+	}
+
+	log.Printf("configuration reloaded")
+	return applied
+}
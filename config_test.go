@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a configuration file and returns its path
+func writeTestConfig(t *testing.T, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "rtw.yaml")
+	err := os.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeTestConfig(t, `
+bind_address: 0.0.0.0:9000
+rtorrent:
+  url: http://file/RPC2
+  timeout: 30s
+cache:
+  view_ttl: 5s
+cors:
+  origin: https://file.example
+`)
+	t.Setenv("URL", "http://env/RPC2")
+	t.Setenv("CORS_ORIGIN", "https://env.example")
+
+	source, _, err := ParseFlags([]string{"--config", path, "--cors-origin", "https://flag.example", "--pprof"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.BindAddress != "0.0.0.0:9000" || config.Rtorrent.Timeout != 30*time.Second || config.Cache.ViewTTL != 5*time.Second {
+		t.Errorf("expected the file to be read, got %+v", config)
+	}
+	if config.Rtorrent.URL != "http://env/RPC2" {
+		t.Errorf("expected the environment to override the file, got %s", config.Rtorrent.URL)
+	}
+	if config.CORS.Origin != "https://flag.example" || !config.PProf {
+		t.Errorf("expected the flags to override the environment, got %+v", config.CORS)
+	}
+	if config.Cache.SystemTTL != time.Second || config.Metrics.MaxTorrents != 1000 {
+		t.Errorf("expected the defaults for what is not set, got %+v", config)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"no url", "", "rtorrent.url (URL, --url): is required"},
+		{"url scheme", "rtorrent: {url: ftp://host}", "must be a http(s):// or scgi:// url"},
+		{"bind address", "{bind_address: localhost, rtorrent: {url: http://host}}", "bind_address (BIND_ADDRESS, --bind-address)"},
+		{"half basic auth", "rtorrent: {url: http://host, username: u}", "requires a password"},
+		{"relative root", "rtorrent: {url: http://host, download_roots: [data]}", "data is not an absolute path"},
+		{"unknown key", "rtorrent: {url: http://host}\nbind: x", "field bind not found"},
+		{"duration", "rtorrent: {url: http://host, timeout: soon}", "soon"},
+		{"backend name", "backends: [{name: a/b, url: http://host}]", `backends[0].name: "a/b" must be`},
+		{"backend url", "backends: [{name: a}]", "backends[0].url: is required"},
+		{"duplicate backend", "backends: [{name: a, url: http://host}, {name: a, url: http://other}]", "a is already used"},
+		{"half tls", "{rtorrent: {url: http://host}, tls: {cert_file: a.crt}}", "tls.cert_file (TLS_CERT_FILE, --tls-cert-file): requires tls.key_file"},
+		{"client auth", "{rtorrent: {url: http://host}, tls: {cert_file: a.crt, key_file: a.key, client_auth: sometimes}}", "must be require or optional"},
+		{"redirect without tls", "{rtorrent: {url: http://host}, tls: {redirect_address: 0.0.0.0:80}}", "tls.redirect_address (TLS_REDIRECT_ADDRESS, --tls-redirect-address): requires tls.cert_file"},
+		{"principal without ca", "{rtorrent: {url: http://host}, auth: {client_cert_principal: common_name}}", "requires tls.client_ca_file"},
+		{"scgi credentials", "rtorrent: {url: scgi://host:5000, username: u, password: p}", "scgi:// does not support credentials"},
+		{"upstream auth", "rtorrent: {url: http://host, username: u, password: p, auth: ntlm}", "rtorrent.auth (RPC_AUTH, --rpc-auth): must be basic or digest"},
+		{"proxy", "rtorrent: {url: http://host, proxy: ftp://proxy}", "rtorrent.proxy (RPC_PROXY, --rpc-proxy)"},
+		{"half client cert", "rtorrent: {url: https://host, client_cert_file: a.crt}", "requires client_key_file"},
+		{"backend bearer", "backends: [{name: a, url: http://a, username: u, password: p, bearer_token: t}]", "backends[0].bearer_token: cannot be used with a username"},
+		{"reserved backend", "{rtorrent: {url: http://host}, backends: [{name: default, url: http://other}]}", "default is already used"},
+	}
+
+	for _, tt := range tests {
+		source := &ConfigSource{Path: writeTestConfig(t, tt.config)}
+		_, err := source.Load()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	source := &ConfigSource{Path: writeTestConfig(t, "backends: [{name: a, url: http://a}, {name: b, url: scgi://b:5000}]")}
+	config, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backends := config.backends(); len(backends) != 2 || backends[0].Name != "a" || backends[0].Timeout != 10*time.Second {
+		t.Errorf("expected the backends without the top-level one, got %+v", backends)
+	}
+
+	t.Setenv("EVENT_INTERVAL", "often")
+	source = &ConfigSource{Path: writeTestConfig(t, "rtorrent: {url: http://host}")}
+	_, err = source.Load()
+	if err == nil || !strings.Contains(err.Error(), "EVENT_INTERVAL") {
+		t.Errorf("expected the variable to be named, got %v", err)
+	}
+
+	_, _, err = ParseFlags([]string{"--rpc-timeout", "soon"})
+	if err == nil {
+		t.Error("expected an invalid flag to be refused")
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	config := defaultConfig()
+	config.Rtorrent.Password = "hunter2"
+	config.Rtorrent.Headers = map[string]string{"X-Api-Key": "hunter2"}
+	config.Backends = []BackendConfig{{Name: "a", UpstreamConfig: UpstreamConfig{BearerToken: "hunter2"}}}
+	config.Auth.SessionSecret = "s3cret"
+
+	out, err := config.redacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "hunter2") || strings.Contains(string(out), "s3cret") {
+		t.Errorf("expected the secrets to be redacted, got:\n%s", out)
+	}
+	if !strings.Contains(string(out), "password: REDACTED") || !strings.Contains(string(out), "timeout: 10s") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if config.Rtorrent.Password != "hunter2" {
+		t.Error("expected the configuration not to be changed")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	keys := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keys, []byte("scripts:key1\n"), 0600)
+
+	current := defaultConfig()
+	current.Rtorrent.URL = "http://host/RPC2"
+	current.Auth.APIKeysFile = keys
+	auth, err := newAuthFromConfig(current.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtorrent, _ := newTestRtorrent(t)
+	srv := httptest.NewServer(newRouter(rtorrent, auth))
+	defer srv.Close()
+	t.Cleanup(func() { SetCORS(CORSConfig{}) })
+
+	os.WriteFile(keys, []byte("scripts:key2\n"), 0600)
+	next := current
+	next.BindAddress = "0.0.0.0:9000"
+	next.CORS.Origin = "https://example.com"
+	next.Metrics.MaxTorrents = 5
+
+	applied := applyConfig(current, next, NewBackends(rtorrent), auth)
+	if applied.BindAddress != current.BindAddress {
+		t.Error("expected the bind address to need a restart")
+	}
+	if applied.CORS.Origin != "https://example.com" || rtorrent.metricsConfig().MaxTorrents != 5 {
+		t.Errorf("expected the reloadable settings to be applied, got %+v", applied)
+	}
+
+	for key, code := range map[string]int{"key1": http.StatusUnauthorized, "key2": http.StatusOK} {
+		got, _ := doAs(t, key, "GET", srv.URL+"/api/hello", "", "")
+		if got != code {
+			t.Errorf("%s: expected %d after the reload, got %d", key, code, got)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/api/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Errorf("expected the new CORS origin, got %q", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	next.Auth.APIKeysFile = ""
+	applied = applyConfig(applied, next, NewBackends(rtorrent), auth)
+	if applied.Auth.APIKeysFile != keys {
+		t.Error("expected authentication not to be disabled by a reload")
+	}
+}
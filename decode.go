@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DecodeError describes an XML-RPC value that could not be stored in the
+// struct field tagged with the command that produced it
+type DecodeError struct {
+	Field    string
+	Tag      string
+	Expected string
+	Received string
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	msg := fmt.Sprintf("cannot decode %s into field %s (rtw:%q) of type %s",
+		e.Received, e.Field, e.Tag, e.Expected)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Maps XMLRPC result to a struct using fields from args with reflection
+func multicallTags[T File | Torrent | Peer | Tracker](result interface{}, args interface{}) ([]T, error) {
+	a, ok := args.([]interface{})
+	if !ok || len(a) < 2 {
+		return nil, fmt.Errorf("multicall args must be a list of a target, a view and commands, got %T", args)
+	}
+
+	commands := make([]string, 0, len(a)-2)
+	for idx := 2; idx < len(a); idx++ {
+		command, ok := a[idx].(string)
+		if !ok {
+			return nil, fmt.Errorf("multicall command %d must be a string, got %T", idx-2, a[idx])
+		}
+		commands = append(commands, command)
+	}
+
+	rows, ok := result.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("multicall result must be an array, got %s", xmlrpcType(result))
+	}
+
+	plan := planFor(reflect.TypeOf((*T)(nil)).Elem(), commands)
+
+	items := make([]T, len(rows))
+	for r, outer := range rows {
+		row, ok := outer.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("multicall row %d must be an array, got %s", r, xmlrpcType(outer))
+		}
+		if len(row) != len(commands) {
+			return nil, fmt.Errorf("multicall row %d has %d values for %d commands", r, len(row), len(commands))
+		}
+
+		el := reflect.ValueOf(&items[r]).Elem()
+		for idx, i := range plan.fields {
+			if i < 0 {
+				continue
+			}
+			err := setField(el, i, commands[idx], row[idx])
+			if err != nil {
+				return nil, fmt.Errorf("multicall row %d: %w", r, err)
+			}
+		}
+	}
+	return items, nil
+}
+
+// Maps system.multicall result to System using the method names from args
+func systemTags(result interface{}, args interface{}) (System, error) {
+	system := &System{}
+
+	a, ok := args.([]interface{})
+	if !ok || len(a) != 1 {
+		return System{}, fmt.Errorf("system.multicall args must be a list with one list of calls, got %T", args)
+	}
+	calls, ok := a[0].([]interface{})
+	if !ok {
+		return System{}, fmt.Errorf("system.multicall calls must be a list, got %T", a[0])
+	}
+
+	r, ok := result.([]interface{})
+	if !ok {
+		return System{}, fmt.Errorf("system.multicall result must be an array, got %s", xmlrpcType(result))
+	}
+	if len(r) != len(calls) {
+		return System{}, fmt.Errorf("system.multicall returned %d results for %d calls", len(r), len(calls))
+	}
+
+	el := reflect.ValueOf(system).Elem()
+	for idx := 0; idx < len(r); idx++ {
+		var fname string
+		switch call := calls[idx].(type) {
+		case SystemCall:
+			fname = call.MethodName
+		case *SystemCall:
+			fname = call.MethodName
+		default:
+			return System{}, fmt.Errorf("system.multicall call %d must be a SystemCall, got %T", idx, calls[idx])
+		}
+
+		ref, err := multicallValue(r[idx])
+		if err != nil {
+			return System{}, fmt.Errorf("system.multicall %s: %w", fname, err)
+		}
+
+		i, ok := tagIndex(el.Type())[fname]
+		if !ok {
+			continue
+		}
+		err = setField(el, i, fname, ref)
+		if err != nil {
+			return System{}, err
+		}
+	}
+
+	return *system, nil
+}
+
+// Unwraps a single system.multicall result, which is either a one element
+// array or a fault struct
+func multicallValue(result interface{}) (interface{}, error) {
+	switch v := result.(type) {
+	case []interface{}:
+		if len(v) != 1 {
+			return nil, fmt.Errorf("expected one value, got %d", len(v))
+		}
+		return v[0], nil
+	case map[string]interface{}:
+		return nil, fmt.Errorf("fault(%v): %v", v["faultCode"], v["faultString"])
+	}
+	return nil, fmt.Errorf("expected an array or a fault, got %s", xmlrpcType(result))
+}
+
+// decodePlan maps each multicall result column to the index of the struct
+// field it is stored in, -1 for columns without a matching field
+type decodePlan struct {
+	fields []int
+}
+
+type planKey struct {
+	typ      reflect.Type
+	commands string
+}
+
+// maxDecodePlans bounds the plan cache since commands can come from the
+// query string
+const maxDecodePlans = 1024
+
+var (
+	tagIndexes  sync.Map
+	decodePlans = struct {
+		sync.RWMutex
+		plans map[planKey]*decodePlan
+	}{plans: make(map[planKey]*decodePlan)}
+)
+
+// Returns the field index of each rtw tag in t, computed once per type
+func tagIndex(t reflect.Type) map[string]int {
+	if index, ok := tagIndexes.Load(t); ok {
+		return index.(map[string]int)
+	}
+
+	index := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("rtw")
+		if tag == "" {
+			continue
+		}
+		if _, ok := index[tag]; !ok {
+			index[tag] = i
+		}
+	}
+
+	actual, _ := tagIndexes.LoadOrStore(t, index)
+	return actual.(map[string]int)
+}
+
+// Returns the cached decode plan for t and commands, building it on first use
+func planFor(t reflect.Type, commands []string) *decodePlan {
+	key := planKey{typ: t, commands: strings.Join(commands, "\x00")}
+
+	decodePlans.RLock()
+	plan, ok := decodePlans.plans[key]
+	decodePlans.RUnlock()
+	if ok {
+		return plan
+	}
+
+	index := tagIndex(t)
+	plan = &decodePlan{fields: make([]int, len(commands))}
+	for idx, command := range commands {
+		i, ok := index[command]
+		if !ok {
+			i = -1
+		}
+		plan.fields[idx] = i
+	}
+
+	decodePlans.Lock()
+	if len(decodePlans.plans) >= maxDecodePlans {
+		decodePlans.plans = make(map[planKey]*decodePlan)
+	}
+	decodePlans.plans[key] = plan
+	decodePlans.Unlock()
+
+	return plan
+}
+
+var errNotConvertible = errors.New("no conversion available")
+
+// Stores value in field i of el, converting between the XML-RPC and Go
+// types where it is safe to do so. Nil values leave the field untouched.
+func setField(el reflect.Value, i int, tag string, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+
+	field := el.Field(i)
+	switch field.Kind() {
+	case reflect.String:
+		switch v := value.(type) {
+		case string:
+			field.SetString(v)
+			return nil
+		case int64:
+			field.SetString(strconv.FormatInt(v, 10))
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch v := value.(type) {
+		case int64:
+			n = v
+		case bool:
+			if v {
+				n = 1
+			}
+		case string:
+			// unset custom values such as d.custom=addtime are empty
+			if v == "" {
+				break
+			}
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return decodeError(el, i, tag, value, err)
+			}
+			n = parsed
+		default:
+			return decodeError(el, i, tag, value, errNotConvertible)
+		}
+		if field.OverflowInt(n) {
+			return decodeError(el, i, tag, value, fmt.Errorf("value %d overflows", n))
+		}
+		field.SetInt(n)
+		return nil
+	case reflect.Slice:
+		// arrays of strings such as d.views
+		if list, ok := value.([]interface{}); ok && field.Type().Elem().Kind() == reflect.String {
+			strs := reflect.MakeSlice(field.Type(), len(list), len(list))
+			for idx, item := range list {
+				s, ok := item.(string)
+				if !ok {
+					return decodeError(el, i, tag, value, fmt.Errorf("element %d is %s", idx, xmlrpcType(item)))
+				}
+				strs.Index(idx).SetString(s)
+			}
+			field.Set(strs)
+			return nil
+		}
+	default:
+		v := reflect.ValueOf(value)
+		if v.Type().AssignableTo(field.Type()) {
+			field.Set(v)
+			return nil
+		}
+	}
+
+	return decodeError(el, i, tag, value, errNotConvertible)
+}
+
+func decodeError(el reflect.Value, i int, tag string, value interface{}, err error) error {
+	sf := el.Type().Field(i)
+	return &DecodeError{
+		Field:    sf.Name,
+		Tag:      tag,
+		Expected: sf.Type.String(),
+		Received: xmlrpcType(value),
+		Err:      err,
+	}
+}
+
+// Returns the XML-RPC type name of a value decoded into an interface{}
+func xmlrpcType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return "string"
+	case int64:
+		return "i8"
+	case bool:
+		return "boolean"
+	case float64:
+		return "double"
+	case time.Time:
+		return "dateTime.iso8601"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "struct"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMulticallTagsConversions(t *testing.T) {
+	args := []interface{}{"", "main", "d.hash=", "d.priority=", "d.is_active=", "d.custom1=", "d.unknown=", "d.state="}
+	result := []interface{}{
+		[]interface{}{"ABC", "3", true, int64(42), "ignored", nil},
+	}
+
+	torrents, err := multicallTags[Torrent](result, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrents) != 1 {
+		t.Fatalf("expected one torrent, got %d", len(torrents))
+	}
+
+	torrent := torrents[0]
+	if torrent.Hash != "ABC" || torrent.Priority != 3 || torrent.IsActive != 1 || torrent.Custom1 != "42" || torrent.State != 0 {
+		t.Errorf("unexpected torrent: %+v", torrent)
+	}
+}
+
+func TestMulticallTagsCustomAndViews(t *testing.T) {
+	args := []interface{}{"", "main", "d.custom=addtime", "d.views="}
+	result := []interface{}{
+		[]interface{}{"1700000000", []interface{}{"seeding", "tv"}},
+		[]interface{}{"", []interface{}{}},
+	}
+
+	torrents, err := multicallTags[Torrent](result, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrents[0].LoadDate != 1700000000 || !reflect.DeepEqual(torrents[0].Views, []string{"seeding", "tv"}) {
+		t.Errorf("unexpected torrent: %+v", torrents[0])
+	}
+	if torrents[1].LoadDate != 0 || len(torrents[1].Views) != 0 {
+		t.Errorf("unexpected torrent: %+v", torrents[1])
+	}
+
+	_, err = multicallTags[Torrent]([]interface{}{[]interface{}{[]interface{}{int64(1)}}}, []interface{}{"", "main", "d.views="})
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Field != "Views" {
+		t.Errorf("expected DecodeError for Views, got %v", err)
+	}
+}
+
+func TestMulticallTagsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		result interface{}
+		args   interface{}
+		want   string
+	}{
+		{
+			name:   "string for integer field",
+			result: []interface{}{[]interface{}{"high"}},
+			args:   []interface{}{"", "main", "d.priority="},
+			want:   `cannot decode string into field Priority (rtw:"d.priority=") of type int64`,
+		},
+		{
+			name:   "array for string field",
+			result: []interface{}{[]interface{}{[]interface{}{}}},
+			args:   []interface{}{"", "main", "d.name="},
+			want:   `cannot decode array into field Name (rtw:"d.name=") of type string`,
+		},
+		{
+			name:   "args not a list",
+			result: []interface{}{},
+			args:   "d.name=",
+			want:   "multicall args must be a list",
+		},
+		{
+			name:   "command not a string",
+			result: []interface{}{},
+			args:   []interface{}{"", "main", 5},
+			want:   "multicall command 0 must be a string",
+		},
+		{
+			name:   "result not an array",
+			result: "oops",
+			args:   []interface{}{"", "main", "d.name="},
+			want:   "multicall result must be an array, got string",
+		},
+		{
+			name:   "short row",
+			result: []interface{}{[]interface{}{"ubuntu"}},
+			args:   []interface{}{"", "main", "d.name=", "d.hash="},
+			want:   "multicall row 0 has 1 values for 2 commands",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := multicallTags[Torrent](tt.result, tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	_, err := multicallTags[Torrent]([]interface{}{[]interface{}{"high"}}, []interface{}{"", "main", "d.priority="})
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Field != "Priority" || decodeErr.Received != "string" {
+		t.Errorf("expected DecodeError for Priority, got %v", err)
+	}
+}
+
+func TestSystemTags(t *testing.T) {
+	args := []interface{}{
+		[]interface{}{
+			SystemCall{MethodName: "system.hostname"},
+			SystemCall{MethodName: "system.pid"},
+			SystemCall{MethodName: "system.unknown"},
+		},
+	}
+
+	system, err := systemTags([]interface{}{
+		[]interface{}{"seedbox"},
+		[]interface{}{"1234"},
+		[]interface{}{"ignored"},
+	}, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if system.Hostname != "seedbox" || system.PID != 1234 {
+		t.Errorf("unexpected system: %+v", system)
+	}
+
+	_, err = systemTags([]interface{}{
+		map[string]interface{}{"faultCode": int64(-506), "faultString": "Method 'system.hostname' not defined"},
+		[]interface{}{int64(1)},
+		[]interface{}{""},
+	}, args)
+	if err == nil || !strings.Contains(err.Error(), "system.hostname") {
+		t.Errorf("expected fault for system.hostname, got %v", err)
+	}
+
+	_, err = systemTags([]interface{}{}, []interface{}{"system.hostname"})
+	if err == nil {
+		t.Error("expected error for malformed args")
+	}
+}
+
+func TestViewHandlerTypeMismatch(t *testing.T) {
+	srv, fake := newTestServer(t)
+	torrent := addTestTorrent(fake, "abc", "ubuntu")
+	torrent.Fields["d.priority"] = "high"
+
+	var resp Response
+	code := doJSON(t, "GET", srv.URL+"/api/view/main", nil, "", &resp)
+	if code != http.StatusBadRequest || !strings.Contains(resp.Message, "Priority") {
+		t.Errorf("expected decode error, got %d: %+v", code, resp)
+	}
+
+	// the server keeps serving after the failed decode
+	code = doJSON(t, "GET", srv.URL+"/api/hello", nil, "", &resp)
+	if code != http.StatusOK {
+		t.Errorf("unexpected status after decode error: %d", code)
+	}
+}
+
+func TestPlanFor(t *testing.T) {
+	typ := reflect.TypeOf(Torrent{})
+	commands := []string{"d.name=", "d.unknown=", "d.hash="}
+
+	plan := planFor(typ, commands)
+	if len(plan.fields) != 3 || plan.fields[1] != -1 {
+		t.Fatalf("unexpected plan: %v", plan.fields)
+	}
+	if typ.Field(plan.fields[0]).Name != "Name" || typ.Field(plan.fields[2]).Name != "Hash" {
+		t.Errorf("plan points at wrong fields: %v", plan.fields)
+	}
+	if planFor(typ, commands) != plan {
+		t.Error("expected plan to be cached")
+	}
+}
+
+// Builds a synthetic d.multicall2 result for the default view commands
+func benchmarkMulticall(rows int) ([]interface{}, []interface{}) {
+	args := []interface{}{"", "main",
+		"d.hash=", "d.name=",
+		"d.size_bytes=", "d.completed_bytes=", "d.up.rate=",
+		"d.up.total=", "d.down.rate=", "d.down.total=",
+		"d.message=", "d.is_active=", "d.is_open=",
+		"d.is_hash_checking=", "d.peers_accounted=", "d.peers_complete=",
+		"d.state=", "d.state_changed=", "d.state_counter=", "d.priority=",
+		"d.custom1=", "d.custom2=", "d.custom3=",
+		"d.custom4=", "d.custom5="}
+
+	result := make([]interface{}, rows)
+	for r := range result {
+		row := make([]interface{}, len(args)-2)
+		for idx, command := range args[2:] {
+			switch command {
+			case "d.hash=", "d.name=", "d.message=",
+				"d.custom1=", "d.custom2=", "d.custom3=", "d.custom4=", "d.custom5=":
+				row[idx] = fmt.Sprintf("%s%d", command, r)
+			default:
+				row[idx] = int64(r)
+			}
+		}
+		result[r] = row
+	}
+	return result, args
+}
+
+// Decodes by scanning every struct field for every value, as rtw did before
+// decode plans were introduced
+func multicallTagsScan(result interface{}, args interface{}) []Torrent {
+	items := make([]Torrent, 0)
+	for _, outer := range result.([]interface{}) {
+		item := new(Torrent)
+		for idx := 2; idx < len(args.([]interface{})); idx++ {
+			ref := outer.([]interface{})[idx-2]
+			fname := args.([]interface{})[idx].(string)
+			el := reflect.ValueOf(item).Elem()
+			for i := 0; i < el.NumField(); i++ {
+				if fname == el.Type().Field(i).Tag.Get("rtw") {
+					el.Field(i).Set(reflect.ValueOf(ref))
+				}
+			}
+		}
+		items = append(items, *item)
+	}
+	return items
+}
+
+func BenchmarkMulticallTags(b *testing.B) {
+	result, args := benchmarkMulticall(50000)
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		_, err := multicallTags[Torrent](result, args)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMulticallTagsScan(b *testing.B) {
+	result, args := benchmarkMulticall(50000)
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		multicallTagsScan(result, args)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrNoDownloadRoots = errors.New("no download roots are configured, refusing to delete data")
+	ErrTorrentNotFound = errors.New("torrent not found")
+)
+
+// OutsideRootsError is returned when a torrent's data is not inside one of
+// the allowed download roots
+type OutsideRootsError struct {
+	Path string
+}
+
+func (e *OutsideRootsError) Error() string {
+	return fmt.Sprintf("refusing to delete %s, it is outside the allowed download roots", e.Path)
+}
+
+// DataRemoval lists what happened to the files of a torrent erased together
+// with its data
+type DataRemoval struct {
+	// Removed files and directories
+	Removed []string `json:"removed"`
+	// Kept files that another loaded torrent still references
+	Kept []string `json:"kept"`
+	// Failed removals with the reason
+	Failed []string `json:"failed"`
+}
+
+// Erases torrent with the specified hash and then deletes its data. Nothing
+// is erased if any of the data lies outside the download roots, and files
+// another loaded torrent references are kept.
+func (rt *Rtorrent) EraseWithData(ctx context.Context, hash string) (DataRemoval, error) {
+	roots := cleanRoots(rt.downloadRoots)
+	if len(roots) == 0 {
+		return DataRemoval{}, ErrNoDownloadRoots
+	}
+	// what is deleted is decided on the current state
+	ctx = withoutCache(ctx)
+
+	args := []interface{}{"", "main", "d.hash=", "d.name=",
+		"d.base_path=", "d.directory=", "d.is_multi_file="}
+	torrents, err := rt.DMulticall(ctx, "main", args)
+	if err != nil {
+		return DataRemoval{}, err
+	}
+
+	var target *Torrent
+	others := make([]Torrent, 0, len(torrents))
+	for i := range torrents {
+		if strings.EqualFold(torrents[i].Hash, hash) {
+			target = &torrents[i]
+			continue
+		}
+		others = append(others, torrents[i])
+	}
+	if target == nil {
+		return DataRemoval{}, ErrTorrentNotFound
+	}
+
+	files, err := rt.FMulticall(ctx, []interface{}{target.Hash, "", "f.path="})
+	if err != nil {
+		return DataRemoval{}, err
+	}
+
+	root := dataRoot(*target)
+	paths := []string{root}
+	if target.IsMultiFile == 1 {
+		paths = make([]string, 0, len(files))
+		for _, file := range files {
+			paths = append(paths, filepath.Join(root, file.Path))
+		}
+	}
+
+	// refuse before anything is erased
+	for _, path := range paths {
+		if !insideRoots(path, roots) || (target.IsMultiFile == 1 && !within(root, path)) {
+			return DataRemoval{}, &OutsideRootsError{Path: path}
+		}
+	}
+
+	err = rt.Erase(ctx, target.Hash)
+	if err != nil {
+		return DataRemoval{}, err
+	}
+
+	removal := DataRemoval{
+		Removed: []string{},
+		Kept:    []string{},
+		Failed:  []string{},
+	}
+
+	for _, path := range paths {
+		if referenced(path, others) {
+			removal.Kept = append(removal.Kept, path)
+			continue
+		}
+
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			removal.Failed = append(removal.Failed, err.Error())
+			continue
+		}
+		removal.Removed = append(removal.Removed, path)
+	}
+
+	if target.IsMultiFile == 1 {
+		for _, dir := range emptyDirCandidates(root, paths) {
+			if !insideRoots(dir, roots) || referenced(dir, others) {
+				continue
+			}
+			// only succeeds for empty directories
+			if os.Remove(dir) == nil {
+				removal.Removed = append(removal.Removed, dir)
+			}
+		}
+	}
+
+	return removal, nil
+}
+
+// Returns the path of the torrent's data, the directory of a multi file
+// torrent or the file of a single file torrent. d.base_path is empty while
+// a torrent is closed, so it is derived from d.directory then.
+func dataRoot(t Torrent) string {
+	if t.BasePath != "" {
+		return filepath.Clean(t.BasePath)
+	}
+	if t.IsMultiFile == 1 {
+		return filepath.Clean(t.Directory)
+	}
+	return filepath.Join(t.Directory, t.Name)
+}
+
+// Reports whether another torrent's data contains path
+func referenced(path string, others []Torrent) bool {
+	for _, other := range others {
+		root := dataRoot(other)
+		if path == root {
+			return true
+		}
+		if other.IsMultiFile == 1 && within(root, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the directories between the files and root, deepest first
+func emptyDirCandidates(root string, paths []string) []string {
+	seen := map[string]bool{}
+	for _, path := range paths {
+		for dir := filepath.Dir(path); within(root, dir) || dir == root; dir = filepath.Dir(dir) {
+			seen[dir] = true
+		}
+	}
+
+	dirs := make([]string, 0, len(seen))
+	for dir := range seen {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	return dirs
+}
+
+// Returns the absolute roots cleaned
+func cleanRoots(roots []string) []string {
+	cleaned := make([]string, 0, len(roots))
+	for _, root := range roots {
+		if !filepath.IsAbs(root) {
+			continue
+		}
+		cleaned = append(cleaned, filepath.Clean(root))
+	}
+	return cleaned
+}
+
+// Reports whether path is strictly inside one of the roots, both as written
+// and with symlinks resolved so a linked directory cannot escape a root
+func insideRoots(path string, roots []string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	path = filepath.Clean(path)
+	dir, dirErr := filepath.EvalSymlinks(filepath.Dir(path))
+
+	for _, root := range roots {
+		if !within(root, path) {
+			continue
+		}
+		if dirErr != nil {
+			// the parent does not exist so there is nothing to delete
+			return true
+		}
+
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			resolvedRoot = root
+		}
+		if within(resolvedRoot, filepath.Join(dir, filepath.Base(path))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether path is strictly inside dir
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
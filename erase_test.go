@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
+)
+
+// Creates files relative to dir
+func createFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// Adds a torrent with data at directory to the fake
+func addDataTorrent(fake *rtorrenttest.Server, hash, name, directory string, files ...string) {
+	torrent := rtorrenttest.NewTorrent(hash, name)
+	torrent.Fields["d.directory"] = directory
+	if len(files) > 0 {
+		torrent.Fields["d.is_multi_file"] = int64(1)
+		torrent.Fields["d.base_path"] = directory
+	} else {
+		files = []string{name}
+	}
+	for _, file := range files {
+		torrent.Files = append(torrent.Files, rtorrenttest.Item{"f.path": file})
+	}
+	fake.Add(torrent)
+}
+
+func newEraseTestRtorrent(t *testing.T, roots ...string) (*Rtorrent, *rtorrenttest.Server) {
+	t.Helper()
+
+	fake := rtorrenttest.NewServer()
+	t.Cleanup(fake.Close)
+
+	rtorrent, err := NewRtorrent(RtorrentConfig{
+		URL:           fake.URL,
+		DownloadRoots: roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rtorrent, fake
+}
+
+func TestEraseWithData(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root,
+		"show/e01.mkv", "show/extras/making-of.mkv", "show/e02.mkv",
+		"movie.mkv",
+	)
+
+	rtorrent, fake := newEraseTestRtorrent(t, root)
+	addDataTorrent(fake, "aaa", "show", filepath.Join(root, "show"), "e01.mkv", "extras/making-of.mkv", "e02.mkv")
+	addDataTorrent(fake, "bbb", "movie.mkv", root)
+	// cross seeded episode that is still loaded
+	addDataTorrent(fake, "ccc", "e02.mkv", filepath.Join(root, "show"))
+
+	removal, err := rtorrent.EraseWithData(context.Background(), "aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(removal.Removed)
+	want := []string{
+		filepath.Join(root, "show/e01.mkv"),
+		filepath.Join(root, "show/extras"),
+		filepath.Join(root, "show/extras/making-of.mkv"),
+	}
+	if len(removal.Removed) != len(want) {
+		t.Fatalf("expected %v removed, got %v", want, removal.Removed)
+	}
+	for i := range want {
+		if removal.Removed[i] != want[i] {
+			t.Errorf("expected %s removed, got %s", want[i], removal.Removed[i])
+		}
+	}
+	if len(removal.Kept) != 1 || removal.Kept[0] != filepath.Join(root, "show/e02.mkv") {
+		t.Errorf("expected cross seeded file to be kept, got %v", removal.Kept)
+	}
+
+	if !exists(filepath.Join(root, "show/e02.mkv")) || !exists(filepath.Join(root, "movie.mkv")) {
+		t.Error("referenced data was deleted")
+	}
+	if _, ok := fake.Torrent("aaa"); ok {
+		t.Error("expected torrent to be erased")
+	}
+
+	removal, err = rtorrent.EraseWithData(context.Background(), "bbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removal.Removed) != 1 || exists(filepath.Join(root, "movie.mkv")) {
+		t.Errorf("expected single file to be removed, got %+v", removal)
+	}
+	if !exists(root) {
+		t.Error("download root was removed")
+	}
+}
+
+func TestEraseWithDataRefused(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	createFiles(t, outside, "secret.txt")
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	rtorrent, fake := newEraseTestRtorrent(t, root)
+	addDataTorrent(fake, "aaa", "secret.txt", outside)
+	addDataTorrent(fake, "bbb", "secret.txt", filepath.Join(root, "link"))
+	addDataTorrent(fake, "ccc", "escape", filepath.Join(root, "escape"), "../../"+filepath.Base(outside)+"/secret.txt")
+
+	for _, hash := range []string{"aaa", "bbb", "ccc"} {
+		_, err := rtorrent.EraseWithData(context.Background(), hash)
+		var outsideErr *OutsideRootsError
+		if !errors.As(err, &outsideErr) {
+			t.Errorf("%s: expected outside roots error, got %v", hash, err)
+		}
+		if _, ok := fake.Torrent(hash); !ok {
+			t.Errorf("%s: torrent was erased despite refusal", hash)
+		}
+	}
+	if !exists(filepath.Join(outside, "secret.txt")) {
+		t.Error("data outside the roots was deleted")
+	}
+
+	_, err := rtorrent.EraseWithData(context.Background(), "missing")
+	if !errors.Is(err, ErrTorrentNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	unconfigured, _ := newEraseTestRtorrent(t)
+	_, err = unconfigured.EraseWithData(context.Background(), "aaa")
+	if !errors.Is(err, ErrNoDownloadRoots) {
+		t.Errorf("expected no download roots error, got %v", err)
+	}
+}
+
+func TestEraseHandlerWithData(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "movie.mkv")
+
+	rtorrent, fake := newEraseTestRtorrent(t, root)
+	addDataTorrent(fake, "aaa", "movie.mkv", root)
+	addDataTorrent(fake, "bbb", "other.mkv", "/elsewhere")
+	srv := httptest.NewServer(newRouter(rtorrent, nil))
+	defer srv.Close()
+
+	var resp EraseResponse
+	code := doJSON(t, "DELETE", srv.URL+"/api/torrent/AAA?with_data=true", nil, "", &resp)
+	if code != http.StatusOK || len(resp.Removed) != 1 || resp.Removed[0] != filepath.Join(root, "movie.mkv") {
+		t.Errorf("unexpected response %d: %+v", code, resp)
+	}
+
+	var errResp Response
+	code = doJSON(t, "DELETE", srv.URL+"/api/torrent/BBB?with_data=true", nil, "", &errResp)
+	if code != http.StatusForbidden {
+		t.Errorf("expected forbidden, got %d: %+v", code, errResp)
+	}
+
+	code = doJSON(t, "DELETE", srv.URL+"/api/torrent/CCC?with_data=true", nil, "", &errResp)
+	if code != http.StatusNotFound {
+		t.Errorf("expected not found, got %d: %+v", code, errResp)
+	}
+
+	code = doJSON(t, "DELETE", srv.URL+"/api/torrent/BBB?with_data=maybe", nil, "", &errResp)
+	if code != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %d: %+v", code, errResp)
+	}
+}
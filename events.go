@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventTorrentAdded          = "torrent.added"
+	EventTorrentRemoved        = "torrent.removed"
+	EventTorrentCompleted      = "torrent.completed"
+	EventTorrentStateChanged   = "torrent.state_changed"
+	EventTorrentMessageChanged = "torrent.message_changed"
+	EventTorrentRates          = "torrent.rates"
+	// EventStreamOpen is sent first on a new stream, its ID lets a client
+	// resume even if no torrent changes before it disconnects
+	EventStreamOpen = "stream.open"
+	// EventStreamReset tells a resuming client that events were missed and
+	// the view has to be fetched again
+	EventStreamReset = "stream.reset"
+)
+
+// maxEventHistory is the number of events kept for resuming streams
+const maxEventHistory = 4096
+
+// eventBuffer is the number of events a subscriber can fall behind before
+// it is dropped
+const eventBuffer = 256
+
+// Commands polled for events
+var eventArgs = []interface{}{"d.hash=", "d.name=", "d.state=", "d.is_active=",
+	"d.message=", "d.up.rate=", "d.down.rate=", "d.size_bytes=", "d.completed_bytes=",
+	"d.custom1="}
+
+// Event is a change of a torrent in a view
+type Event struct {
+	ID      uint64        `json:"id"`
+	Type    string        `json:"type"`
+	View    string        `json:"view"`
+	Hash    string        `json:"hash,omitempty"`
+	Torrent *TorrentState `json:"torrent,omitempty"`
+}
+
+// TorrentState is the part of a torrent events report on
+type TorrentState struct {
+	Name         string  `json:"name"`
+	Label        string  `json:"label"`
+	State        int64   `json:"state"`
+	IsActive     int64   `json:"is_active"`
+	Message      string  `json:"message"`
+	UploadRate   int64   `json:"upload_rate"`
+	DownloadRate int64   `json:"download_rate"`
+	Progress     float64 `json:"progress"`
+	Complete     bool    `json:"complete"`
+}
+
+func newTorrentState(t Torrent) TorrentState {
+	return TorrentState{
+		Name:         t.Name,
+		Label:        t.Custom1,
+		State:        t.State,
+		IsActive:     t.IsActive,
+		Message:      t.Message,
+		UploadRate:   t.UploadRate,
+		DownloadRate: t.DownloadRate,
+		Progress:     t.Progress,
+		Complete:     t.complete(),
+	}
+}
+
+// Returns the events that turn old into current, old is nil for a torrent
+// that was not in the view before
+func diffTorrent(old *TorrentState, current TorrentState) []string {
+	if old == nil {
+		return []string{EventTorrentAdded}
+	}
+
+	types := []string{}
+	if current.Complete && !old.Complete {
+		types = append(types, EventTorrentCompleted)
+	}
+	if current.State != old.State || current.IsActive != old.IsActive {
+		types = append(types, EventTorrentStateChanged)
+	}
+	if current.Message != old.Message {
+		types = append(types, EventTorrentMessageChanged)
+	}
+	if current.UploadRate != old.UploadRate || current.DownloadRate != old.DownloadRate {
+		types = append(types, EventTorrentRates)
+	}
+	return types
+}
+
+// Subscription receives the events of a view, optionally only for some
+// hashes. Events is closed when the subscriber falls too far behind or the
+// hub is closed.
+type Subscription struct {
+	Events <-chan Event
+
+	view   string
+	hashes map[string]bool
+	events chan Event
+}
+
+func (s *Subscription) matches(e Event) bool {
+	if e.View != s.view {
+		return false
+	}
+	return len(s.hashes) == 0 || e.Hash == "" || s.hashes[e.Hash]
+}
+
+// watchedView is the last polled state of a view
+type watchedView struct {
+	// torrents is nil until the first poll sets the baseline
+	torrents map[string]TorrentState
+	// since is the event ID at which the baseline was set, streams resuming
+	// from before it have missed changes
+	since       uint64
+	subscribers int
+}
+
+// eventHub polls the views that have subscribers, diffs them and fans the
+// events out. Polling stops while nobody is subscribed.
+type eventHub struct {
+	rt       *Rtorrent
+	interval time.Duration
+	// ctx is cancelled when the hub is closed, ending a poll in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	// polling is done when run has returned
+	polling sync.WaitGroup
+
+	mu      sync.Mutex
+	lastID  uint64
+	history []Event
+	// trimmed is the ID of the last event dropped from history
+	trimmed     uint64
+	views       map[string]*watchedView
+	subscribers map[*Subscription]bool
+	running     bool
+	closed      bool
+}
+
+func newEventHub(rt *Rtorrent, interval time.Duration) *eventHub {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &eventHub{
+		rt:          rt,
+		interval:    interval,
+		ctx:         ctx,
+		cancel:      cancel,
+		views:       map[string]*watchedView{},
+		subscribers: map[*Subscription]bool{},
+	}
+}
+
+// Subscribes to the events of view. The returned events are to be sent
+// first, a stream.open event or with resume set the buffered events after
+// lastID, or a stream.reset event when some of them are no longer known.
+func (h *eventHub) Subscribe(view string, hashes []string, resume bool, lastID uint64) (*Subscription, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &Subscription{
+		view:   view,
+		hashes: map[string]bool{},
+		events: make(chan Event, eventBuffer),
+	}
+	sub.Events = sub.events
+	for _, hash := range hashes {
+		sub.hashes[hash] = true
+	}
+	if h.closed {
+		close(sub.events)
+		return sub, nil
+	}
+
+	watched, ok := h.views[view]
+	if !ok {
+		// nothing can be resumed until the first poll
+		watched = &watchedView{since: ^uint64(0)}
+		h.views[view] = watched
+	}
+	watched.subscribers++
+	h.subscribers[sub] = true
+
+	if !h.running {
+		h.running = true
+		h.polling.Add(1)
+		go h.run()
+	}
+
+	if !resume {
+		return sub, []Event{{ID: h.lastID, Type: EventStreamOpen, View: view}}
+	}
+	// IDs from before a restart are larger than the current ones
+	if lastID > h.lastID || lastID < watched.since || lastID < h.trimmed {
+		return sub, []Event{{ID: h.lastID, Type: EventStreamReset, View: view}}
+	}
+
+	replay := []Event{}
+	for _, e := range h.history {
+		if e.ID > lastID && sub.matches(e) {
+			replay = append(replay, e)
+		}
+	}
+	return sub, replay
+}
+
+// Removes the subscription, the view stops being polled with its last
+// subscriber
+func (h *eventHub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+func (h *eventHub) remove(sub *Subscription) {
+	if !h.subscribers[sub] {
+		return
+	}
+	delete(h.subscribers, sub)
+	close(sub.events)
+
+	watched := h.views[sub.view]
+	watched.subscribers--
+	if watched.subscribers == 0 {
+		delete(h.views, sub.view)
+	}
+}
+
+// Ends every subscription and waits for polling to stop
+func (h *eventHub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	for sub := range h.subscribers {
+		h.remove(sub)
+	}
+	h.mu.Unlock()
+
+	h.cancel()
+	h.polling.Wait()
+}
+
+// Polls until there are no subscribers left
+func (h *eventHub) run() {
+	defer h.polling.Done()
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.mu.Lock()
+		if len(h.subscribers) == 0 {
+			h.running = false
+			h.mu.Unlock()
+			return
+		}
+		views := make([]string, 0, len(h.views))
+		for view := range h.views {
+			views = append(views, view)
+		}
+		h.mu.Unlock()
+
+		for _, view := range views {
+			h.poll(view)
+		}
+		select {
+		case <-ticker.C:
+		case <-h.ctx.Done():
+		}
+	}
+}
+
+func (h *eventHub) poll(view string) {
+	ctx, cancel := context.WithTimeout(h.ctx, h.interval)
+	defer cancel()
+
+	args := append([]interface{}{"", view}, eventArgs...)
+	torrents, err := h.rt.DMulticall(ctx, view, args)
+	if err != nil {
+		log.Printf("error polling view %s for events: %s", view, err)
+		return
+	}
+
+	current := make(map[string]TorrentState, len(torrents))
+	for _, torrent := range torrents {
+		current[torrent.Hash] = newTorrentState(torrent)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	watched, ok := h.views[view]
+	if !ok {
+		// unsubscribed while polling
+		return
+	}
+	previous := watched.torrents
+	watched.torrents = current
+	if previous == nil {
+		h.lastID++
+		watched.since = h.lastID
+		return
+	}
+
+	for _, torrent := range torrents {
+		state := current[torrent.Hash]
+		var old *TorrentState
+		if prev, ok := previous[torrent.Hash]; ok {
+			old = &prev
+		}
+		for _, typ := range diffTorrent(old, state) {
+			state := state
+			h.publish(Event{Type: typ, View: view, Hash: torrent.Hash, Torrent: &state})
+		}
+	}
+	for hash := range previous {
+		if _, ok := current[hash]; !ok {
+			h.publish(Event{Type: EventTorrentRemoved, View: view, Hash: hash})
+		}
+	}
+}
+
+// Numbers the event, records it and sends it to matching subscribers.
+// Subscribers that cannot keep up are dropped, they can resume from their
+// last event ID.
+func (h *eventHub) publish(e Event) {
+	h.lastID++
+	e.ID = h.lastID
+
+	// the oldest event is resliced away, the window is only copied to a new
+	// array of twice the limit once it reaches the end of the current one
+	if len(h.history) >= maxEventHistory && len(h.history) == cap(h.history) {
+		history := make([]Event, len(h.history), 2*maxEventHistory)
+		copy(history, h.history)
+		h.history = history
+	}
+	h.history = append(h.history, e)
+	if len(h.history) > maxEventHistory {
+		h.trimmed = h.history[0].ID
+		h.history = h.history[1:]
+	}
+
+	for sub := range h.subscribers {
+		if !sub.matches(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			log.Printf("dropping events subscriber of view %s, it fell behind", sub.view)
+			h.remove(sub)
+		}
+	}
+}
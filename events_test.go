@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
+)
+
+// Returns an Rtorrent whose event hub polls every few milliseconds
+func newTestEvents(t *testing.T) (*Rtorrent, *rtorrenttest.Server) {
+	t.Helper()
+
+	rtorrent, fake := newTestRtorrent(t)
+	rtorrent.events = newEventHub(rtorrent, 5*time.Millisecond)
+	return rtorrent, fake
+}
+
+// Waits until the view's baseline has been polled
+func waitForBaseline(t *testing.T, hub *eventHub, view string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		hub.mu.Lock()
+		watched, ok := hub.views[view]
+		ready := ok && watched.torrents != nil
+		hub.mu.Unlock()
+		if ready {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("view %s was not polled", view)
+}
+
+// Returns the next event of the subscription
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+
+	select {
+	case e, ok := <-sub.Events:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received")
+	}
+	return Event{}
+}
+
+func TestDiffTorrent(t *testing.T) {
+	old := TorrentState{Name: "a", State: 1, IsActive: 1}
+
+	tests := []struct {
+		old     *TorrentState
+		current TorrentState
+		want    []string
+	}{
+		{nil, old, []string{EventTorrentAdded}},
+		{&old, old, []string{}},
+		{&old, TorrentState{Name: "a", State: 0, IsActive: 0}, []string{EventTorrentStateChanged}},
+		{&old, TorrentState{Name: "a", State: 1, IsActive: 1, Complete: true, Message: "x", DownloadRate: 5},
+			[]string{EventTorrentCompleted, EventTorrentMessageChanged, EventTorrentRates}},
+	}
+
+	for _, tt := range tests {
+		got := diffTorrent(tt.old, tt.current)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v -> %+v: expected %v, got %v", tt.old, tt.current, tt.want, got)
+		}
+	}
+}
+
+func TestEventHub(t *testing.T) {
+	rtorrent, fake := newTestEvents(t)
+	addTestTorrent(fake, "A", "a")
+
+	sub, first := rtorrent.events.Subscribe("main", nil, false, 0)
+	defer rtorrent.events.Unsubscribe(sub)
+	if len(first) != 1 || first[0].Type != EventStreamOpen {
+		t.Fatalf("expected stream.open, got %+v", first)
+	}
+	waitForBaseline(t, rtorrent.events, "main")
+
+	addTestTorrent(fake, "B", "b")
+	e := nextEvent(t, sub)
+	if e.Type != EventTorrentAdded || e.Hash != "B" || e.Torrent.Name != "b" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	err := rtorrent.Start(context.Background(), "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = nextEvent(t, sub)
+	if e.Type != EventTorrentStateChanged || e.Hash != "A" || e.Torrent.State != 1 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	fake.Update("A", rtorrenttest.Item{"d.completed_bytes": int64(1024), "d.message": "done"})
+	e = nextEvent(t, sub)
+	if e.Type != EventTorrentCompleted || !e.Torrent.Complete || e.Torrent.Progress != 100 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	e = nextEvent(t, sub)
+	if e.Type != EventTorrentMessageChanged || e.Torrent.Message != "done" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	err = rtorrent.Erase(context.Background(), "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = nextEvent(t, sub)
+	if e.Type != EventTorrentRemoved || e.Hash != "B" || e.Torrent != nil {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestEventHubHashes(t *testing.T) {
+	rtorrent, fake := newTestEvents(t)
+	addTestTorrent(fake, "A", "a")
+	addTestTorrent(fake, "B", "b")
+
+	sub, _ := rtorrent.events.Subscribe("main", []string{"B"}, false, 0)
+	defer rtorrent.events.Unsubscribe(sub)
+	waitForBaseline(t, rtorrent.events, "main")
+
+	fake.Update("A", rtorrenttest.Item{"d.message": "a"})
+	fake.Update("B", rtorrenttest.Item{"d.message": "b"})
+
+	e := nextEvent(t, sub)
+	if e.Hash != "B" || e.Type != EventTorrentMessageChanged {
+		t.Fatalf("expected only events of B, got %+v", e)
+	}
+}
+
+func TestEventHubResume(t *testing.T) {
+	rtorrent, fake := newTestEvents(t)
+	addTestTorrent(fake, "A", "a")
+
+	// keeps the view polled while the other subscriber reconnects
+	keep, _ := rtorrent.events.Subscribe("main", nil, false, 0)
+	defer rtorrent.events.Unsubscribe(keep)
+	waitForBaseline(t, rtorrent.events, "main")
+
+	sub, _ := rtorrent.events.Subscribe("main", nil, false, 0)
+	fake.Update("A", rtorrenttest.Item{"d.message": "one"})
+	first := nextEvent(t, sub)
+	rtorrent.events.Unsubscribe(sub)
+
+	fake.Update("A", rtorrenttest.Item{"d.message": "two"})
+	nextEvent(t, keep)
+	nextEvent(t, keep)
+
+	sub, replay := rtorrent.events.Subscribe("main", nil, true, first.ID)
+	defer rtorrent.events.Unsubscribe(sub)
+	if len(replay) != 1 || replay[0].Type != EventTorrentMessageChanged || replay[0].Torrent.Message != "two" {
+		t.Fatalf("unexpected replay %+v", replay)
+	}
+
+	for _, lastID := range []uint64{0, first.ID + 1000} {
+		other, replay := rtorrent.events.Subscribe("main", nil, true, lastID)
+		rtorrent.events.Unsubscribe(other)
+		if len(replay) != 1 || replay[0].Type != EventStreamReset {
+			t.Errorf("%d: expected stream.reset, got %+v", lastID, replay)
+		}
+	}
+
+	other, replay := rtorrent.events.Subscribe("other", nil, true, first.ID)
+	rtorrent.events.Unsubscribe(other)
+	if len(replay) != 1 || replay[0].Type != EventStreamReset {
+		t.Errorf("expected stream.reset for a view that was not watched, got %+v", replay)
+	}
+}
+
+func TestEventHubHistory(t *testing.T) {
+	rtorrent, _ := newTestEvents(t)
+	hub := rtorrent.events
+
+	for i := 0; i < 3*maxEventHistory+10; i++ {
+		hub.publish(Event{Type: EventTorrentMessageChanged, View: "main"})
+		if cap(hub.history) > 2*maxEventHistory {
+			t.Fatalf("expected the history to stay within twice the limit, got a capacity of %d", cap(hub.history))
+		}
+	}
+	if len(hub.history) != maxEventHistory || hub.history[0].ID != hub.trimmed+1 || hub.history[maxEventHistory-1].ID != hub.lastID {
+		t.Errorf("expected the last %d events after %d, got %d from %d to %d",
+			maxEventHistory, hub.trimmed, len(hub.history), hub.history[0].ID, hub.history[len(hub.history)-1].ID)
+	}
+}
+
+func TestEventHubStops(t *testing.T) {
+	rtorrent, _ := newTestEvents(t)
+
+	sub, _ := rtorrent.events.Subscribe("main", nil, false, 0)
+	waitForBaseline(t, rtorrent.events, "main")
+	rtorrent.events.Unsubscribe(sub)
+
+	if _, ok := <-sub.Events; ok {
+		t.Error("expected events to be closed")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		rtorrent.events.mu.Lock()
+		running := rtorrent.events.running
+		rtorrent.events.mu.Unlock()
+		if !running {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("expected polling to stop without subscribers")
+}
+
+func TestEventHubClose(t *testing.T) {
+	rtorrent, _ := newTestEvents(t)
+
+	sub, _ := rtorrent.events.Subscribe("main", nil, false, 0)
+	waitForBaseline(t, rtorrent.events, "main")
+	rtorrent.events.Close()
+
+	if _, ok := <-sub.Events; ok {
+		t.Error("expected events to be closed")
+	}
+	if rtorrent.events.running {
+		t.Error("expected polling to have stopped")
+	}
+
+	late, first := rtorrent.events.Subscribe("main", nil, false, 0)
+	if _, ok := <-late.Events; ok || len(first) != 0 {
+		t.Errorf("expected a subscription after closing to be closed, got %+v", first)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	rtorrent, fake := newTestEvents(t)
+	srv := httptest.NewServer(newRouter(rtorrent, nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/events?view=main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var e Event
+			json.Unmarshal([]byte(data), &e)
+			events <- e
+		}
+	}()
+
+	e := <-events
+	if e.Type != EventStreamOpen {
+		t.Fatalf("expected stream.open, got %+v", e)
+	}
+	waitForBaseline(t, rtorrent.events, "main")
+
+	addTestTorrent(fake, "A", "a")
+	select {
+	case e := <-events:
+		if e.Type != EventTorrentAdded || e.Hash != "A" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	var errResp Response
+	code := doJSON(t, "GET", srv.URL+"/api/events?view=nonexistent", nil, "", &errResp)
+	if code != http.StatusBadRequest {
+		t.Errorf("expected bad request for unknown view, got %d", code)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/api/events", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	bad, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request for invalid Last-Event-ID, got %d", bad.StatusCode)
+	}
+}
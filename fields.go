@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Reports whether rTorrent has the method, the method list is fetched once
+// and cached
+func (rt *Rtorrent) HasMethod(ctx context.Context, name string) (bool, error) {
+	rt.methods.Lock()
+	defer rt.methods.Unlock()
+
+	if rt.methods.names == nil {
+		methods, err := rt.ListMethods(ctx)
+		if err != nil {
+			return false, err
+		}
+		names := make(map[string]bool, len(methods))
+		for _, method := range methods {
+			names[method] = true
+		}
+		rt.methods.names = names
+	}
+	return rt.methods.names[name], nil
+}
+
+// fieldGetters are the d.* commands that can be selected as fields. They
+// only read, d.multicall2 runs the selection on every torrent of the view.
+var fieldGetters = map[string]bool{
+	"d.accepting_seeders": true, "d.base_filename": true, "d.base_path": true,
+	"d.bitfield": true, "d.bytes_done": true, "d.chunk_size": true,
+	"d.chunks_hashed": true, "d.chunks_seen": true, "d.complete": true,
+	"d.completed_bytes": true, "d.completed_chunks": true,
+	"d.connection_current": true, "d.connection_leech": true,
+	"d.connection_seed": true, "d.creation_date": true, "d.custom": true,
+	"d.custom1": true, "d.custom2": true, "d.custom3": true, "d.custom4": true,
+	"d.custom5": true, "d.custom_throw": true, "d.directory": true,
+	"d.directory_base": true, "d.down.rate": true, "d.down.total": true,
+	"d.downloads_max": true, "d.downloads_min": true,
+	"d.free_diskspace": true, "d.hash": true, "d.hashing": true,
+	"d.hashing_failed": true, "d.ignore_commands": true, "d.incomplete": true,
+	"d.is_active": true, "d.is_hash_checked": true, "d.is_hash_checking": true,
+	"d.is_meta": true, "d.is_multi_file": true, "d.is_not_partially_done": true,
+	"d.is_open": true, "d.is_partially_done": true, "d.is_pex_active": true,
+	"d.is_private": true, "d.left_bytes": true, "d.load_date": true,
+	"d.loaded_file": true, "d.local_id": true, "d.local_id_html": true,
+	"d.max_file_size": true, "d.message": true, "d.mode": true, "d.name": true,
+	"d.peer_exchange": true, "d.peers_accounted": true,
+	"d.peers_complete": true, "d.peers_connected": true, "d.peers_max": true,
+	"d.peers_min": true, "d.peers_not_connected": true, "d.priority": true,
+	"d.priority_str": true, "d.ratio": true, "d.size_bytes": true,
+	"d.size_chunks": true, "d.size_files": true, "d.size_pex": true,
+	"d.skip.rate": true, "d.skip.total": true, "d.state": true,
+	"d.state_changed": true, "d.state_counter": true, "d.throttle_name": true,
+	"d.tied_to_file": true, "d.timestamp.finished": true,
+	"d.timestamp.started": true, "d.tracker_focus": true,
+	"d.tracker_numwant": true, "d.tracker_size": true, "d.up.rate": true,
+	"d.up.total": true, "d.uploads_max": true, "d.uploads_min": true,
+	"d.views": true, "d.views.has": true, "d.wanted_chunks": true,
+}
+
+// Checks that a field such as "d.ratio" or "d.custom=seedtime" is a getter
+// and returns its method. Parameters are limited to plain words since
+// rTorrent evaluates "$" and other syntax inside them.
+func checkField(field string) (string, error) {
+	method, param, hasParam := strings.Cut(field, "=")
+	if !strings.HasPrefix(method, "d.") {
+		return "", fmt.Errorf("invalid field %s, only d.* commands can be selected", field)
+	}
+	if !fieldGetters[method] {
+		return "", fmt.Errorf("invalid field %s, only getters can be selected", field)
+	}
+	if hasParam && !plainParam(param) {
+		return "", fmt.Errorf("invalid parameter in field %s", field)
+	}
+	return method, nil
+}
+
+// Parses a field selection such as "d.ratio" or "d.custom=seedtime" into a
+// multicall command and checks that it is a getter rTorrent has
+func (rt *Rtorrent) FieldCommand(ctx context.Context, field string) (string, error) {
+	method, err := checkField(field)
+	if err != nil {
+		return "", err
+	}
+	_, param, _ := strings.Cut(field, "=")
+
+	ok, err := rt.HasMethod(ctx, method)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown command: %s", method)
+	}
+	return method + "=" + param, nil
+}
+
+// Reports whether a command parameter only has letters, digits, '_', '-'
+// and '.'
+func plainParam(param string) bool {
+	if param == "" {
+		return false
+	}
+	for _, c := range param {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '_', c == '-', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Runs d.multicall2 and returns each row both decoded into a Torrent and as
+// a map keyed by the field the command was selected with (e.g. "d.ratio" or
+// "d.custom=seedtime"), the rows are in the same order
+func (rt *Rtorrent) DMulticallFields(ctx context.Context, view string, args []interface{}) ([]Torrent, []map[string]interface{}, error) {
+	result, err := rt.cachedCall(ctx, cacheView, "", "d.multicall2", args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	torrents, err := multicallTags[Torrent](result, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range torrents {
+		torrents[i].derive()
+	}
+
+	// multicallTags has checked the shape of the rows
+	rows := result.([]interface{})
+	fields := make([]map[string]interface{}, len(rows))
+	for r, row := range rows {
+		values := row.([]interface{})
+		fields[r] = make(map[string]interface{}, len(values))
+		for idx, value := range values {
+			command := args[idx+2].(string)
+			fields[r][strings.TrimSuffix(command, "=")] = value
+		}
+	}
+	return torrents, fields, nil
+}
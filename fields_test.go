@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFieldCommand(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	addTestTorrent(fake, "A", "a").Fields["d.custom=seedtime"] = "100"
+
+	tests := map[string]string{
+		"d.name":            "d.name=",
+		"d.custom=seedtime": "d.custom=seedtime",
+	}
+	for field, want := range tests {
+		command, err := rtorrent.FieldCommand(context.Background(), field)
+		if err != nil || command != want {
+			t.Errorf("%s: expected %q, got %q (%v)", field, want, command, err)
+		}
+	}
+
+	invalid := []string{
+		"system.hostname",
+		"d.nonexistent",
+		"d.custom=",
+		"d.custom=$execute.throw=rm",
+		"d.custom=a,b",
+		"execute.throw",
+		"d.erase",
+		"d.custom.set=x",
+	}
+	for _, field := range invalid {
+		_, err := rtorrent.FieldCommand(context.Background(), field)
+		if err == nil {
+			t.Errorf("%s: expected error", field)
+		}
+	}
+
+	listed := 0
+	for _, call := range fake.Calls() {
+		if call == "system.listMethods" {
+			listed++
+		}
+	}
+	if listed != 1 {
+		t.Errorf("expected methods to be listed once, got %d", listed)
+	}
+}
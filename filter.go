@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// torrentField describes a Torrent field that can be filtered and sorted on
+type torrentField struct {
+	index   int
+	command string
+	numeric bool
+}
+
+// Torrent fields by their JSON name
+var torrentFields = func() map[string]torrentField {
+	fields := map[string]torrentField{}
+	t := reflect.TypeOf(Torrent{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		command := field.Tag.Get("rtw")
+		kind := field.Type.Kind()
+		if name == "" || name == "-" || command == "" ||
+			(kind != reflect.String && kind != reflect.Int64) {
+			continue
+		}
+		fields[name] = torrentField{
+			index:   i,
+			command: command,
+			numeric: kind == reflect.Int64,
+		}
+	}
+	return fields
+}()
+
+// Comparison operators, the two character ones first so "<=" is not read
+// as "<" followed by "=value"
+var filterOps = []string{"~=", "!=", ">=", "<=", "=", ">", "<"}
+
+// Condition compares a Torrent field with a value, e.g. "message~=unregistered"
+// or "size_bytes>1e9". Text fields support =, != and ~= (case insensitive
+// substring), numeric fields =, !=, >, >=, < and <=.
+type Condition struct {
+	Field string
+	Op    string
+	Value string
+
+	field  torrentField
+	number float64
+}
+
+// Filter matches torrents that satisfy all of its conditions
+type Filter []Condition
+
+// Parses filter expressions, each holding one condition
+func ParseFilter(exprs []string) (Filter, error) {
+	filter := make(Filter, 0, len(exprs))
+	for _, expr := range exprs {
+		condition, err := parseCondition(expr)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, condition)
+	}
+	return filter, nil
+}
+
+func parseCondition(expr string) (Condition, error) {
+	end := strings.IndexAny(expr, "~!=<>")
+	if end <= 0 {
+		return Condition{}, fmt.Errorf("invalid filter %q, expected field, operator and value", expr)
+	}
+
+	c := Condition{Field: expr[:end]}
+	for _, op := range filterOps {
+		if strings.HasPrefix(expr[end:], op) {
+			c.Op = op
+			c.Value = expr[end+len(op):]
+			break
+		}
+	}
+	if c.Op == "" {
+		return Condition{}, fmt.Errorf("invalid operator in filter %q", expr)
+	}
+
+	field, ok := torrentFields[c.Field]
+	if !ok {
+		return Condition{}, fmt.Errorf("unknown filter field: %s", c.Field)
+	}
+	c.field = field
+
+	if !field.numeric {
+		if c.Op != "=" && c.Op != "!=" && c.Op != "~=" {
+			return Condition{}, fmt.Errorf("operator %s does not apply to text field %s", c.Op, c.Field)
+		}
+		return c, nil
+	}
+
+	if c.Op == "~=" {
+		return Condition{}, fmt.Errorf("operator ~= does not apply to numeric field %s", c.Field)
+	}
+	number, err := strconv.ParseFloat(c.Value, 64)
+	if err != nil {
+		return Condition{}, fmt.Errorf("invalid number in filter %q", expr)
+	}
+	c.number = number
+	return c, nil
+}
+
+// Returns the multicall commands the filter needs, e.g. "d.message="
+func (f Filter) Commands() []string {
+	commands := make([]string, 0, len(f))
+	seen := map[string]bool{}
+	for _, c := range f {
+		if seen[c.field.command] {
+			continue
+		}
+		seen[c.field.command] = true
+		commands = append(commands, c.field.command)
+	}
+	return commands
+}
+
+// Reports whether the torrent satisfies all conditions
+func (f Filter) Match(t Torrent) bool {
+	v := reflect.ValueOf(t)
+	for _, c := range f {
+		if !c.match(v.Field(c.field.index)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Condition) match(v reflect.Value) bool {
+	if !c.field.numeric {
+		s := v.String()
+		switch c.Op {
+		case "=":
+			return s == c.Value
+		case "!=":
+			return s != c.Value
+		case "~=":
+			return strings.Contains(strings.ToLower(s), strings.ToLower(c.Value))
+		}
+		return false
+	}
+
+	n := float64(v.Int())
+	switch c.Op {
+	case "=":
+		return n == c.number
+	case "!=":
+		return n != c.number
+	case ">":
+		return n > c.number
+	case ">=":
+		return n >= c.number
+	case "<":
+		return n < c.number
+	case "<=":
+		return n <= c.number
+	}
+	return false
+}
+
+// SortKey orders torrents by a field, descending when Desc is set
+type SortKey struct {
+	Field string
+	Desc  bool
+
+	field torrentField
+}
+
+// Parses a comma separated list of fields, a leading "-" sorts descending,
+// e.g. "-size_bytes,name"
+func ParseSort(expr string) ([]SortKey, error) {
+	keys := []SortKey{}
+	for _, name := range strings.Split(expr, ",") {
+		key := SortKey{}
+		name, key.Desc = strings.CutPrefix(name, "-")
+
+		field, ok := torrentFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown sort field: %s", name)
+		}
+		key.Field = name
+		key.field = field
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Returns the multicall commands the sort keys need
+func sortCommands(keys []SortKey) []string {
+	commands := make([]string, 0, len(keys))
+	for _, key := range keys {
+		commands = append(commands, key.field.command)
+	}
+	return commands
+}
+
+// Sorts order, indexes into torrents, by the keys. Text is compared case
+// insensitively and torrents that compare equal keep their order.
+func sortTorrents(torrents []Torrent, order []int, keys []SortKey) {
+	sort.SliceStable(order, func(i, j int) bool {
+		a := reflect.ValueOf(torrents[order[i]])
+		b := reflect.ValueOf(torrents[order[j]])
+		for _, key := range keys {
+			cmp := compareField(a.Field(key.field.index), b.Field(key.field.index), key.field.numeric)
+			if cmp == 0 {
+				continue
+			}
+			if key.Desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+}
+
+func compareField(a, b reflect.Value, numeric bool) int {
+	if numeric {
+		switch {
+		case a.Int() < b.Int():
+			return -1
+		case a.Int() > b.Int():
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(strings.ToLower(a.String()), strings.ToLower(b.String()))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	filter, err := ParseFilter([]string{"message~=unregistered", "size_bytes>=1e9", "custom1=tv", "state!=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"d.message=", "d.size_bytes=", "d.custom1=", "d.state="}
+	if !reflect.DeepEqual(filter.Commands(), want) {
+		t.Errorf("expected commands %v, got %v", want, filter.Commands())
+	}
+	if filter[1].Op != ">=" || filter[1].number != 1e9 {
+		t.Errorf("unexpected condition: %+v", filter[1])
+	}
+
+	invalid := []string{
+		"",
+		"message",
+		"=tv",
+		"unknown=1",
+		"state~=1",
+		"name>a",
+		"size_bytes>big",
+		"size_bytes=>1",
+	}
+	for _, expr := range invalid {
+		_, err := ParseFilter([]string{expr})
+		if err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	torrent := Torrent{
+		Message:   "Tracker: [Failure reason \"Unregistered torrent\"]",
+		SizeBytes: 2e9,
+		Custom1:   "tv",
+		State:     0,
+	}
+
+	tests := []struct {
+		exprs []string
+		want  bool
+	}{
+		{nil, true},
+		{[]string{"message~=unregistered"}, true},
+		{[]string{"message~=unregistered", "custom1=tv"}, true},
+		{[]string{"message~=unregistered", "custom1=movies"}, false},
+		{[]string{"custom1!=tv"}, false},
+		{[]string{"size_bytes>1e9"}, true},
+		{[]string{"size_bytes<=1e9"}, false},
+		{[]string{"size_bytes=2000000000"}, true},
+		{[]string{"state=1"}, false},
+		{[]string{"state<1"}, true},
+	}
+
+	for _, tt := range tests {
+		filter, err := ParseFilter(tt.exprs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filter.Match(torrent); got != tt.want {
+			t.Errorf("%v: expected %v, got %v", tt.exprs, tt.want, got)
+		}
+	}
+}
+
+func TestSortTorrents(t *testing.T) {
+	torrents := []Torrent{
+		{Name: "b", State: 1, SizeBytes: 10},
+		{Name: "A", State: 0, SizeBytes: 10},
+		{Name: "c", State: 1, SizeBytes: 30},
+		{Name: "d", State: 0, SizeBytes: 20},
+	}
+
+	keys, err := ParseSort("-state,size_bytes,name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := []int{0, 1, 2, 3}
+	sortTorrents(torrents, order, keys)
+
+	names := ""
+	for _, i := range order {
+		names += torrents[i].Name
+	}
+	if names != "bcAd" {
+		t.Errorf("unexpected order %s", names)
+	}
+
+	for _, expr := range []string{"", "bogus", "name,", "--name"} {
+		_, err := ParseSort(expr)
+		if err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
@@ -6,3 +6,9 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/kolo/xmlrpc v0.0.0-20220921171641-a4b6fa1dd06b
 )
+
+require github.com/gorilla/websocket v1.5.0
+
+require golang.org/x/crypto v0.17.0
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -20,7 +25,10 @@ type Response struct {
 
 type SystemResponse struct {
 	Status string `json:"status"`
-	System System `json:"system"`
+	// CacheAge is the age of the cached result in milliseconds, zero when
+	// it was fetched for the request
+	CacheAge int64  `json:"cache_age_ms"`
+	System   System `json:"system"`
 }
 
 type MethodsResponse struct {
@@ -28,23 +36,64 @@ type MethodsResponse struct {
 	Methods []string `json:"methods"`
 }
 
+type LoadResponse struct {
+	Status  string    `json:"status"`
+	Torrent *Metainfo `json:"torrent"`
+}
+
 type ViewResponse struct {
-	Status   string    `json:"status"`
+	Status string `json:"status"`
+	// Total is the number of torrents in the view
+	Total int `json:"total"`
+	// Filtered is the number of torrents matching the filters before
+	// limit and offset are applied
+	Filtered int       `json:"filtered"`
+	CacheAge int64     `json:"cache_age_ms"`
 	Torrents []Torrent `json:"torrents"`
 }
 
-type FilesResponse struct {
+type FieldsViewResponse struct {
+	Status   string                   `json:"status"`
+	Total    int                      `json:"total"`
+	Filtered int                      `json:"filtered"`
+	CacheAge int64                    `json:"cache_age_ms"`
+	Torrents []map[string]interface{} `json:"torrents"`
+}
+
+type EraseResponse struct {
 	Status string `json:"status"`
-	Files  []File `json:"files"`
+	DataRemoval
+}
+
+type BulkRequest struct {
+	Action string   `json:"action"`
+	Hashes []string `json:"hashes"`
+	View   string   `json:"view"`
+	Filter []string `json:"filter"`
+}
+
+type BulkResponse struct {
+	Status    string         `json:"status"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Results   []ActionResult `json:"results"`
+}
+
+type FilesResponse struct {
+	Status   string `json:"status"`
+	CacheAge int64  `json:"cache_age_ms"`
+	Files    []File `json:"files"`
 }
 
 type PeersResponse struct {
-	Status string `json:"status"`
-	Peers  []Peer `json:"peers"`
+	Status   string `json:"status"`
+	CacheAge int64  `json:"cache_age_ms"`
+	Peers    []Peer `json:"peers"`
 }
 
 type TrackersResponse struct {
 	Status   string    `json:"status"`
+	CacheAge int64     `json:"cache_age_ms"`
 	Trackers []Tracker `json:"trackers"`
 }
 
@@ -66,13 +115,27 @@ func TemplateViewHandler(rt *Rtorrent) http.HandlerFunc {
 			"d.size_bytes=", "d.completed_bytes=", "d.up.rate=",
 			"d.up.total=", "d.down.rate=", "d.down.total=",
 			"d.message=", "d.is_active=", "d.is_open=",
-			"d.state=", "d.state_changed=", "d.state_counter="}
+			"d.state=", "d.state_changed=", "d.state_counter=",
+			"d.ratio=", "d.left_bytes=", "d.directory=",
+			"d.base_path=", "d.is_multi_file=", "d.chunk_size=",
+			"d.size_chunks=", "d.completed_chunks=",
+			"d.creation_date=", "d.custom=addtime", "d.timestamp.started=",
+			"d.timestamp.finished=", "d.is_private=", "d.throttle_name=",
+			"d.connection_current=", "d.views="}
+
+		principal := PrincipalFrom(r.Context())
+		if !authorizeView(w, r, "main") {
+			return
+		}
 
-		torrents, err := rt.DMulticall("main", args)
+		ctx, age := withCacheAge(r.Context())
+		torrents, err := rt.DMulticall(ctx, "main", principal.labelArgs(args))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		torrents, _ = principal.filterTorrents(torrents, nil)
+		setAge(w, age)
 
 		tpl := template.Must(template.ParseFiles("templates/torrents.html"))
 		tpl.Execute(w, torrents)
@@ -90,61 +153,8 @@ func HelloHandler(rt *Rtorrent) http.HandlerFunc {
 
 func SystemHandler(rt *Rtorrent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		args := []interface{}{
-			[]interface{}{
-				SystemCall{
-					MethodName: "system.hostname",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "system.pid",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "system.time_seconds",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "system.api_version",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "system.client_version",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "system.library_version",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "throttle.global_down.total",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "throttle.global_up.total",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "throttle.global_down.rate",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "throttle.global_up.rate",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "throttle.global_down.max_rate",
-					Params:     []string{""},
-				},
-				SystemCall{
-					MethodName: "throttle.global_up.max_rate",
-					Params:     []string{""},
-				},
-			},
-		}
-
-		result, err := rt.SystemMulticall(args)
+		ctx, age := withCacheAge(r.Context())
+		result, err := rt.SystemMulticall(ctx, systemArgs())
 		if err != nil {
 			respond(Response{
 				Status:  "error",
@@ -152,16 +162,74 @@ func SystemHandler(rt *Rtorrent) http.HandlerFunc {
 			}, http.StatusInternalServerError, w)
 			return
 		}
+		setAge(w, age)
 		respond(SystemResponse{
-			Status: "ok",
-			System: result,
+			Status:   "ok",
+			CacheAge: age.Milliseconds(),
+			System:   result,
 		}, http.StatusOK, w)
 	}
 }
 
+// Returns the system.multicall arguments for the fields of System
+func systemArgs() []interface{} {
+	return []interface{}{
+		[]interface{}{
+			SystemCall{
+				MethodName: "system.hostname",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "system.pid",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "system.time_seconds",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "system.api_version",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "system.client_version",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "system.library_version",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "throttle.global_down.total",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "throttle.global_up.total",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "throttle.global_down.rate",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "throttle.global_up.rate",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "throttle.global_down.max_rate",
+				Params:     []string{""},
+			},
+			SystemCall{
+				MethodName: "throttle.global_up.max_rate",
+				Params:     []string{""},
+			},
+		},
+	}
+}
+
 func MethodsHandler(rt *Rtorrent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		result, err := rt.ListMethods()
+		result, err := rt.ListMethods(r.Context())
 		if err != nil {
 			respond(Response{
 				Status:  "error",
@@ -180,7 +248,61 @@ func LoadHandler(rt *Rtorrent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		r.ParseMultipartForm(10 << 20)
 
-		file, _, err := r.FormFile("file")
+		options, err := loadOptions(r)
+		if err != nil {
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, http.StatusBadRequest, w)
+			return
+		}
+		if len(options.Commands) > 0 && !authorize(w, r, ScopeRaw) {
+			return
+		}
+
+		// principals restricted to labels load with one of them
+		principal := PrincipalFrom(r.Context())
+		if options.Label == "" && principal != nil && len(principal.Labels) == 1 {
+			options.Label = principal.Labels[0]
+		}
+		if !principal.CanLabel(options.Label) {
+			respond(Response{
+				Status:  "error",
+				Message: fmt.Sprintf("%s: label %q is not allowed", ErrForbidden, options.Label),
+			}, http.StatusForbidden, w)
+			return
+		}
+
+		// magnet or remote .torrent
+		if uri := r.FormValue("uri"); uri != "" {
+			if !loadableURI(uri) {
+				respond(Response{
+					Status:  "error",
+					Message: "uri must be a magnet link or a http(s) url",
+				}, http.StatusBadRequest, w)
+				return
+			}
+
+			err = rt.Load(r.Context(), uri, options)
+			hash, name := magnetTorrent(uri)
+			params := options.auditParams()
+			params["uri"] = uri
+			rt.auditorFor(r).record("load", hash, name, params, err)
+			if err != nil {
+				log.Printf("error in load handler: %s", err)
+				respond(Response{
+					Status:  "error",
+					Message: err.Error(),
+				}, http.StatusInternalServerError, w)
+				return
+			}
+			respond(Response{
+				Status: "ok",
+			}, http.StatusOK, w)
+			return
+		}
+
+		file, header, err := r.FormFile("file")
 		if err != nil {
 			log.Printf("error in load handler reading form: %s", err)
 			respond(Response{
@@ -202,7 +324,17 @@ func LoadHandler(rt *Rtorrent) http.HandlerFunc {
 			return
 		}
 
-		err = rt.LoadRawStart(buffer.Bytes())
+		meta, err := ParseMetainfo(buffer.Bytes())
+		if err != nil {
+			log.Printf("error in load handler parsing metainfo: %s", err)
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, http.StatusBadRequest, w)
+			return
+		}
+
+		loaded, err := rt.InView(r.Context(), "main", meta.InfoHash)
 		if err != nil {
 			log.Printf("error in load handler: %s", err)
 			respond(Response{
@@ -211,26 +343,102 @@ func LoadHandler(rt *Rtorrent) http.HandlerFunc {
 			}, http.StatusInternalServerError, w)
 			return
 		}
-		respond(Response{
-			Status: "ok",
+		if loaded {
+			respond(Response{
+				Status:  "error",
+				Message: fmt.Sprintf("torrent %s is already loaded", meta.InfoHash),
+			}, http.StatusConflict, w)
+			return
+		}
+
+		err = rt.LoadRaw(r.Context(), buffer.Bytes(), options)
+		params := options.auditParams()
+		params["file"] = header.Filename
+		rt.auditorFor(r).record("load", meta.InfoHash, meta.Name, params, err)
+		if err != nil {
+			log.Printf("error in load handler: %s", err)
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, http.StatusInternalServerError, w)
+			return
+		}
+		respond(LoadResponse{
+			Status:  "ok",
+			Torrent: meta,
 		}, http.StatusOK, w)
 	}
 }
 
+// Reads load options from the form fields paused, directory, label,
+// priority and the repeatable command
+func loadOptions(r *http.Request) (LoadOptions, error) {
+	options := LoadOptions{
+		Directory: r.FormValue("directory"),
+		Label:     r.FormValue("label"),
+		Commands:  r.Form["command"],
+	}
+
+	if v := r.FormValue("paused"); v != "" {
+		paused, err := strconv.ParseBool(v)
+		if err != nil {
+			return LoadOptions{}, fmt.Errorf("invalid paused value: %s", v)
+		}
+		options.Paused = paused
+	}
+
+	if v := r.FormValue("priority"); v != "" {
+		priority, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || priority < 0 || priority > 3 {
+			return LoadOptions{}, fmt.Errorf("invalid priority value: %s, must be 0-3", v)
+		}
+		options.Priority = &priority
+	}
+
+	for _, command := range options.Commands {
+		if !strings.HasPrefix(command, "d.") || strings.ContainsAny(command, "\r\n") {
+			return LoadOptions{}, fmt.Errorf("invalid command: %s, must be a d.* command", command)
+		}
+	}
+
+	return options, nil
+}
+
+// Reports whether rTorrent can load the uri itself
+func loadableURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "magnet":
+		return true
+	case "http", "https":
+		return u.Host != ""
+	}
+	return false
+}
+
 func ViewHandler(rt *Rtorrent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
+		principal := PrincipalFrom(r.Context())
+
+		if !authorizeView(w, r, vars["view"]) {
+			return
+		}
 
 		// default calls
-		args := []interface{}{"", vars["view"],
-			"d.hash=", "d.name=",
-			"d.size_bytes=", "d.completed_bytes=", "d.up.rate=",
-			"d.up.total=", "d.down.rate=", "d.down.total=",
-			"d.message=", "d.is_active=", "d.is_open=",
-			"d.is_hash_checking=", "d.peers_accounted=", "d.peers_complete=",
-			"d.state=", "d.state_changed=", "d.state_counter=", "d.priority=",
-			"d.custom1=", "d.custom2=", "d.custom3=",
-			"d.custom4=", "d.custom5="}
+		args := viewArgs(vars["view"])
+
+		query, err := parseViewQuery(r.URL.RawQuery)
+		if err != nil {
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, http.StatusBadRequest, w)
+			return
+		}
 
 		// custom call from query string
 		qs := r.URL.Query().Get("args")
@@ -239,27 +447,62 @@ func ViewHandler(rt *Rtorrent) http.HandlerFunc {
 			// split by comma
 			pieces := strings.Split(qs, ",")
 
-			// check that there are commands
-			if len(pieces) < 1 {
-				log.Printf("not enough pieces to make view handler request: %s", qs)
-				respond(Response{
-					Status:  "error",
-					Message: "not enough pieces in query string to make request",
-				}, http.StatusBadRequest, w)
-				return
-			}
-
 			// build view
 			args = []interface{}{"", vars["view"]}
 
-			// append pieces to args
+			// append pieces to args, any d.* command when a map is requested
 			for _, piece := range pieces {
-				args = append(args, fmt.Sprintf("%s=", piece))
+				if !query.asMap {
+					// parameterized commands such as d.custom=addtime
+					// already have their "="
+					if !strings.Contains(piece, "=") {
+						piece = fmt.Sprintf("%s=", piece)
+					}
+					args = append(args, piece)
+					continue
+				}
+
+				command, err := rt.FieldCommand(r.Context(), piece)
+				if err != nil {
+					log.Printf("error in view handler: %s", err)
+					respond(Response{
+						Status:  "error",
+						Message: err.Error(),
+					}, http.StatusBadRequest, w)
+					return
+				}
+				args = append(args, command)
+			}
+
+			// commands without a Torrent field could be anything
+			for _, arg := range args[2:] {
+				if !torrentCommands[arg.(string)] && !authorize(w, r, ScopeRaw) {
+					return
+				}
+			}
+
+			// the selection runs on every torrent, it must only read
+			for _, arg := range args[2:] {
+				_, err := checkField(strings.TrimSuffix(arg.(string), "="))
+				if err != nil {
+					log.Printf("error in view handler: %s", err)
+					respond(Response{
+						Status:  "error",
+						Message: err.Error(),
+					}, http.StatusBadRequest, w)
+					return
+				}
 			}
 		}
+		// commands past selected are only fetched to filter and sort
+		selected := len(args)
+		args = principal.labelArgs(args)
+
+		args = query.addCommands(args)
 
 		// do request
-		torrents, err := rt.DMulticall("main", args)
+		ctx, age := withCacheAge(r.Context())
+		torrents, fields, err := rt.DMulticallFields(ctx, "main", args)
 		if err != nil {
 			log.Printf("error in view handler: %s", err)
 			respond(Response{
@@ -269,21 +512,183 @@ func ViewHandler(rt *Rtorrent) http.HandlerFunc {
 			return
 		}
 
-		respond(ViewResponse{
+		torrents, fields = principal.filterTorrents(torrents, fields)
+		page, filtered := query.apply(torrents)
+		setAge(w, age)
+
+		if query.asMap {
+			response := FieldsViewResponse{
+				Status:   "ok",
+				Total:    len(torrents),
+				Filtered: filtered,
+				CacheAge: age.Milliseconds(),
+				Torrents: make([]map[string]interface{}, 0, len(page)),
+			}
+			for _, i := range page {
+				for _, arg := range args[selected:] {
+					delete(fields[i], strings.TrimSuffix(arg.(string), "="))
+				}
+				response.Torrents = append(response.Torrents, fields[i])
+			}
+			respond(response, http.StatusOK, w)
+			return
+		}
+
+		response := ViewResponse{
 			Status:   "ok",
-			Torrents: torrents,
-		}, http.StatusOK, w)
+			Total:    len(torrents),
+			Filtered: filtered,
+			CacheAge: age.Milliseconds(),
+			Torrents: make([]Torrent, 0, len(page)),
+		}
+		for _, i := range page {
+			response.Torrents = append(response.Torrents, torrents[i])
+		}
+		respond(response, http.StatusOK, w)
 	}
 }
 
+// viewQuery holds the filters, sort keys and pagination of a view request
+type viewQuery struct {
+	filter Filter
+	sort   []SortKey
+	limit  int
+	offset int
+	// asMap returns the selected fields keyed by command
+	asMap bool
+}
+
+// Parses the view query string. Parameters other than args, map, sort, limit
+// and offset are filter conditions such as "message~=unregistered" or
+// "size_bytes>1e9", which is why the raw query is split instead of parsed
+// into keys and values.
+func parseViewQuery(rawQuery string) (viewQuery, error) {
+	query := viewQuery{}
+	exprs := []string{}
+
+	for _, piece := range strings.Split(rawQuery, "&") {
+		if piece == "" {
+			continue
+		}
+		piece, err := url.QueryUnescape(piece)
+		if err != nil {
+			return viewQuery{}, fmt.Errorf("invalid query string: %s", err)
+		}
+
+		key, value, _ := strings.Cut(piece, "=")
+		switch key {
+		case "args":
+		case "sort":
+			query.sort, err = ParseSort(value)
+			if err != nil {
+				return viewQuery{}, err
+			}
+		case "limit":
+			query.limit, err = strconv.Atoi(value)
+			if err != nil || query.limit < 1 {
+				return viewQuery{}, fmt.Errorf("invalid limit: %s", value)
+			}
+		case "offset":
+			query.offset, err = strconv.Atoi(value)
+			if err != nil || query.offset < 0 {
+				return viewQuery{}, fmt.Errorf("invalid offset: %s", value)
+			}
+		case "map":
+			query.asMap, err = strconv.ParseBool(value)
+			if err != nil {
+				return viewQuery{}, fmt.Errorf("invalid map value: %s", value)
+			}
+		default:
+			exprs = append(exprs, piece)
+		}
+	}
+
+	filter, err := ParseFilter(exprs)
+	if err != nil {
+		return viewQuery{}, err
+	}
+	query.filter = filter
+	return query, nil
+}
+
+// Returns the d.multicall2 arguments of the default fields of view
+func viewArgs(view string) []interface{} {
+	return []interface{}{"", view,
+		"d.hash=", "d.name=",
+		"d.size_bytes=", "d.completed_bytes=", "d.up.rate=",
+		"d.up.total=", "d.down.rate=", "d.down.total=",
+		"d.message=", "d.is_active=", "d.is_open=",
+		"d.is_hash_checking=", "d.peers_accounted=", "d.peers_complete=",
+		"d.state=", "d.state_changed=", "d.state_counter=", "d.priority=",
+		"d.custom1=", "d.custom2=", "d.custom3=",
+		"d.custom4=", "d.custom5=",
+		"d.ratio=", "d.base_path=", "d.directory=",
+		"d.creation_date=", "d.custom=addtime", "d.timestamp.started=",
+		"d.timestamp.finished=", "d.is_multi_file=", "d.is_private=",
+		"d.chunk_size=", "d.size_chunks=", "d.completed_chunks=",
+		"d.left_bytes=", "d.throttle_name=", "d.connection_current=",
+		"d.views="}
+}
+
+// Returns args with the fields the filters and sort keys need but args
+// leaves out
+func (q viewQuery) addCommands(args []interface{}) []interface{} {
+	requested := map[string]bool{}
+	for _, arg := range args[2:] {
+		requested[arg.(string)] = true
+	}
+	for _, command := range append(q.filter.Commands(), sortCommands(q.sort)...) {
+		if !requested[command] {
+			requested[command] = true
+			args = append(args, command)
+		}
+	}
+	return args
+}
+
+// Returns the indexes of the torrents on the requested page in sorted order
+// and the number of torrents that matched the filters
+func (q viewQuery) apply(torrents []Torrent) ([]int, int) {
+	order := make([]int, 0, len(torrents))
+	for i, torrent := range torrents {
+		if q.filter.Match(torrent) {
+			order = append(order, i)
+		}
+	}
+
+	sortTorrents(torrents, order, q.sort)
+
+	start := q.offset
+	if start > len(order) {
+		start = len(order)
+	}
+	end := len(order)
+	if q.limit > 0 && start+q.limit < end {
+		end = start + q.limit
+	}
+	return order[start:end], len(order)
+}
+
 func TorrentHandler(rt *Rtorrent) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 
-		if vars["action"] == "stop" {
-			err := rt.Stop(vars["hash"])
+		// state changes
+		if action, ok := torrentActions[vars["action"]]; ok {
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, http.MethodPost)
+				return
+			}
+			if !authorize(w, r, ScopeControl) || !authorizeTorrentRequest(w, r, rt, vars["hash"]) {
+				return
+			}
+
+			audit := rt.auditorFor(r)
+			names := audit.names(r.Context(), vars["hash"])
+			err := action(rt, r.Context(), vars["hash"])
+			audit.record(vars["action"], vars["hash"], names[strings.ToUpper(vars["hash"])], nil, err)
 			if err != nil {
-				log.Printf("error in action stop handler: %s", err)
+				log.Printf("error in action %s handler: %s", vars["action"], err)
 				respond(Response{
 					Status:  "error",
 					Message: err.Error(),
@@ -296,29 +701,27 @@ func TorrentHandler(rt *Rtorrent) http.HandlerFunc {
 			return
 		}
 
-		if vars["action"] == "start" {
-			err := rt.Start(vars["hash"])
-			if err != nil {
-				log.Printf("error in action start handler: %s", err)
-				respond(Response{
-					Status:  "error",
-					Message: err.Error(),
-				}, http.StatusBadRequest, w)
+		switch vars["action"] {
+		case "files", "peers", "trackers":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			if !authorize(w, r, ScopeRead) || !authorizeTorrentRequest(w, r, rt, vars["hash"]) {
 				return
 			}
+		default:
 			respond(Response{
-				Status: "ok",
-			}, http.StatusOK, w)
+				Status:  "error",
+				Message: fmt.Sprintf("unknown action: %s", vars["action"]),
+			}, http.StatusNotFound, w)
 			return
 		}
 
-		if vars["action"] == "files" {
-			args := []interface{}{vars["hash"], "",
-				"f.path=", "f.size_bytes=", "f.size_chunks=",
-				"f.completed_chunks=", "f.frozen_path=", "f.priority=",
-				"f.is_created=", "f.is_open="}
+		ctx, age := withCacheAge(r.Context())
 
-			files, err := rt.FMulticall(args)
+		if vars["action"] == "files" {
+			files, err := rt.FMulticall(ctx, fileArgs(vars["hash"]))
 			if err != nil {
 				log.Printf("error in action files handler: %s", err)
 				respond(Response{
@@ -328,21 +731,17 @@ func TorrentHandler(rt *Rtorrent) http.HandlerFunc {
 				return
 			}
 
+			setAge(w, age)
 			respond(FilesResponse{
-				Status: "ok",
-				Files:  files,
+				Status:   "ok",
+				CacheAge: age.Milliseconds(),
+				Files:    files,
 			}, http.StatusOK, w)
 			return
 		}
 
 		if vars["action"] == "peers" {
-			args := []interface{}{vars["hash"], "",
-				"p.id=", "p.address=", "p.port=",
-				"p.banned=", "p.client_version=", "p.completed_percent=",
-				"p.is_encrypted=", "p.is_incoming=", "p.is_obfuscated=",
-				"p.peer_rate=", "p.peer_total=", "p.up_rate=", "p.up_total="}
-
-			peers, err := rt.PMulticall(args)
+			peers, err := rt.PMulticall(ctx, peerArgs(vars["hash"]))
 			if err != nil {
 				log.Printf("error in action peers handler: %s", err)
 				respond(Response{
@@ -352,23 +751,17 @@ func TorrentHandler(rt *Rtorrent) http.HandlerFunc {
 				return
 			}
 
+			setAge(w, age)
 			respond(PeersResponse{
-				Status: "ok",
-				Peers:  peers,
+				Status:   "ok",
+				CacheAge: age.Milliseconds(),
+				Peers:    peers,
 			}, http.StatusOK, w)
 			return
 		}
 
 		if vars["action"] == "trackers" {
-			args := []interface{}{vars["hash"], "",
-				"t.id=", "t.type=", "t.url=",
-				"t.activity_time_last=", "t.activity_time_next=", "t.can_scrape=",
-				"t.is_usable=", "t.is_enabled=", "t.failed_counter=",
-				"t.failed_time_last=", "t.failed_time_next=", "t.is_busy=",
-				"t.is_open=",
-			}
-
-			trackers, err := rt.TMulticall(args)
+			trackers, err := rt.TMulticall(ctx, trackerArgs(vars["hash"]))
 			if err != nil {
 				log.Printf("error in action trackers handler: %s", err)
 				respond(Response{
@@ -378,8 +771,10 @@ func TorrentHandler(rt *Rtorrent) http.HandlerFunc {
 				return
 			}
 
+			setAge(w, age)
 			respond(TrackersResponse{
 				Status:   "ok",
+				CacheAge: age.Milliseconds(),
 				Trackers: trackers,
 			}, http.StatusOK, w)
 			return
@@ -387,3 +782,341 @@ func TorrentHandler(rt *Rtorrent) http.HandlerFunc {
 
 	}
 }
+
+// Returns the f.multicall arguments for the files of a torrent
+func fileArgs(hash string) []interface{} {
+	return []interface{}{hash, "",
+		"f.path=", "f.size_bytes=", "f.size_chunks=",
+		"f.completed_chunks=", "f.frozen_path=", "f.priority=",
+		"f.is_created=", "f.is_open="}
+}
+
+// Returns the p.multicall arguments for the peers of a torrent
+func peerArgs(hash string) []interface{} {
+	return []interface{}{hash, "",
+		"p.id=", "p.address=", "p.port=",
+		"p.banned=", "p.client_version=", "p.completed_percent=",
+		"p.is_encrypted=", "p.is_incoming=", "p.is_obfuscated=",
+		"p.peer_rate=", "p.peer_total=", "p.up_rate=", "p.up_total="}
+}
+
+// Returns the t.multicall arguments for the trackers of a torrent
+func trackerArgs(hash string) []interface{} {
+	return []interface{}{hash, "",
+		"t.id=", "t.type=", "t.url=",
+		"t.activity_time_last=", "t.activity_time_next=", "t.can_scrape=",
+		"t.is_usable=", "t.is_enabled=", "t.failed_counter=",
+		"t.failed_time_last=", "t.failed_time_next=", "t.is_busy=",
+		"t.is_open=",
+	}
+}
+
+func EraseHandler(rt *Rtorrent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		withData := false
+		if qs := r.URL.Query().Get("with_data"); qs != "" {
+			var err error
+			withData, err = strconv.ParseBool(qs)
+			if err != nil {
+				respond(Response{
+					Status:  "error",
+					Message: fmt.Sprintf("invalid with_data value: %s", qs),
+				}, http.StatusBadRequest, w)
+				return
+			}
+		}
+
+		if !authorizeTorrentRequest(w, r, rt, vars["hash"]) {
+			return
+		}
+
+		audit := rt.auditorFor(r)
+		name := audit.names(r.Context(), vars["hash"])[strings.ToUpper(vars["hash"])]
+		params := map[string]interface{}{"with_data": withData}
+
+		if !withData {
+			err := rt.Erase(r.Context(), vars["hash"])
+			audit.record("erase", vars["hash"], name, params, err)
+			if err != nil {
+				log.Printf("error in erase handler: %s", err)
+				respond(Response{
+					Status:  "error",
+					Message: err.Error(),
+				}, http.StatusInternalServerError, w)
+				return
+			}
+			respond(Response{
+				Status: "ok",
+			}, http.StatusOK, w)
+			return
+		}
+
+		removal, err := rt.EraseWithData(r.Context(), vars["hash"])
+		audit.record("erase", vars["hash"], name, params, err)
+		if err != nil {
+			log.Printf("error in erase with data handler: %s", err)
+
+			statusCode := http.StatusInternalServerError
+			var outside *OutsideRootsError
+			switch {
+			case errors.Is(err, ErrTorrentNotFound):
+				statusCode = http.StatusNotFound
+			case errors.Is(err, ErrNoDownloadRoots), errors.As(err, &outside):
+				statusCode = http.StatusForbidden
+			}
+
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, statusCode, w)
+			return
+		}
+		respond(EraseResponse{
+			Status:      "ok",
+			DataRemoval: removal,
+		}, http.StatusOK, w)
+	}
+}
+
+func BulkHandler(rt *Rtorrent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request BulkRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 10<<20)).Decode(&request)
+		if err != nil {
+			respond(Response{
+				Status:  "error",
+				Message: fmt.Sprintf("invalid request body: %s", err),
+			}, http.StatusBadRequest, w)
+			return
+		}
+
+		command, ok := bulkCommands[request.Action]
+		if !ok {
+			respond(Response{
+				Status:  "error",
+				Message: fmt.Sprintf("unknown action: %s", request.Action),
+			}, http.StatusBadRequest, w)
+			return
+		}
+		scope := ScopeControl
+		if request.Action == "erase" {
+			scope = ScopeDelete
+		}
+		if !authorize(w, r, scope) {
+			return
+		}
+
+		bySelection := request.View != "" || len(request.Filter) > 0
+		if len(request.Hashes) > 0 == bySelection {
+			respond(Response{
+				Status:  "error",
+				Message: "either hashes or a view and filter are required",
+			}, http.StatusBadRequest, w)
+			return
+		}
+
+		hashes := request.Hashes
+		if bySelection {
+			filter, err := ParseFilter(request.Filter)
+			if err != nil {
+				respond(Response{
+					Status:  "error",
+					Message: err.Error(),
+				}, http.StatusBadRequest, w)
+				return
+			}
+
+			view := request.View
+			if view == "" {
+				view = "main"
+			}
+			if !authorizeView(w, r, view) {
+				return
+			}
+
+			hashes, err = rt.FilterHashes(r.Context(), view, filter)
+			if err != nil {
+				log.Printf("error in bulk handler: %s", err)
+				respond(Response{
+					Status:  "error",
+					Message: err.Error(),
+				}, http.StatusInternalServerError, w)
+				return
+			}
+		}
+
+		allowed, err := allowedHashes(r.Context(), rt, PrincipalFrom(r.Context()))
+		if err != nil {
+			log.Printf("error in bulk handler: %s", err)
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, http.StatusInternalServerError, w)
+			return
+		}
+
+		// torrents the principal may not act on fail without being sent
+		permitted := []string{}
+		refused := []ActionResult{}
+		for _, hash := range uniqueHashes(hashes) {
+			if allowed != nil && !allowed[strings.ToUpper(hash)] {
+				if !bySelection {
+					refused = append(refused, ActionResult{Hash: hash, Status: "error", Message: ErrForbidden.Error()})
+				}
+				continue
+			}
+			permitted = append(permitted, hash)
+		}
+		audit := rt.auditorFor(r)
+		names := audit.names(r.Context(), permitted...)
+		results := append(rt.Bulk(r.Context(), command, permitted), refused...)
+
+		var params map[string]interface{}
+		if bySelection {
+			params = map[string]interface{}{"view": request.View, "filter": request.Filter}
+		}
+		audit.recordResults(request.Action, names, params, results)
+
+		response := BulkResponse{
+			Status:  "ok",
+			Results: results,
+		}
+		for _, result := range results {
+			if result.Status == "ok" {
+				response.Succeeded++
+			} else {
+				response.Failed++
+			}
+		}
+		respond(response, http.StatusOK, w)
+	}
+}
+
+// eventHeartbeat is how often an idle event stream gets a comment so that
+// proxies keep it open
+const eventHeartbeat = 15 * time.Second
+
+func EventsHandler(rt *Rtorrent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		view := r.URL.Query().Get("view")
+		if view == "" {
+			view = "main"
+		}
+
+		hashes := []string{}
+		for _, hash := range r.URL.Query()["hash"] {
+			hashes = append(hashes, strings.ToUpper(hash))
+		}
+
+		// EventSource sends Last-Event-ID when it reconnects
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("last_event_id")
+		}
+		var lastID uint64
+		if lastEventID != "" {
+			var err error
+			lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+			if err != nil {
+				respond(Response{
+					Status:  "error",
+					Message: fmt.Sprintf("invalid last event id: %s", lastEventID),
+				}, http.StatusBadRequest, w)
+				return
+			}
+		}
+
+		if !authorizeView(w, r, view) {
+			return
+		}
+		gate := newEventGate(PrincipalFrom(r.Context()))
+
+		err := checkView(r.Context(), rt, view)
+		if err != nil {
+			log.Printf("error in events handler: %s", err)
+			respond(Response{
+				Status:  "error",
+				Message: err.Error(),
+			}, http.StatusBadRequest, w)
+			return
+		}
+
+		// the stream outlives the server's write timeout
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		sub, first := rt.events.Subscribe(view, hashes, lastEventID != "", lastID)
+		defer rt.events.Unsubscribe(sub)
+
+		for _, e := range first {
+			if gate.pass(e) {
+				writeEvent(w, e)
+			}
+		}
+		rc.Flush()
+
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-sub.Events:
+				if !ok {
+					return
+				}
+				if !gate.pass(e) {
+					continue
+				}
+				writeEvent(w, e)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			}
+			if rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// Checks that the view exists, so unknown views fail when subscribing
+// instead of on every poll
+func checkView(ctx context.Context, rt *Rtorrent, view string) error {
+	_, err := rt.DMulticall(ctx, view, []interface{}{"", view, "d.hash="})
+	return err
+}
+
+// Sets the Age header in whole seconds when the cached result served is at
+// least a second old
+func setAge(w http.ResponseWriter, age *CacheAge) {
+	if age.Milliseconds() >= 1000 {
+		w.Header().Set("Age", strconv.FormatInt(age.Milliseconds()/1000, 10))
+	}
+}
+
+// Writes an event in text/event-stream format
+func writeEvent(w io.Writer, e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("unable to marshal event: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
+
+// Responds with 405 and the allowed method
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	respond(Response{
+		Status:  "error",
+		Message: fmt.Sprintf("method not allowed, use %s", allowed),
+	}, http.StatusMethodNotAllowed, w)
+}
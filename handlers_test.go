@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
+)
+
+// Starts rtw in front of a fake rTorrent
+func newTestServer(t *testing.T) (*httptest.Server, *rtorrenttest.Server) {
+	t.Helper()
+
+	rtorrent, fake := newTestRtorrent(t)
+	srv := httptest.NewServer(newRouter(rtorrent, nil))
+	t.Cleanup(srv.Close)
+
+	return srv, fake
+}
+
+// Performs a request and decodes the JSON response into v
+func doJSON(t *testing.T, method, url string, body io.Reader, contentType string, v interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			t.Fatalf("unable to decode %s %s response: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHelloHandler(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	var resp Response
+	code := doJSON(t, "GET", srv.URL+"/api/hello", nil, "", &resp)
+	if code != http.StatusOK || resp.Status != "ok" {
+		t.Errorf("unexpected response %d: %+v", code, resp)
+	}
+}
+
+func TestSystemHandler(t *testing.T) {
+	srv, fake := newTestServer(t)
+	fake.SetSystem("throttle.global_up.rate", int64(2048))
+
+	var resp SystemResponse
+	code := doJSON(t, "GET", srv.URL+"/api/system", nil, "", &resp)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if resp.System.Hostname != "rtorrenttest" || resp.System.ThrottleGlobalUpRate != 2048 {
+		t.Errorf("unexpected system: %+v", resp.System)
+	}
+}
+
+func TestMethodsHandler(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	var resp MethodsResponse
+	code := doJSON(t, "GET", srv.URL+"/api/methods", nil, "", &resp)
+	if code != http.StatusOK || len(resp.Methods) == 0 {
+		t.Errorf("unexpected response %d: %+v", code, resp)
+	}
+}
+
+func TestLoadHandler(t *testing.T) {
+	srv, fake := newTestServer(t)
+
+	upload := func(data []byte, v interface{}) int {
+		body := bytes.NewBuffer(nil)
+		form := multipart.NewWriter(body)
+		part, err := form.CreateFormFile("file", "ubuntu.torrent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+		form.Close()
+
+		return doJSON(t, "POST", srv.URL+"/api/load", body, form.FormDataContentType(), v)
+	}
+
+	metainfo := rtorrenttest.NewMetainfo("ubuntu.iso", 4096)
+
+	var loaded LoadResponse
+	code := upload(metainfo, &loaded)
+	if code != http.StatusOK || loaded.Status != "ok" || loaded.Torrent == nil {
+		t.Fatalf("unexpected response %d: %+v", code, loaded)
+	}
+	hashes := fake.Hashes()
+	if len(hashes) != 1 {
+		t.Fatalf("expected torrent to be loaded")
+	}
+	if loaded.Torrent.InfoHash != hashes[0] || loaded.Torrent.Name != "ubuntu.iso" ||
+		loaded.Torrent.Size != 4096 || len(loaded.Torrent.Files) != 1 {
+		t.Errorf("unexpected torrent %+v, loaded %s", loaded.Torrent, hashes[0])
+	}
+
+	var resp Response
+	code = upload(metainfo, &resp)
+	if code != http.StatusConflict || resp.Status != "error" {
+		t.Errorf("expected conflict for duplicate torrent, got %d: %+v", code, resp)
+	}
+
+	code = upload([]byte("<html>not a torrent</html>"), &resp)
+	if code != http.StatusBadRequest || resp.Status != "error" {
+		t.Errorf("expected bad request for invalid torrent, got %d: %+v", code, resp)
+	}
+	if len(fake.Hashes()) != 1 {
+		t.Errorf("expected only the first torrent to be loaded, got %v", fake.Hashes())
+	}
+
+	code = doJSON(t, "POST", srv.URL+"/api/load", strings.NewReader(""), "text/plain", &resp)
+	if code != http.StatusBadRequest || resp.Status != "error" {
+		t.Errorf("expected bad request without file, got %d: %+v", code, resp)
+	}
+}
+
+func TestLoadHandlerURI(t *testing.T) {
+	srv, fake := newTestServer(t)
+
+	metainfo := rtorrenttest.NewMetainfo("remote.iso", 4096)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(metainfo)
+	}))
+	defer remote.Close()
+
+	form := url.Values{}
+	form.Set("uri", remote.URL+"/remote.torrent")
+	form.Set("paused", "true")
+	form.Set("label", "remote")
+
+	var resp Response
+	code := doJSON(t, "POST", srv.URL+"/api/load", strings.NewReader(form.Encode()), "application/x-www-form-urlencoded", &resp)
+	if code != http.StatusOK || resp.Status != "ok" {
+		t.Fatalf("unexpected response %d: %+v", code, resp)
+	}
+
+	hashes := fake.Hashes()
+	if len(hashes) != 1 {
+		t.Fatalf("expected remote torrent to be loaded, got %v", hashes)
+	}
+	torrent, _ := fake.Torrent(hashes[0])
+	if torrent.Fields["d.name"] != "remote.iso" || torrent.Fields["d.custom1"] != "remote" || torrent.Fields["d.state"] != int64(0) {
+		t.Errorf("unexpected loaded torrent: %v", torrent.Fields)
+	}
+
+	tests := []url.Values{
+		{"uri": {"file:///etc/passwd"}},
+		{"uri": {"magnet:?xt=urn:btih:abc"}, "priority": {"9"}},
+		{"uri": {"magnet:?xt=urn:btih:abc"}, "paused": {"sometimes"}},
+		{"uri": {"magnet:?xt=urn:btih:abc"}, "command": {"execute.throw=rm"}},
+	}
+	for _, tt := range tests {
+		code := doJSON(t, "POST", srv.URL+"/api/load", strings.NewReader(tt.Encode()), "application/x-www-form-urlencoded", &resp)
+		if code != http.StatusBadRequest || resp.Status != "error" {
+			t.Errorf("expected bad request for %v, got %d: %+v", tt, code, resp)
+		}
+	}
+}
+
+func TestViewHandler(t *testing.T) {
+	srv, fake := newTestServer(t)
+	addTestTorrent(fake, "abc", "ubuntu")
+	torrent := addTestTorrent(fake, "def", "debian")
+	torrent.Fields["d.message"] = "Tracker: [Failure reason \"Unregistered torrent\"]"
+
+	var resp ViewResponse
+	code := doJSON(t, "GET", srv.URL+"/api/view/main", nil, "", &resp)
+	if code != http.StatusOK || len(resp.Torrents) != 2 {
+		t.Fatalf("unexpected response %d: %+v", code, resp)
+	}
+	if resp.Torrents[1].Message == "" || resp.Torrents[1].Priority != 2 {
+		t.Errorf("unexpected torrent: %+v", resp.Torrents[1])
+	}
+	if resp.Torrents[0].ConnectionCurrent != "leech" || resp.Torrents[0].ChunkSize != 16384 || resp.Torrents[0].Views == nil {
+		t.Errorf("expected extended fields: %+v", resp.Torrents[0])
+	}
+
+	resp = ViewResponse{}
+	code = doJSON(t, "GET", srv.URL+"/api/view/main?args=d.hash,d.name", nil, "", &resp)
+	if code != http.StatusOK || len(resp.Torrents) != 2 {
+		t.Fatalf("unexpected response %d: %+v", code, resp)
+	}
+	if resp.Torrents[0].Name != "ubuntu" || resp.Torrents[0].SizeBytes != 0 {
+		t.Errorf("expected only requested fields: %+v", resp.Torrents[0])
+	}
+
+	var errResp Response
+	code = doJSON(t, "GET", srv.URL+"/api/view/main?args=d.nonexistent", nil, "", &errResp)
+	if code != http.StatusBadRequest || errResp.Status != "error" {
+		t.Errorf("expected error for unknown command, got %d: %+v", code, errResp)
+	}
+}
+
+func TestViewHandlerQuery(t *testing.T) {
+	srv, fake := newTestServer(t)
+	for i, name := range []string{"b", "a", "d", "c", "e"} {
+		torrent := addTestTorrent(fake, strings.ToUpper(name), name)
+		torrent.Fields["d.size_bytes"] = int64(i * 1000)
+		if name != "e" {
+			torrent.Fields["d.custom1"] = "tv"
+		}
+	}
+
+	names := func(torrents []Torrent) string {
+		list := []string{}
+		for _, torrent := range torrents {
+			list = append(list, torrent.Name)
+		}
+		return strings.Join(list, ",")
+	}
+
+	tests := []struct {
+		query    string
+		names    string
+		filtered int
+	}{
+		{"custom1=tv&sort=name", "a,b,c,d", 4},
+		{"custom1=tv&sort=-size_bytes&limit=2", "c,d", 4},
+		{"custom1=tv&sort=-size_bytes&limit=2&offset=2", "a,b", 4},
+		{"size_bytes%3E1e3&sort=name", "c,d,e", 3},
+		{"size_bytes>=1000&size_bytes<=3000&sort=size_bytes", "a,d,c", 3},
+		{"sort=name&offset=10", "", 5},
+		{"args=d.hash,d.name&custom1!=tv", "e", 1},
+	}
+
+	for _, tt := range tests {
+		var resp ViewResponse
+		code := doJSON(t, "GET", srv.URL+"/api/view/main?"+tt.query, nil, "", &resp)
+		if code != http.StatusOK {
+			t.Errorf("%s: unexpected status %d", tt.query, code)
+			continue
+		}
+		if got := names(resp.Torrents); got != tt.names || resp.Total != 5 || resp.Filtered != tt.filtered {
+			t.Errorf("%s: expected %q of %d, got %q total %d filtered %d", tt.query, tt.names, tt.filtered, got, resp.Total, resp.Filtered)
+		}
+	}
+
+	for _, query := range []string{"sort=bogus", "limit=0", "offset=-1", "state~=1", "nonsense"} {
+		var resp Response
+		code := doJSON(t, "GET", srv.URL+"/api/view/main?"+query, nil, "", &resp)
+		if code != http.StatusBadRequest || resp.Status != "error" {
+			t.Errorf("%s: expected bad request, got %d: %+v", query, code, resp)
+		}
+	}
+}
+
+func TestViewHandlerFields(t *testing.T) {
+	srv, fake := newTestServer(t)
+	torrent := addTestTorrent(fake, "A", "a")
+	torrent.Fields["d.custom=seedtime"] = "3600"
+	torrent.Fields["d.ratio"] = int64(1500)
+	torrent = addTestTorrent(fake, "B", "b")
+	torrent.Fields["d.custom=seedtime"] = ""
+	torrent.Fields["d.ratio"] = int64(200)
+
+	var resp FieldsViewResponse
+	code := doJSON(t, "GET", srv.URL+"/api/view/main?map=true&args=d.hash,d.ratio,d.custom=seedtime&seedtime=3600", nil, "", &resp)
+	if code == http.StatusOK {
+		t.Fatalf("expected seedtime filter to be rejected, it is not a Torrent field")
+	}
+
+	resp = FieldsViewResponse{}
+	code = doJSON(t, "GET", srv.URL+"/api/view/main?map=true&args=d.hash,d.ratio,d.custom=seedtime&name=a", nil, "", &resp)
+	if code != http.StatusOK || len(resp.Torrents) != 1 || resp.Total != 2 || resp.Filtered != 1 {
+		t.Fatalf("unexpected response %d: %+v", code, resp)
+	}
+	row := resp.Torrents[0]
+	if _, ok := row["d.name"]; ok || row["d.hash"] != "A" || row["d.ratio"] != float64(1500) || row["d.custom=seedtime"] != "3600" {
+		t.Errorf("unexpected row: %v", row)
+	}
+
+	for _, args := range []string{"d.nonexistent", "system.hostname", "d.custom=$execute.throw=rm"} {
+		var errResp Response
+		code := doJSON(t, "GET", srv.URL+"/api/view/main?map=true&args="+url.QueryEscape(args), nil, "", &errResp)
+		if code != http.StatusBadRequest || errResp.Status != "error" {
+			t.Errorf("%s: expected bad request, got %d: %+v", args, code, errResp)
+		}
+	}
+
+	calls := len(fake.Calls())
+	for _, query := range []string{"args=d.erase", "args=d.custom.set", "args=d.name,d.erase", "map=true&args=d.erase", "map=true&args=d.custom.set=x"} {
+		var errResp Response
+		code := doJSON(t, "GET", srv.URL+"/api/view/main?"+query, nil, "", &errResp)
+		if code != http.StatusBadRequest || errResp.Status != "error" {
+			t.Errorf("%s: expected bad request, got %d: %+v", query, code, errResp)
+		}
+	}
+	for _, call := range fake.Calls()[calls:] {
+		if call == "d.multicall2" || call == "d.erase" {
+			t.Errorf("expected mutators not to reach rTorrent, got a %s call", call)
+		}
+	}
+	if _, ok := fake.Torrent("A"); !ok {
+		t.Error("expected the torrent to be kept")
+	}
+}
+
+func TestTorrentHandler(t *testing.T) {
+	srv, fake := newTestServer(t)
+	torrent := addTestTorrent(fake, "abc", "ubuntu")
+
+	tests := []struct {
+		action string
+		field  string
+		want   int64
+	}{
+		{"start", "d.state", 1},
+		{"pause", "d.is_active", 0},
+		{"resume", "d.is_active", 1},
+		{"stop", "d.state", 0},
+		{"close", "d.is_open", 0},
+		{"open", "d.is_open", 1},
+		{"check_hash", "d.is_hash_checking", 1},
+	}
+
+	for _, tt := range tests {
+		var resp Response
+		code := doJSON(t, "POST", srv.URL+"/api/torrent/ABC/"+tt.action, nil, "", &resp)
+		if code != http.StatusOK || resp.Status != "ok" {
+			t.Errorf("unexpected %s response %d: %+v", tt.action, code, resp)
+		}
+		if torrent.Fields[tt.field] != tt.want {
+			t.Errorf("expected %s to set %s to %d, got %v", tt.action, tt.field, tt.want, torrent.Fields[tt.field])
+		}
+	}
+
+	var resp Response
+	code := doJSON(t, "POST", srv.URL+"/api/torrent/missing/stop", nil, "", &resp)
+	if code != http.StatusInternalServerError || resp.Status != "error" {
+		t.Errorf("expected error for unknown hash, got %d: %+v", code, resp)
+	}
+
+	code = doJSON(t, "GET", srv.URL+"/api/torrent/ABC/start", nil, "", &resp)
+	if code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET start to be rejected, got %d", code)
+	}
+
+	code = doJSON(t, "POST", srv.URL+"/api/torrent/ABC/files", nil, "", &resp)
+	if code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST files to be rejected, got %d", code)
+	}
+
+	code = doJSON(t, "POST", srv.URL+"/api/torrent/ABC/explode", nil, "", &resp)
+	if code != http.StatusNotFound || resp.Status != "error" {
+		t.Errorf("expected unknown action to be 404, got %d: %+v", code, resp)
+	}
+
+	var files FilesResponse
+	code = doJSON(t, "GET", srv.URL+"/api/torrent/ABC/files", nil, "", &files)
+	if code != http.StatusOK || len(files.Files) != 1 || files.Files[0].Path != "ubuntu.mkv" {
+		t.Errorf("unexpected files response %d: %+v", code, files)
+	}
+
+	var peers PeersResponse
+	code = doJSON(t, "GET", srv.URL+"/api/torrent/ABC/peers", nil, "", &peers)
+	if code != http.StatusOK || len(peers.Peers) != 1 || peers.Peers[0].ClientVersion != "Transmission 4.0.0" {
+		t.Errorf("unexpected peers response %d: %+v", code, peers)
+	}
+
+	var trackers TrackersResponse
+	code = doJSON(t, "GET", srv.URL+"/api/torrent/ABC/trackers", nil, "", &trackers)
+	if code != http.StatusOK || len(trackers.Trackers) != 1 || trackers.Trackers[0].IsEnabled != 1 {
+		t.Errorf("unexpected trackers response %d: %+v", code, trackers)
+	}
+}
+
+func TestBulkHandler(t *testing.T) {
+	srv, fake := newTestServer(t)
+	addTestTorrent(fake, "A", "a").Fields["d.message"] = "Unregistered torrent"
+	addTestTorrent(fake, "B", "b").Fields["d.message"] = "unregistered torrent"
+	addTestTorrent(fake, "C", "c")
+
+	var resp BulkResponse
+	body := `{"action": "erase", "filter": ["message~=unregistered"]}`
+	code := doJSON(t, "POST", srv.URL+"/api/torrents/actions", strings.NewReader(body), "application/json", &resp)
+	if code != http.StatusOK || resp.Succeeded != 2 || resp.Failed != 0 || len(resp.Results) != 2 {
+		t.Fatalf("unexpected response %d: %+v", code, resp)
+	}
+	if hashes := fake.Hashes(); len(hashes) != 1 || hashes[0] != "C" {
+		t.Errorf("expected only C to be left, got %v", hashes)
+	}
+
+	body = `{"action": "stop", "hashes": ["C", "MISSING", "c"]}`
+	code = doJSON(t, "POST", srv.URL+"/api/torrents/actions", strings.NewReader(body), "application/json", &resp)
+	if code != http.StatusOK || resp.Succeeded != 1 || resp.Failed != 1 || len(resp.Results) != 2 {
+		t.Fatalf("unexpected response %d: %+v", code, resp)
+	}
+	if resp.Results[1].Hash != "MISSING" || resp.Results[1].Status != "error" {
+		t.Errorf("expected missing torrent to fail, got %+v", resp.Results[1])
+	}
+
+	tests := []string{
+		`not json`,
+		`{"action": "explode", "hashes": ["C"]}`,
+		`{"action": "stop"}`,
+		`{"action": "stop", "hashes": ["C"], "filter": ["state=1"]}`,
+		`{"action": "stop", "filter": ["bogus=1"]}`,
+	}
+	for _, tt := range tests {
+		var resp Response
+		code := doJSON(t, "POST", srv.URL+"/api/torrents/actions", strings.NewReader(tt), "application/json", &resp)
+		if code != http.StatusBadRequest || resp.Status != "error" {
+			t.Errorf("expected bad request for %s, got %d: %+v", tt, code, resp)
+		}
+	}
+}
+
+func TestEraseHandler(t *testing.T) {
+	srv, fake := newTestServer(t)
+	addTestTorrent(fake, "abc", "ubuntu")
+
+	var resp Response
+	code := doJSON(t, "DELETE", srv.URL+"/api/torrent/ABC", nil, "", &resp)
+	if code != http.StatusOK || resp.Status != "ok" {
+		t.Fatalf("unexpected erase response %d: %+v", code, resp)
+	}
+	if len(fake.Hashes()) != 0 {
+		t.Errorf("expected torrent to be erased")
+	}
+
+	code = doJSON(t, "DELETE", srv.URL+"/api/torrent/ABC", nil, "", &resp)
+	if code != http.StatusInternalServerError || resp.Status != "error" {
+		t.Errorf("expected error erasing unknown hash, got %d: %+v", code, resp)
+	}
+}
+
+func TestTemplateViewHandler(t *testing.T) {
+	srv, fake := newTestServer(t)
+	torrent := addTestTorrent(fake, "abc", "ubuntu")
+	torrent.Fields["d.views"] = []interface{}{"main", "seeding"}
+	torrent.Fields["d.base_path"] = "/downloads/ubuntu.iso"
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "ubuntu") || !strings.Contains(string(body), "main, seeding") ||
+		!strings.Contains(string(body), "<td>/downloads/ubuntu.iso</td>") || !strings.Contains(string(body), "<td>16384</td>") {
+		t.Errorf("unexpected index response %d: %s", resp.StatusCode, body)
+	}
+}
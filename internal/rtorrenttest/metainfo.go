@@ -0,0 +1,234 @@
+package rtorrenttest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Builds a single file v1 .torrent with the name and length, pieces are
+// zeroed so the content is not verifiable but the info hash is stable
+func NewMetainfo(name string, length int64) []byte {
+	pieces := (length + 16383) / 16384
+	if pieces < 1 {
+		pieces = 1
+	}
+	return encodeBencode(map[string]interface{}{
+		"announce": "http://tracker.invalid/announce",
+		"info": map[string]interface{}{
+			"name":         name,
+			"length":       length,
+			"piece length": int64(16384),
+			"pieces":       strings.Repeat("\x00", int(pieces)*sha1.Size),
+		},
+	})
+}
+
+// Creates a torrent from a bencoded .torrent, the hash is the sha1 of the
+// raw info dictionary
+func torrentFromMetainfo(data []byte) (*Torrent, error) {
+	value, rest, err := decodeBencode(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after metainfo")
+	}
+	dict, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metainfo is not a dictionary")
+	}
+	info, ok := dict["info"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metainfo has no info dictionary")
+	}
+
+	hash := sha1.Sum(encodeBencode(info))
+	name, _ := info["name"].(string)
+
+	size, _ := info["length"].(int64)
+	files := []Item{}
+	if list, ok := info["files"].([]interface{}); ok {
+		for _, f := range list {
+			file, _ := f.(map[string]interface{})
+			length, _ := file["length"].(int64)
+			parts := []string{}
+			path, _ := file["path"].([]interface{})
+			for _, p := range path {
+				part, _ := p.(string)
+				parts = append(parts, part)
+			}
+			size += length
+			files = append(files, newFile(strings.Join(parts, "/"), length))
+		}
+	} else {
+		files = append(files, newFile(name, size))
+	}
+
+	t := NewTorrent(fmt.Sprintf("%X", hash), name)
+	t.Fields["d.size_bytes"] = size
+	if _, ok := info["files"]; ok {
+		t.Fields["d.is_multi_file"] = int64(1)
+	}
+	t.Files = files
+	return t, nil
+}
+
+// Creates a torrent from a magnet link, or by fetching a http(s) URL of a
+// .torrent file
+func torrentFromURI(uri string) (*Torrent, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "magnet":
+		xt := u.Query().Get("xt")
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok || hash == "" {
+			return nil, fmt.Errorf("magnet link has no btih: %s", uri)
+		}
+		name := u.Query().Get("dn")
+		if name == "" {
+			name = strings.ToUpper(hash) + ".meta"
+		}
+		return NewTorrent(hash, name), nil
+	case "http", "https":
+		resp, err := http.Get(uri)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", uri, resp.Status)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return torrentFromMetainfo(data)
+	}
+	return nil, fmt.Errorf("unsupported uri: %s", uri)
+}
+
+func newFile(path string, size int64) Item {
+	return Item{
+		"f.path":             path,
+		"f.size_bytes":       size,
+		"f.size_chunks":      int64(0),
+		"f.completed_chunks": int64(0),
+		"f.frozen_path":      "",
+		"f.priority":         int64(1),
+		"f.is_created":       int64(0),
+		"f.is_open":          int64(0),
+	}
+}
+
+// Decodes one bencoded value from the start of data and returns the rest.
+// Strings decode to string, integers to int64.
+func decodeBencode(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errors.New("unexpected end of data")
+	}
+
+	switch {
+	case data[0] == 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 0 {
+			return nil, nil, errors.New("unterminated integer")
+		}
+		n, err := strconv.ParseInt(string(data[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		return n, data[end+1:], nil
+	case data[0] == 'l':
+		list := []interface{}{}
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			value, rest, err := decodeBencode(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, value)
+			data = rest
+		}
+		if len(data) == 0 {
+			return nil, nil, errors.New("unterminated list")
+		}
+		return list, data[1:], nil
+	case data[0] == 'd':
+		dict := map[string]interface{}{}
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			key, rest, err := decodeBencode(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, nil, errors.New("dictionary key is not a string")
+			}
+			value, rest, err := decodeBencode(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			dict[k] = value
+			data = rest
+		}
+		if len(data) == 0 {
+			return nil, nil, errors.New("unterminated dictionary")
+		}
+		return dict, data[1:], nil
+	case data[0] >= '0' && data[0] <= '9':
+		colon := bytes.IndexByte(data, ':')
+		if colon < 0 {
+			return nil, nil, errors.New("unterminated string length")
+		}
+		n, err := strconv.Atoi(string(data[:colon]))
+		if err != nil || n < 0 || colon+1+n > len(data) {
+			return nil, nil, errors.New("invalid string length")
+		}
+		return string(data[colon+1 : colon+1+n]), data[colon+1+n:], nil
+	}
+	return nil, nil, fmt.Errorf("invalid bencode type %q", data[0])
+}
+
+// Encodes a value produced by decodeBencode, dictionary keys are sorted
+func encodeBencode(value interface{}) []byte {
+	buffer := bytes.NewBuffer(nil)
+	switch v := value.(type) {
+	case int64:
+		fmt.Fprintf(buffer, "i%de", v)
+	case string:
+		fmt.Fprintf(buffer, "%d:%s", len(v), v)
+	case []interface{}:
+		buffer.WriteByte('l')
+		for _, item := range v {
+			buffer.Write(encodeBencode(item))
+		}
+		buffer.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buffer.WriteByte('d')
+		for _, key := range keys {
+			buffer.Write(encodeBencode(key))
+			buffer.Write(encodeBencode(v[key]))
+		}
+		buffer.WriteByte('e')
+	}
+	return buffer.Bytes()
+}
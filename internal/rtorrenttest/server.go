@@ -0,0 +1,667 @@
+// Package rtorrenttest provides an in-process fake rTorrent XML-RPC server
+// backed by an in-memory torrent model, for hermetic tests of rtw.
+package rtorrenttest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Item holds the value of each command for a torrent, file, peer or tracker,
+// keyed by the command name without the trailing "=" (e.g. "d.name",
+// "f.path" or "d.custom=addtime")
+type Item map[string]interface{}
+
+// Torrent is a torrent in the fake's model
+type Torrent struct {
+	Fields   Item
+	Views    []string
+	Files    []Item
+	Peers    []Item
+	Trackers []Item
+}
+
+// Method implements an XML-RPC method, returning a Fault as error makes the
+// server respond with that fault
+type Method func(params []interface{}) (interface{}, error)
+
+// Server is a fake rTorrent speaking XML-RPC over HTTP
+type Server struct {
+	// URL of the XML-RPC endpoint
+	URL string
+
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	torrents []*Torrent
+	system   Item
+	methods  map[string]Method
+	calls    []string
+}
+
+// Creates and starts a fake rTorrent, call Close when done
+func NewServer() *Server {
+	s := &Server{
+		system: Item{
+			"system.hostname":               "rtorrenttest",
+			"system.pid":                    int64(1),
+			"system.time_seconds":           int64(1700000000),
+			"system.api_version":            "10",
+			"system.client_version":         "0.9.8",
+			"system.library_version":        "0.13.8",
+			"throttle.global_down.total":    int64(0),
+			"throttle.global_up.total":      int64(0),
+			"throttle.global_down.rate":     int64(0),
+			"throttle.global_up.rate":       int64(0),
+			"throttle.global_down.max_rate": int64(0),
+			"throttle.global_up.max_rate":   int64(0),
+		},
+	}
+
+	s.methods = map[string]Method{
+		"system.listMethods":     s.listMethods,
+		"system.multicall":       s.systemMulticall,
+		"d.multicall2":           s.dMulticall,
+		"f.multicall":            s.itemMulticall(func(t *Torrent) []Item { return t.Files }),
+		"p.multicall":            s.itemMulticall(func(t *Torrent) []Item { return t.Peers }),
+		"t.multicall":            s.itemMulticall(func(t *Torrent) []Item { return t.Trackers }),
+		"load.normal":            s.loadURI(false),
+		"load.verbose":           s.loadURI(false),
+		"load.start":             s.loadURI(true),
+		"load.start_verbose":     s.loadURI(true),
+		"load.raw":               s.loadRaw(false),
+		"load.raw_verbose":       s.loadRaw(false),
+		"load.raw_start":         s.loadRaw(true),
+		"load.raw_start_verbose": s.loadRaw(true),
+		"d.start":                s.setState(1),
+		"d.stop":                 s.setState(0),
+		"d.pause":                s.update(Item{"d.is_active": int64(0)}),
+		"d.resume":               s.update(Item{"d.is_active": int64(1)}),
+		"d.open":                 s.update(Item{"d.is_open": int64(1)}),
+		"d.close":                s.update(Item{"d.is_open": int64(0), "d.is_active": int64(0), "d.state": int64(0)}),
+		"d.check_hash":           s.update(Item{"d.is_hash_checking": int64(1)}),
+		"d.erase":                s.erase,
+		"d.priority.set":         s.set("d.priority"),
+	}
+
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL + "/RPC2"
+	return s
+}
+
+// Shuts down the server
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Creates a torrent with every field rtw requests by default set to its zero
+// value, the hash is upper cased like rTorrent does
+func NewTorrent(hash, name string) *Torrent {
+	return &Torrent{
+		Fields: Item{
+			"d.hash":               strings.ToUpper(hash),
+			"d.name":               name,
+			"d.size_bytes":         int64(0),
+			"d.completed_bytes":    int64(0),
+			"d.up.rate":            int64(0),
+			"d.up.total":           int64(0),
+			"d.down.rate":          int64(0),
+			"d.down.total":         int64(0),
+			"d.message":            "",
+			"d.is_active":          int64(0),
+			"d.is_open":            int64(0),
+			"d.is_hash_checking":   int64(0),
+			"d.peers_accounted":    int64(0),
+			"d.peers_complete":     int64(0),
+			"d.state":              int64(0),
+			"d.state_changed":      int64(0),
+			"d.state_counter":      int64(0),
+			"d.priority":           int64(2),
+			"d.custom1":            "",
+			"d.custom2":            "",
+			"d.custom3":            "",
+			"d.custom4":            "",
+			"d.custom5":            "",
+			"d.base_path":          "",
+			"d.directory":          "",
+			"d.is_multi_file":      int64(0),
+			"d.ratio":              int64(0),
+			"d.creation_date":      int64(0),
+			"d.custom=addtime":     "",
+			"d.timestamp.started":  int64(0),
+			"d.timestamp.finished": int64(0),
+			"d.is_private":         int64(0),
+			"d.chunk_size":         int64(16384),
+			"d.size_chunks":        int64(0),
+			"d.completed_chunks":   int64(0),
+			"d.left_bytes":         int64(0),
+			"d.throttle_name":      "",
+			"d.connection_current": "leech",
+			"d.views":              []interface{}{},
+		},
+	}
+}
+
+// Adds torrents to the model
+func (s *Server) Add(torrents ...*Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents = append(s.torrents, torrents...)
+}
+
+// Sets fields of the torrent with the hash while the server may be serving
+// calls, reports whether the torrent exists
+func (s *Server) Update(hash string, fields Item) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.find(hash)
+	if t == nil {
+		return false
+	}
+	for name, value := range fields {
+		t.Fields[name] = value
+	}
+	return true
+}
+
+// Returns the torrent with the hash
+func (s *Server) Torrent(hash string) (*Torrent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.find(hash)
+	return t, t != nil
+}
+
+// Returns the hashes of all torrents in the model in load order
+func (s *Server) Hashes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make([]string, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		hashes = append(hashes, t.Fields["d.hash"].(string))
+	}
+	return hashes
+}
+
+// Sets the value returned by a system.* or throttle.* command
+func (s *Server) SetSystem(method string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.system[method] = value
+}
+
+// Registers or replaces the implementation of a method
+func (s *Server) Handle(method string, fn Method) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[method] = fn
+}
+
+// Returns the names of the methods called so far, system.multicall entries
+// are recorded individually after the multicall itself
+func (s *Server) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	method, params, err := decodeCall(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.call(method, params)
+
+	buffer := bytes.NewBuffer(nil)
+	if fault, ok := err.(Fault); ok {
+		err = encodeFault(buffer, fault)
+	} else if err != nil {
+		err = encodeFault(buffer, Fault{Code: -500, Message: err.Error()})
+	} else {
+		err = encodeResponse(buffer, result)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buffer.Bytes())
+}
+
+// Dispatches a single call, methods run without the lock held so custom
+// handlers may use the exported accessors
+func (s *Server) call(method string, params []interface{}) (interface{}, error) {
+	s.mu.Lock()
+	s.calls = append(s.calls, method)
+	fn, ok := s.methods[method]
+	s.mu.Unlock()
+
+	if ok {
+		return fn(params)
+	}
+	return s.command(method, params)
+}
+
+// Answers plain getters such as d.name or throttle.global_up.rate from the
+// model
+func (s *Server) command(method string, params []interface{}) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value, ok := s.system[method]; ok {
+		return value, nil
+	}
+
+	if strings.HasPrefix(method, "d.") {
+		t, err := s.target(params)
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := t.Fields[method]; ok {
+			return value, nil
+		}
+	}
+
+	return nil, notDefined(method)
+}
+
+func (s *Server) listMethods(params []interface{}) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+	for name := range s.methods {
+		seen[name] = true
+	}
+	for name := range s.system {
+		seen[name] = true
+	}
+	for _, item := range append([]Item{NewTorrent("", "").Fields}, s.items()...) {
+		for name := range item {
+			// parameterized commands like d.custom=key are listed by name
+			name, _, _ = strings.Cut(name, "=")
+			seen[name] = true
+		}
+	}
+
+	methods := make([]string, 0, len(seen))
+	for name := range seen {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	return methods, nil
+}
+
+// Returns the fields of every torrent, file, peer and tracker in the model
+func (s *Server) items() []Item {
+	items := []Item{}
+	for _, t := range s.torrents {
+		items = append(items, t.Fields)
+		items = append(items, t.Files...)
+		items = append(items, t.Peers...)
+		items = append(items, t.Trackers...)
+	}
+	return items
+}
+
+func (s *Server) systemMulticall(params []interface{}) (interface{}, error) {
+	if len(params) != 1 {
+		return nil, Fault{Code: -500, Message: "system.multicall expects one array parameter"}
+	}
+	calls, ok := params[0].([]interface{})
+	if !ok {
+		return nil, Fault{Code: -500, Message: "system.multicall expects an array"}
+	}
+
+	results := make([]interface{}, 0, len(calls))
+	for _, c := range calls {
+		call, ok := c.(map[string]interface{})
+		if !ok {
+			results = append(results, faultStruct(Fault{Code: -500, Message: "invalid call"}))
+			continue
+		}
+
+		method, _ := call["methodName"].(string)
+		args, _ := call["params"].([]interface{})
+
+		result, err := s.call(method, args)
+		if fault, ok := err.(Fault); ok {
+			results = append(results, faultStruct(fault))
+			continue
+		}
+		if err != nil {
+			results = append(results, faultStruct(Fault{Code: -500, Message: err.Error()}))
+			continue
+		}
+		results = append(results, []interface{}{result})
+	}
+	return results, nil
+}
+
+func (s *Server) dMulticall(params []interface{}) (interface{}, error) {
+	if len(params) < 2 {
+		return nil, Fault{Code: -500, Message: "d.multicall2 expects a target and a view"}
+	}
+	view, ok := params[1].(string)
+	if !ok {
+		return nil, Fault{Code: -500, Message: "view must be a string"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !isView(view) && !s.customView(view) {
+		return nil, Fault{Code: -500, Message: "Could not find view: " + view}
+	}
+
+	rows := []interface{}{}
+	for _, t := range s.torrents {
+		if !inView(t, view) {
+			continue
+		}
+		row, err := commands(t.Fields, params[2:])
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (s *Server) itemMulticall(items func(*Torrent) []Item) Method {
+	return func(params []interface{}) (interface{}, error) {
+		if len(params) < 2 {
+			return nil, Fault{Code: -500, Message: "multicall expects a hash and a pattern"}
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		t, err := s.target(params)
+		if err != nil {
+			return nil, err
+		}
+
+		rows := []interface{}{}
+		for _, item := range items(t) {
+			row, err := commands(item, params[2:])
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+}
+
+func (s *Server) setState(state int64) Method {
+	return func(params []interface{}) (interface{}, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		t, err := s.target(params)
+		if err != nil {
+			return nil, err
+		}
+		t.Fields["d.state"] = state
+		t.Fields["d.is_active"] = state
+		t.Fields["d.is_open"] = int64(1)
+		return int64(0), nil
+	}
+}
+
+// Returns a method that sets fields on the target torrent
+func (s *Server) update(fields Item) Method {
+	return func(params []interface{}) (interface{}, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		t, err := s.target(params)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fields {
+			t.Fields[name] = value
+		}
+		return int64(0), nil
+	}
+}
+
+// Returns a method that sets a field of the target torrent to its second
+// parameter
+func (s *Server) set(field string) Method {
+	return func(params []interface{}) (interface{}, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		t, err := s.target(params)
+		if err != nil {
+			return nil, err
+		}
+		if len(params) != 2 {
+			return nil, Fault{Code: -500, Message: field + ".set expects a target and a value"}
+		}
+		t.Fields[field] = params[1]
+		return int64(0), nil
+	}
+}
+
+func (s *Server) erase(params []interface{}) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.target(params)
+	if err != nil {
+		return nil, err
+	}
+	for i := range s.torrents {
+		if s.torrents[i] == t {
+			s.torrents = append(s.torrents[:i], s.torrents[i+1:]...)
+			break
+		}
+	}
+	return int64(0), nil
+}
+
+func (s *Server) loadRaw(start bool) Method {
+	return func(params []interface{}) (interface{}, error) {
+		if len(params) < 2 {
+			return nil, Fault{Code: -500, Message: "load expects a target and data"}
+		}
+		data, ok := params[1].([]byte)
+		if !ok {
+			return nil, Fault{Code: -500, Message: "load expects base64 data"}
+		}
+
+		t, err := torrentFromMetainfo(data)
+		if err != nil {
+			return nil, Fault{Code: -503, Message: "Could not create download: " + err.Error()}
+		}
+		return s.load(t, start, params[2:])
+	}
+}
+
+// Loads magnet links and http(s) URLs of .torrent files
+func (s *Server) loadURI(start bool) Method {
+	return func(params []interface{}) (interface{}, error) {
+		if len(params) < 2 {
+			return nil, Fault{Code: -500, Message: "load expects a target and an uri"}
+		}
+		uri, ok := params[1].(string)
+		if !ok {
+			return nil, Fault{Code: -500, Message: "load expects an uri"}
+		}
+
+		t, err := torrentFromURI(uri)
+		if err != nil {
+			return nil, Fault{Code: -503, Message: "Could not create download: " + err.Error()}
+		}
+		return s.load(t, start, params[2:])
+	}
+}
+
+// Adds a loaded torrent and applies the post-load commands to it, loading a
+// torrent that is already in the model does nothing
+func (s *Server) load(t *Torrent, start bool, commands []interface{}) (interface{}, error) {
+	if start {
+		t.Fields["d.state"] = int64(1)
+		t.Fields["d.is_active"] = int64(1)
+		t.Fields["d.is_open"] = int64(1)
+	}
+	for _, c := range commands {
+		command, ok := c.(string)
+		if !ok {
+			return nil, Fault{Code: -500, Message: fmt.Sprintf("invalid command %v", c)}
+		}
+		applyCommand(t, command)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(t.Fields["d.hash"].(string)) == nil {
+		s.torrents = append(s.torrents, t)
+	}
+	return int64(0), nil
+}
+
+// Applies setters such as d.directory.set="/downloads" to a torrent, other
+// commands are ignored
+func applyCommand(t *Torrent, command string) {
+	name, value, _ := strings.Cut(command, "=")
+	field, ok := strings.CutSuffix(name, ".set")
+	if !ok {
+		return
+	}
+
+	if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) && len(value) >= 2 {
+		value = value[1 : len(value)-1]
+		value = strings.ReplaceAll(value, `\"`, `"`)
+		value = strings.ReplaceAll(value, `\\`, `\`)
+	}
+
+	if _, ok := t.Fields[field].(int64); ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			t.Fields[field] = n
+		}
+		return
+	}
+	t.Fields[field] = value
+}
+
+// Returns the torrent named by the first parameter, caller holds the lock
+func (s *Server) target(params []interface{}) (*Torrent, error) {
+	if len(params) < 1 {
+		return nil, Fault{Code: -501, Message: "Could not find info-hash."}
+	}
+	hash, _ := params[0].(string)
+	t := s.find(hash)
+	if t == nil {
+		return nil, Fault{Code: -501, Message: "Could not find info-hash."}
+	}
+	return t, nil
+}
+
+// Caller holds the lock
+func (s *Server) find(hash string) *Torrent {
+	for _, t := range s.torrents {
+		if strings.EqualFold(t.Fields["d.hash"].(string), hash) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Caller holds the lock
+func (s *Server) customView(view string) bool {
+	for _, t := range s.torrents {
+		for _, v := range t.Views {
+			if v == view {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reports whether view is one of rTorrent's built in views
+func isView(view string) bool {
+	switch view {
+	case "", "default", "main", "name", "started", "stopped",
+		"complete", "incomplete", "hashing", "seeding", "leeching", "active":
+		return true
+	}
+	return false
+}
+
+func inView(t *Torrent, view string) bool {
+	state, _ := t.Fields["d.state"].(int64)
+	size, _ := t.Fields["d.size_bytes"].(int64)
+	completed, _ := t.Fields["d.completed_bytes"].(int64)
+	hashing, _ := t.Fields["d.is_hash_checking"].(int64)
+	active, _ := t.Fields["d.is_active"].(int64)
+
+	switch view {
+	case "", "default", "main", "name":
+		return true
+	case "started":
+		return state == 1
+	case "stopped":
+		return state == 0
+	case "complete":
+		return completed == size
+	case "incomplete":
+		return completed != size
+	case "hashing":
+		return hashing == 1
+	case "seeding":
+		return state == 1 && completed == size
+	case "leeching":
+		return state == 1 && completed != size
+	case "active":
+		return active == 1
+	}
+
+	for _, v := range t.Views {
+		if v == view {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluates multicall commands such as "d.name=" against an item
+func commands(item Item, cmds []interface{}) ([]interface{}, error) {
+	row := make([]interface{}, 0, len(cmds))
+	for _, c := range cmds {
+		cmd, ok := c.(string)
+		if !ok {
+			return nil, Fault{Code: -500, Message: fmt.Sprintf("invalid command %v", c)}
+		}
+		value, ok := item[strings.TrimSuffix(cmd, "=")]
+		if !ok {
+			return nil, notDefined(cmd)
+		}
+		row = append(row, value)
+	}
+	return row, nil
+}
+
+func notDefined(method string) Fault {
+	return Fault{Code: -506, Message: fmt.Sprintf("Method '%s' not defined", method)}
+}
@@ -0,0 +1,269 @@
+package rtorrenttest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fault is an XML-RPC fault returned by a method
+type Fault struct {
+	Code    int
+	Message string
+}
+
+func (f Fault) Error() string {
+	return fmt.Sprintf("Fault(%d): %s", f.Code, f.Message)
+}
+
+// Decodes a methodCall document into its method name and parameters.
+// Integers decode to int64, base64 to []byte, arrays to []interface{} and
+// structs to map[string]interface{}.
+func decodeCall(r io.Reader) (string, []interface{}, error) {
+	dec := xml.NewDecoder(r)
+
+	var method string
+	params := []interface{}{}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "methodName":
+			var name string
+			if err := dec.DecodeElement(&name, &start); err != nil {
+				return "", nil, err
+			}
+			method = strings.TrimSpace(name)
+		case "value":
+			value, err := decodeValue(dec)
+			if err != nil {
+				return "", nil, err
+			}
+			params = append(params, value)
+		}
+	}
+
+	if method == "" {
+		return "", nil, errors.New("missing methodName")
+	}
+	return method, params, nil
+}
+
+// Decodes the contents of a <value> element, the start element has already
+// been consumed
+func decodeValue(dec *xml.Decoder) (interface{}, error) {
+	var text strings.Builder
+	var value interface{}
+	typed := false
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			// </value>
+			if !typed {
+				return text.String(), nil
+			}
+			return value, nil
+		case xml.StartElement:
+			typed = true
+			value, err = decodeTyped(dec, t)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func decodeTyped(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "array":
+		values := []interface{}{}
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if t.Name.Local != "value" {
+					continue
+				}
+				value, err := decodeValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, value)
+			case xml.EndElement:
+				if t.Name.Local == "array" {
+					return values, nil
+				}
+			}
+		}
+	case "struct":
+		members := map[string]interface{}{}
+		var name string
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "name":
+					if err := dec.DecodeElement(&name, &t); err != nil {
+						return nil, err
+					}
+				case "value":
+					value, err := decodeValue(dec)
+					if err != nil {
+						return nil, err
+					}
+					members[name] = value
+				}
+			case xml.EndElement:
+				if t.Name.Local == "struct" {
+					return members, nil
+				}
+			}
+		}
+	}
+
+	var data string
+	if err := dec.DecodeElement(&data, &start); err != nil {
+		return nil, err
+	}
+	data = strings.TrimSpace(data)
+
+	switch start.Name.Local {
+	case "int", "i4", "i8":
+		return strconv.ParseInt(data, 10, 64)
+	case "boolean":
+		return data == "1", nil
+	case "double":
+		return strconv.ParseFloat(data, 64)
+	case "base64":
+		return base64.StdEncoding.DecodeString(data)
+	case "string", "dateTime.iso8601":
+		return data, nil
+	}
+	return nil, fmt.Errorf("unsupported xml-rpc type %q", start.Name.Local)
+}
+
+// Encodes value as a methodResponse document
+func encodeResponse(w io.Writer, value interface{}) error {
+	buffer := bytes.NewBufferString(`<?xml version="1.0" encoding="UTF-8"?><methodResponse><params><param>`)
+	if err := encodeValue(buffer, value); err != nil {
+		return err
+	}
+	buffer.WriteString(`</param></params></methodResponse>`)
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// Encodes a fault as a methodResponse document
+func encodeFault(w io.Writer, fault Fault) error {
+	buffer := bytes.NewBufferString(`<?xml version="1.0" encoding="UTF-8"?><methodResponse><fault>`)
+	if err := encodeValue(buffer, faultStruct(fault)); err != nil {
+		return err
+	}
+	buffer.WriteString(`</fault></methodResponse>`)
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+func faultStruct(fault Fault) map[string]interface{} {
+	return map[string]interface{}{
+		"faultCode":   fault.Code,
+		"faultString": fault.Message,
+	}
+}
+
+// Encodes value the way rTorrent does, integers are always sent as i8
+func encodeValue(buffer *bytes.Buffer, value interface{}) error {
+	buffer.WriteString("<value>")
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteString("<string></string>")
+	case string:
+		buffer.WriteString("<string>")
+		xml.EscapeText(buffer, []byte(v))
+		buffer.WriteString("</string>")
+	case int:
+		fmt.Fprintf(buffer, "<i8>%d</i8>", v)
+	case int64:
+		fmt.Fprintf(buffer, "<i8>%d</i8>", v)
+	case bool:
+		if v {
+			buffer.WriteString("<i8>1</i8>")
+		} else {
+			buffer.WriteString("<i8>0</i8>")
+		}
+	case float64:
+		fmt.Fprintf(buffer, "<double>%s</double>", strconv.FormatFloat(v, 'f', -1, 64))
+	case []byte:
+		fmt.Fprintf(buffer, "<base64>%s</base64>", base64.StdEncoding.EncodeToString(v))
+	case []string:
+		buffer.WriteString("<array><data>")
+		for _, item := range v {
+			if err := encodeValue(buffer, item); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("</data></array>")
+	case []interface{}:
+		buffer.WriteString("<array><data>")
+		for _, item := range v {
+			if err := encodeValue(buffer, item); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("</data></array>")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buffer.WriteString("<struct>")
+		for _, key := range keys {
+			buffer.WriteString("<member><name>")
+			xml.EscapeText(buffer, []byte(key))
+			buffer.WriteString("</name>")
+			if err := encodeValue(buffer, v[key]); err != nil {
+				return err
+			}
+			buffer.WriteString("</member>")
+		}
+		buffer.WriteString("</struct>")
+	default:
+		return fmt.Errorf("unsupported value type %T", value)
+	}
+	buffer.WriteString("</value>")
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Metainfo is the parsed content of a .torrent file
+type Metainfo struct {
+	// InfoHash is the hash rTorrent reports as d.hash, the SHA-1 of the
+	// info dictionary for v1 and hybrid torrents and the truncated SHA-256
+	// for v2 only torrents
+	InfoHash string `json:"info_hash"`
+	// InfoHashV2 is the SHA-256 of the info dictionary of v2 and hybrid
+	// torrents
+	InfoHashV2 string         `json:"info_hash_v2,omitempty"`
+	Version    string         `json:"version"`
+	Name       string         `json:"name"`
+	Size       int64          `json:"size"`
+	PieceSize  int64          `json:"piece_size"`
+	Private    bool           `json:"private"`
+	Files      []MetainfoFile `json:"files"`
+}
+
+type MetainfoFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+var ErrInvalidMetainfo = errors.New("invalid metainfo")
+
+// Parses and validates a bencoded .torrent file with a v1, v2 or hybrid
+// info dictionary
+func ParseMetainfo(data []byte) (*Metainfo, error) {
+	raw, err := bencodeRawDict(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMetainfo, err)
+	}
+	rawInfo, ok := raw["info"]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing info dictionary", ErrInvalidMetainfo)
+	}
+
+	value, err := bencodeDecode(rawInfo)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMetainfo, err)
+	}
+	info, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: info is not a dictionary", ErrInvalidMetainfo)
+	}
+
+	meta := &Metainfo{}
+	meta.Name, ok = info["name"].(string)
+	if !ok || !validPathComponent(meta.Name) {
+		return nil, fmt.Errorf("%w: invalid name", ErrInvalidMetainfo)
+	}
+	meta.PieceSize, ok = info["piece length"].(int64)
+	if !ok || meta.PieceSize <= 0 {
+		return nil, fmt.Errorf("%w: invalid piece length", ErrInvalidMetainfo)
+	}
+	if private, ok := info["private"].(int64); ok && private == 1 {
+		meta.Private = true
+	}
+
+	version, _ := info["meta version"].(int64)
+	_, hasPieces := info["pieces"]
+	isV1 := hasPieces
+	isV2 := version == 2
+
+	switch {
+	case isV1 && isV2:
+		meta.Version = "hybrid"
+	case isV2:
+		meta.Version = "v2"
+	case isV1:
+		meta.Version = "v1"
+	default:
+		return nil, fmt.Errorf("%w: neither v1 pieces nor v2 meta version", ErrInvalidMetainfo)
+	}
+
+	if isV1 {
+		files, err := v1Files(info)
+		if err != nil {
+			return nil, err
+		}
+		meta.Files = files
+
+		sum := sha1.Sum(rawInfo)
+		meta.InfoHash = strings.ToUpper(hex.EncodeToString(sum[:]))
+	}
+
+	if isV2 {
+		tree, ok := info["file tree"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: missing file tree", ErrInvalidMetainfo)
+		}
+		files := []MetainfoFile{}
+		err := v2Files(tree, "", &files, 0)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Path < files[j].Path
+		})
+		// hybrid torrents list the same files in both, the v1 list keeps
+		// the order of the torrent
+		if !isV1 {
+			meta.Files = files
+		}
+
+		sum := sha256.Sum256(rawInfo)
+		meta.InfoHashV2 = strings.ToUpper(hex.EncodeToString(sum[:]))
+		if !isV1 {
+			meta.InfoHash = meta.InfoHashV2[:40]
+		}
+	}
+
+	for _, file := range meta.Files {
+		meta.Size += file.Size
+	}
+
+	return meta, nil
+}
+
+// Returns the files of a v1 info dictionary, padding files are left out
+func v1Files(info map[string]interface{}) ([]MetainfoFile, error) {
+	pieces, _ := info["pieces"].(string)
+	if len(pieces) == 0 || len(pieces)%sha1.Size != 0 {
+		return nil, fmt.Errorf("%w: pieces must be a multiple of %d bytes", ErrInvalidMetainfo, sha1.Size)
+	}
+
+	name := info["name"].(string)
+
+	if length, ok := info["length"]; ok {
+		size, ok := length.(int64)
+		if !ok || size < 0 {
+			return nil, fmt.Errorf("%w: invalid length", ErrInvalidMetainfo)
+		}
+		return []MetainfoFile{{Path: name, Size: size}}, nil
+	}
+
+	list, ok := info["files"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%w: missing length or files", ErrInvalidMetainfo)
+	}
+
+	files := make([]MetainfoFile, 0, len(list))
+	for idx, item := range list {
+		file, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: file %d is not a dictionary", ErrInvalidMetainfo, idx)
+		}
+		size, ok := file["length"].(int64)
+		if !ok || size < 0 {
+			return nil, fmt.Errorf("%w: file %d has an invalid length", ErrInvalidMetainfo, idx)
+		}
+		parts, ok := file["path"].([]interface{})
+		if !ok || len(parts) == 0 {
+			return nil, fmt.Errorf("%w: file %d has an invalid path", ErrInvalidMetainfo, idx)
+		}
+
+		components := make([]string, 0, len(parts))
+		for _, part := range parts {
+			component, ok := part.(string)
+			if !ok || !validPathComponent(component) {
+				return nil, fmt.Errorf("%w: file %d has an invalid path", ErrInvalidMetainfo, idx)
+			}
+			components = append(components, component)
+		}
+
+		// BEP 47 padding files
+		if attr, _ := file["attr"].(string); strings.Contains(attr, "p") {
+			continue
+		}
+
+		files = append(files, MetainfoFile{
+			Path: path.Join(components...),
+			Size: size,
+		})
+	}
+	return files, nil
+}
+
+// Walks a v2 file tree, files are dictionaries with an empty key holding the
+// length
+func v2Files(tree map[string]interface{}, prefix string, files *[]MetainfoFile, depth int) error {
+	if depth > maxBencodeDepth {
+		return fmt.Errorf("%w: file tree too deep", ErrInvalidMetainfo)
+	}
+
+	for name, node := range tree {
+		entry, ok := node.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%w: file tree entry %q is not a dictionary", ErrInvalidMetainfo, name)
+		}
+
+		if name == "" {
+			size, ok := entry["length"].(int64)
+			if !ok || size < 0 || prefix == "" {
+				return fmt.Errorf("%w: invalid file tree entry", ErrInvalidMetainfo)
+			}
+			*files = append(*files, MetainfoFile{Path: prefix, Size: size})
+			continue
+		}
+
+		if !validPathComponent(name) {
+			return fmt.Errorf("%w: invalid path component %q", ErrInvalidMetainfo, name)
+		}
+		err := v2Files(entry, path.Join(prefix, name), files, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports whether a name can be used as a file or directory name without
+// escaping the download directory
+func validPathComponent(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
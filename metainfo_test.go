@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
+)
+
+// Encodes int64, string, list and dictionary values with sorted keys
+func bencodeTest(value interface{}) []byte {
+	buffer := bytes.NewBuffer(nil)
+	switch v := value.(type) {
+	case int64:
+		fmt.Fprintf(buffer, "i%de", v)
+	case string:
+		fmt.Fprintf(buffer, "%d:%s", len(v), v)
+	case []interface{}:
+		buffer.WriteByte('l')
+		for _, item := range v {
+			buffer.Write(bencodeTest(item))
+		}
+		buffer.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buffer.WriteByte('d')
+		for _, key := range keys {
+			buffer.Write(bencodeTest(key))
+			buffer.Write(bencodeTest(v[key]))
+		}
+		buffer.WriteByte('e')
+	}
+	return buffer.Bytes()
+}
+
+func testTorrent(info map[string]interface{}) []byte {
+	return bencodeTest(map[string]interface{}{
+		"announce": "http://tracker.invalid/announce",
+		"info":     info,
+	})
+}
+
+func v1File(size int64, path ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"length": size, "path": path}
+}
+
+func v2File(size int64) map[string]interface{} {
+	return map[string]interface{}{
+		"": map[string]interface{}{"length": size, "pieces root": strings.Repeat("\x00", 32)},
+	}
+}
+
+func TestParseMetainfoV1(t *testing.T) {
+	meta, err := ParseMetainfo(rtorrenttest.NewMetainfo("ubuntu.iso", 40000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != "v1" || meta.Name != "ubuntu.iso" || meta.Size != 40000 || meta.PieceSize != 16384 {
+		t.Errorf("unexpected metainfo: %+v", meta)
+	}
+	if len(meta.InfoHash) != 40 || meta.InfoHash != strings.ToUpper(meta.InfoHash) {
+		t.Errorf("unexpected info hash %q", meta.InfoHash)
+	}
+
+	data := testTorrent(map[string]interface{}{
+		"name":         "album",
+		"piece length": int64(16384),
+		"pieces":       strings.Repeat("\x00", sha1.Size),
+		"private":      int64(1),
+		"files": []interface{}{
+			v1File(100, "cd1", "01.flac"),
+			map[string]interface{}{"length": int64(16284), "path": []interface{}{".pad", "16284"}, "attr": "p"},
+			v1File(200, "cover.jpg"),
+		},
+	})
+	meta, err = ParseMetainfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MetainfoFile{{Path: "cd1/01.flac", Size: 100}, {Path: "cover.jpg", Size: 200}}
+	if !reflect.DeepEqual(meta.Files, want) || meta.Size != 300 || !meta.Private {
+		t.Errorf("unexpected metainfo: %+v", meta)
+	}
+}
+
+func TestParseMetainfoV2(t *testing.T) {
+	tree := map[string]interface{}{
+		"b.txt": v2File(20),
+		"dir":   map[string]interface{}{"a.txt": v2File(10)},
+	}
+
+	meta, err := ParseMetainfo(testTorrent(map[string]interface{}{
+		"name":         "v2",
+		"piece length": int64(16384),
+		"meta version": int64(2),
+		"file tree":    tree,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MetainfoFile{{Path: "b.txt", Size: 20}, {Path: "dir/a.txt", Size: 10}}
+	if meta.Version != "v2" || !reflect.DeepEqual(meta.Files, want) || meta.Size != 30 {
+		t.Errorf("unexpected metainfo: %+v", meta)
+	}
+	if len(meta.InfoHashV2) != 64 || meta.InfoHash != meta.InfoHashV2[:40] {
+		t.Errorf("unexpected info hashes %q %q", meta.InfoHash, meta.InfoHashV2)
+	}
+
+	meta, err = ParseMetainfo(testTorrent(map[string]interface{}{
+		"name":         "hybrid",
+		"piece length": int64(16384),
+		"meta version": int64(2),
+		"file tree":    tree,
+		"pieces":       strings.Repeat("\x00", sha1.Size),
+		"files":        []interface{}{v1File(20, "b.txt"), v1File(10, "dir", "a.txt")},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != "hybrid" || meta.Size != 30 || len(meta.Files) != 2 {
+		t.Errorf("unexpected metainfo: %+v", meta)
+	}
+	if meta.InfoHashV2 == "" || meta.InfoHash == meta.InfoHashV2[:40] {
+		t.Errorf("expected sha1 info hash for hybrid torrent, got %q %q", meta.InfoHash, meta.InfoHashV2)
+	}
+}
+
+func TestParseMetainfoInvalid(t *testing.T) {
+	pieces := strings.Repeat("\x00", sha1.Size)
+	tests := map[string][]byte{
+		"garbage":  []byte("<html></html>"),
+		"no info":  bencodeTest(map[string]interface{}{"announce": "x"}),
+		"list":     bencodeTest([]interface{}{"x"}),
+		"no name":  testTorrent(map[string]interface{}{"piece length": int64(1), "pieces": pieces, "length": int64(1)}),
+		"no files": testTorrent(map[string]interface{}{"name": "x", "piece length": int64(1), "pieces": pieces}),
+		"pieces":   testTorrent(map[string]interface{}{"name": "x", "piece length": int64(1), "pieces": "short", "length": int64(1)}),
+		"piece":    testTorrent(map[string]interface{}{"name": "x", "piece length": int64(0), "pieces": pieces, "length": int64(1)}),
+		"size":     testTorrent(map[string]interface{}{"name": "x", "piece length": int64(1), "pieces": pieces, "length": int64(-1)}),
+		"name":     testTorrent(map[string]interface{}{"name": "..", "piece length": int64(1), "pieces": pieces, "length": int64(1)}),
+		"v1 path": testTorrent(map[string]interface{}{"name": "x", "piece length": int64(1), "pieces": pieces,
+			"files": []interface{}{v1File(1, "..", "etc", "passwd")}}),
+		"v1 slash": testTorrent(map[string]interface{}{"name": "x", "piece length": int64(1), "pieces": pieces,
+			"files": []interface{}{v1File(1, "a/../../b")}}),
+		"v2 path": testTorrent(map[string]interface{}{"name": "x", "piece length": int64(1), "meta version": int64(2),
+			"file tree": map[string]interface{}{"..": map[string]interface{}{"passwd": v2File(1)}}}),
+		"v2 tree": testTorrent(map[string]interface{}{"name": "x", "piece length": int64(1), "meta version": int64(2)}),
+	}
+
+	for name, data := range tests {
+		_, err := ParseMetainfo(data)
+		if !errors.Is(err, ErrInvalidMetainfo) {
+			t.Errorf("%s: expected invalid metainfo, got %v", name, err)
+		}
+	}
+}
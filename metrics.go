@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rpcLatencyBuckets are the upper bounds in seconds of the XML-RPC call
+// latency histogram
+var rpcLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Torrent states counted per view
+var torrentStatuses = []string{"downloading", "seeding", "paused", "stopped", "hashing"}
+
+// Commands fetched for the view and per-torrent metrics
+var metricsArgs = []interface{}{"d.hash=", "d.name=", "d.state=", "d.is_active=",
+	"d.is_hash_checking=", "d.size_bytes=", "d.completed_bytes=", "d.up.rate=",
+	"d.up.total=", "d.down.rate=", "d.down.total=", "d.ratio="}
+
+// Commands fetched for the tracker metrics
+var metricsTrackerArgs = []interface{}{"t.url=", "t.failed_counter=", "t.is_enabled="}
+
+type rpcSeries struct {
+	method string
+	status string
+}
+
+type rpcHistogram struct {
+	// buckets counts the calls up to each bound of rpcLatencyBuckets
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// rpcMetrics records the latency of XML-RPC calls by method and outcome
+type rpcMetrics struct {
+	mu     sync.Mutex
+	series map[rpcSeries]*rpcHistogram
+}
+
+func newRPCMetrics() *rpcMetrics {
+	return &rpcMetrics{
+		series: map[rpcSeries]*rpcHistogram{},
+	}
+}
+
+func (m *rpcMetrics) observe(method string, d time.Duration, err error) {
+	key := rpcSeries{method: method, status: "ok"}
+	if err != nil {
+		key.status = "error"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.series[key]
+	if !ok {
+		h = &rpcHistogram{buckets: make([]uint64, len(rpcLatencyBuckets))}
+		m.series[key] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range rpcLatencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *rpcMetrics) write(mw *metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]rpcSeries, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	name := "rtw_xmlrpc_request_duration_seconds"
+	mw.family(name, "histogram", "Latency of XML-RPC calls to rTorrent by method and status (ok or error).")
+	for _, key := range keys {
+		h := m.series[key]
+		for i, bound := range rpcLatencyBuckets {
+			mw.sample(name+"_bucket", float64(h.buckets[i]),
+				"method", key.method, "status", key.status, "le", formatFloat(bound))
+		}
+		mw.sample(name+"_bucket", float64(h.count), "method", key.method, "status", key.status, "le", "+Inf")
+		mw.sample(name+"_sum", h.sum, "method", key.method, "status", key.status)
+		mw.sample(name+"_count", float64(h.count), "method", key.method, "status", key.status)
+	}
+}
+
+// metricsWriter writes the Prometheus text format
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (mw *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(&mw.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Writes a sample, labels are pairs of names and values
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.buf.WriteString(name)
+	if len(labels) > 0 {
+		mw.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&mw.buf, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		mw.buf.WriteByte('}')
+	}
+	mw.buf.WriteByte(' ')
+	mw.buf.WriteString(formatFloat(value))
+	mw.buf.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// MetricsConfig selects what /metrics exports
+type MetricsConfig struct {
+	// Views are the views whose torrents are counted by state
+	Views []string `yaml:"views"`
+	// Torrents enables the per-torrent series of the main view
+	Torrents bool `yaml:"torrents"`
+	// Trackers enables the tracker series, fetched with a call per torrent
+	Trackers bool `yaml:"trackers"`
+	// MaxTorrents is the number of torrents above which the per-torrent
+	// and tracker series are left out, to bound the number of series and
+	// calls
+	MaxTorrents int `yaml:"max_torrents"`
+}
+
+// Returns the state a torrent is counted in
+func torrentStatus(t Torrent) string {
+	switch {
+	case t.IsHashing != 0:
+		return "hashing"
+	case t.State == 0:
+		return "stopped"
+	case t.IsActive == 0:
+		return "paused"
+	case t.complete():
+		return "seeding"
+	}
+	return "downloading"
+}
+
+// Returns the trackers of each torrent, fetched in batched system.multicall
+// calls and decoded as TMulticall does. Torrents whose call fails are left
+// out.
+func (rt *Rtorrent) TrackersOf(ctx context.Context, hashes []string, commands []interface{}) (map[string][]Tracker, error) {
+	trackers := make(map[string][]Tracker, len(hashes))
+
+	for start := 0; start < len(hashes); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		batch := hashes[start:end]
+
+		calls := make([]interface{}, 0, len(batch))
+		for _, hash := range batch {
+			calls = append(calls, SystemCall{
+				MethodName: "t.multicall",
+				Params:     append([]interface{}{hash, ""}, commands...),
+			})
+		}
+
+		var result interface{}
+		err := rt.client.Call(ctx, "system.multicall", []interface{}{calls}, &result)
+		if err != nil {
+			return nil, err
+		}
+		values, ok := result.([]interface{})
+		if !ok || len(values) != len(batch) {
+			return nil, fmt.Errorf("expected %d results from system.multicall, got %s", len(batch), xmlrpcType(result))
+		}
+
+		for i, hash := range batch {
+			rows, err := multicallValue(values[i])
+			if err != nil {
+				continue
+			}
+			decoded, err := multicallTags[Tracker](rows, calls[i].(SystemCall).Params)
+			if err != nil {
+				continue
+			}
+			trackers[hash] = decoded
+		}
+	}
+	return trackers, nil
+}
+
+// Returns the host a tracker is reported under
+func trackerHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Hostname()
+}
+
+func MetricsHandler(rt *Rtorrent) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := rt.metricsConfig()
+		mw := &metricsWriter{}
+		ctx := r.Context()
+
+		system, err := rt.SystemMulticall(ctx, systemArgs())
+		up := 1.0
+		if err != nil {
+			log.Printf("error in metrics handler: %s", err)
+			up = 0
+		}
+		mw.family("rtorrent_up", "gauge", "Whether rTorrent answered the last scrape.")
+		mw.sample("rtorrent_up", up)
+
+		if err == nil {
+			writeSystemMetrics(mw, system)
+			writeTorrentMetrics(ctx, mw, rt, config)
+		}
+		rt.client.metrics.write(mw)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(mw.buf.Bytes())
+	}
+}
+
+func writeSystemMetrics(mw *metricsWriter, system System) {
+	mw.family("rtorrent_info", "gauge", "rTorrent version information.")
+	mw.sample("rtorrent_info", 1,
+		"client_version", system.ClientVersion,
+		"library_version", system.LibraryVersion,
+		"api_version", system.APIVersion,
+		"hostname", system.Hostname)
+
+	counters := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"rtorrent_downloaded_bytes_total", "Bytes downloaded by rTorrent.", system.ThrottleGlobalDownTotal},
+		{"rtorrent_uploaded_bytes_total", "Bytes uploaded by rTorrent.", system.ThrottleGlobalUpTotal},
+	}
+	for _, c := range counters {
+		mw.family(c.name, "counter", c.help)
+		mw.sample(c.name, float64(c.value))
+	}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"rtorrent_download_rate_bytes", "Global download rate in bytes per second.", system.ThrottleGlobalDownRate},
+		{"rtorrent_upload_rate_bytes", "Global upload rate in bytes per second.", system.ThrottleGlobalUpRate},
+		{"rtorrent_download_max_rate_bytes", "Global download rate limit in bytes per second, 0 is unlimited.", system.ThrottleGlobalDownMaxRate},
+		{"rtorrent_upload_max_rate_bytes", "Global upload rate limit in bytes per second, 0 is unlimited.", system.ThrottleGlobalUpMaxRate},
+	}
+	for _, g := range gauges {
+		mw.family(g.name, "gauge", g.help)
+		mw.sample(g.name, float64(g.value))
+	}
+}
+
+func writeTorrentMetrics(ctx context.Context, mw *metricsWriter, rt *Rtorrent, config MetricsConfig) {
+	views := map[string][]Torrent{}
+	mw.family("rtorrent_torrents", "gauge", "Torrents in a view by state.")
+	for _, view := range config.Views {
+		args := append([]interface{}{"", view}, metricsArgs...)
+		torrents, err := rt.DMulticall(ctx, view, args)
+		if err != nil {
+			log.Printf("error in metrics handler: view %s: %s", view, err)
+			continue
+		}
+		views[view] = torrents
+
+		counts := map[string]int{}
+		for _, torrent := range torrents {
+			counts[torrentStatus(torrent)]++
+		}
+		for _, status := range torrentStatuses {
+			mw.sample("rtorrent_torrents", float64(counts[status]), "view", view, "state", status)
+		}
+	}
+
+	main, ok := views["main"]
+	if !ok {
+		args := append([]interface{}{"", "main"}, metricsArgs...)
+		var err error
+		main, err = rt.DMulticall(ctx, "main", args)
+		if err != nil {
+			log.Printf("error in metrics handler: view main: %s", err)
+			return
+		}
+	}
+
+	if config.Torrents {
+		writePerTorrentMetrics(mw, main, config.MaxTorrents)
+	}
+
+	if !config.Trackers || len(main) > config.MaxTorrents {
+		return
+	}
+	hashes := make([]string, 0, len(main))
+	for _, torrent := range main {
+		hashes = append(hashes, torrent.Hash)
+	}
+	trackers, err := rt.TrackersOf(ctx, hashes, metricsTrackerArgs)
+	if err != nil {
+		log.Printf("error in metrics handler: trackers: %s", err)
+		return
+	}
+	writeTrackerMetrics(mw, trackers)
+}
+
+func writePerTorrentMetrics(mw *metricsWriter, torrents []Torrent, max int) {
+	skipped := 0.0
+	if len(torrents) > max {
+		skipped = 1
+		torrents = nil
+	}
+	mw.family("rtw_torrent_series_skipped", "gauge",
+		"Whether the per-torrent and tracker series were left out because there are more torrents than METRICS_MAX_TORRENTS.")
+	mw.sample("rtw_torrent_series_skipped", skipped)
+
+	series := []struct {
+		name  string
+		typ   string
+		help  string
+		value func(Torrent) float64
+	}{
+		{"rtorrent_torrent_download_rate_bytes", "gauge", "Download rate of a torrent in bytes per second.",
+			func(t Torrent) float64 { return float64(t.DownloadRate) }},
+		{"rtorrent_torrent_upload_rate_bytes", "gauge", "Upload rate of a torrent in bytes per second.",
+			func(t Torrent) float64 { return float64(t.UploadRate) }},
+		{"rtorrent_torrent_downloaded_bytes_total", "counter", "Bytes downloaded for a torrent.",
+			func(t Torrent) float64 { return float64(t.DownloadTotal) }},
+		{"rtorrent_torrent_uploaded_bytes_total", "counter", "Bytes uploaded for a torrent.",
+			func(t Torrent) float64 { return float64(t.UploadTotal) }},
+		{"rtorrent_torrent_ratio", "gauge", "Upload ratio of a torrent.",
+			func(t Torrent) float64 { return float64(t.Ratio) / 1000 }},
+	}
+	for _, s := range series {
+		mw.family(s.name, s.typ, s.help)
+		for _, torrent := range torrents {
+			mw.sample(s.name, s.value(torrent), "hash", torrent.Hash, "name", torrent.Name)
+		}
+	}
+}
+
+func writeTrackerMetrics(mw *metricsWriter, trackers map[string][]Tracker) {
+	count := map[string]int64{}
+	failing := map[string]int64{}
+	failures := map[string]int64{}
+	for _, list := range trackers {
+		for _, tracker := range list {
+			if tracker.IsEnabled == 0 {
+				continue
+			}
+			host := trackerHost(tracker.URL)
+			count[host]++
+			failures[host] += tracker.FailedCounter
+			if tracker.FailedCounter > 0 {
+				failing[host]++
+			}
+		}
+	}
+
+	hosts := make([]string, 0, len(count))
+	for host := range count {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	families := []struct {
+		name   string
+		help   string
+		values map[string]int64
+	}{
+		{"rtorrent_trackers", "Enabled trackers of the torrents in the main view by host.", count},
+		{"rtorrent_trackers_failing", "Enabled trackers whose last announces failed by host.", failing},
+		{"rtorrent_tracker_failures", "Consecutive failed announces of the enabled trackers by host.", failures},
+	}
+	for _, f := range families {
+		mw.family(f.name, "gauge", f.help)
+		for _, host := range hosts {
+			mw.sample(f.name, float64(f.values[host]), "host", host)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
+)
+
+// Returns the /metrics output
+func scrape(t *testing.T, rtorrent *Rtorrent) string {
+	t.Helper()
+
+	srv := httptest.NewServer(newRouter(rtorrent, nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	rtorrent.reconfigure(CacheConfig{}, MetricsConfig{Torrents: true, Trackers: true, MaxTorrents: 1000})
+	fake.SetSystem("throttle.global_down.total", int64(100))
+	fake.SetSystem("throttle.global_up.rate", int64(20))
+
+	addTestTorrent(fake, "A", "a")
+	b := addTestTorrent(fake, "B", `b "quoted"`)
+	b.Fields["d.state"] = int64(1)
+	b.Fields["d.is_active"] = int64(1)
+	b.Fields["d.completed_bytes"] = int64(1024)
+	b.Fields["d.ratio"] = int64(1500)
+	b.Trackers[0]["t.failed_counter"] = int64(3)
+
+	body := scrape(t, rtorrent)
+
+	for _, want := range []string{
+		"rtorrent_up 1\n",
+		`rtorrent_info{client_version="0.9.8",library_version="0.13.8",api_version="10",hostname="rtorrenttest"} 1`,
+		"# TYPE rtorrent_downloaded_bytes_total counter\nrtorrent_downloaded_bytes_total 100\n",
+		"rtorrent_upload_rate_bytes 20\n",
+		`rtorrent_torrents{view="main",state="stopped"} 1`,
+		`rtorrent_torrents{view="main",state="seeding"} 1`,
+		`rtorrent_torrents{view="main",state="downloading"} 0`,
+		"rtw_torrent_series_skipped 0\n",
+		`rtorrent_torrent_ratio{hash="B",name="b \"quoted\""} 1.5`,
+		`rtorrent_trackers{host="tracker.invalid"} 2`,
+		`rtorrent_trackers_failing{host="tracker.invalid"} 1`,
+		`rtorrent_tracker_failures{host="tracker.invalid"} 3`,
+		`rtw_xmlrpc_request_duration_seconds_count{method="d.multicall2",status="ok"} 1`,
+		`rtw_xmlrpc_request_duration_seconds_bucket{method="system.multicall",status="ok",le="+Inf"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsCardinalityGuard(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	rtorrent.reconfigure(CacheConfig{}, MetricsConfig{Torrents: true, Trackers: true, MaxTorrents: 1})
+	addTestTorrent(fake, "A", "a")
+	addTestTorrent(fake, "B", "b")
+
+	body := scrape(t, rtorrent)
+	if !strings.Contains(body, "rtw_torrent_series_skipped 1\n") || strings.Contains(body, `hash="A"`) {
+		t.Errorf("expected per-torrent series to be left out, got:\n%s", body)
+	}
+	if strings.Contains(body, "rtorrent_trackers") {
+		t.Errorf("expected tracker series to be left out, got:\n%s", body)
+	}
+}
+
+func TestMetricsTrackersDisabled(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	rtorrent.reconfigure(CacheConfig{}, MetricsConfig{Views: []string{"main"}, MaxTorrents: 1000})
+	addTestTorrent(fake, "A", "a")
+
+	body := scrape(t, rtorrent)
+	if strings.Contains(body, "rtorrent_trackers") {
+		t.Errorf("expected tracker series to be off by default, got:\n%s", body)
+	}
+	for _, call := range fake.Calls() {
+		if call == "t.multicall" {
+			t.Error("expected the trackers not to be fetched")
+		}
+	}
+}
+
+func TestMetricsRtorrentDown(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	fake.Handle("system.multicall", func(params []interface{}) (interface{}, error) {
+		return nil, rtorrenttest.Fault{Code: -500, Message: "down"}
+	})
+
+	body := scrape(t, rtorrent)
+	if !strings.Contains(body, "rtorrent_up 0\n") ||
+		!strings.Contains(body, `rtw_xmlrpc_request_duration_seconds_count{method="system.multicall",status="error"} 1`) {
+		t.Errorf("expected rTorrent to be reported down, got:\n%s", body)
+	}
+}
+
+func TestRPCMetricsBuckets(t *testing.T) {
+	m := newRPCMetrics()
+	m.observe("d.start", 30*time.Millisecond, nil)
+
+	mw := &metricsWriter{}
+	m.write(mw)
+	body := mw.buf.String()
+	for _, want := range []string{
+		`rtw_xmlrpc_request_duration_seconds_bucket{method="d.start",status="ok",le="0.025"} 0`,
+		`rtw_xmlrpc_request_duration_seconds_bucket{method="d.start",status="ok",le="0.05"} 1`,
+		`rtw_xmlrpc_request_duration_seconds_sum{method="d.start",status="ok"} 0.03`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q, got:\n%s", want, body)
+		}
+	}
+}
@@ -2,13 +2,54 @@ package main
 
 import (
 	"net/http"
-	"os"
+	"strconv"
+	"sync/atomic"
 )
 
+// CORSConfig allows cross origin requests from one origin
+type CORSConfig struct {
+	// Origin is the allowed origin or *, nothing is allowed when empty
+	Origin string `yaml:"origin"`
+	// MaxAge is how long in seconds browsers may cache preflight results,
+	// not sent when zero
+	MaxAge int `yaml:"max_age"`
+}
+
+// cors is the current CORSConfig, it changes on reload
+var cors atomic.Value
+
+// Sets the CORS configuration of every route
+func SetCORS(config CORSConfig) {
+	cors.Store(config)
+}
+
+func currentCORS() CORSConfig {
+	config, _ := cors.Load().(CORSConfig)
+	return config
+}
+
 func CorsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", os.Getenv("CORS_ORIGIN"))
-		w.Header().Set("Access-Control-Max-Age", os.Getenv("CORS_AGE"))
+		// nothing is allowed cross origin unless configured
+		if config := currentCORS(); config.Origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", config.Origin)
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+			if config.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+			}
+		}
+		// browsers send preflight requests without credentials, they are
+		// answered before authentication
+		if r.Method == http.MethodOptions {
+			PreflightHandler(w, r)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Answers OPTIONS requests, the CORS headers are set by CorsMiddleware
+func PreflightHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"time"
+
+	"github.com/kolo/xmlrpc"
+)
+
+// rpcClient performs XML-RPC calls with a context so that a call is aborted
+// when the caller goes away or the per-call timeout expires
+type rpcClient struct {
+	url        string
+	httpClient *http.Client
+	timeout    time.Duration
+	metrics    *rpcMetrics
+}
+
+func newRPCClient(url string, transport http.RoundTripper, timeout time.Duration) (*rpcClient, error) {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpcClient{
+		url: url,
+		httpClient: &http.Client{
+			Transport: transport,
+			Jar:       jar,
+		},
+		timeout: timeout,
+		metrics: newRPCMetrics(),
+	}, nil
+}
+
+// Calls method with args and unmarshals the response into reply, reply can be nil
+func (c *rpcClient) Call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	start := time.Now()
+	err := c.call(ctx, method, args, reply)
+	c.metrics.observe(method, time.Since(start), err)
+	return err
+}
+
+func (c *rpcClient) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := xmlrpc.NewRequest(c.url, method, args)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("request error: bad status code - %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	response := xmlrpc.Response(body)
+	if err := response.Err(); err != nil {
+		return err
+	}
+
+	if reply == nil {
+		return nil
+	}
+	return response.Unmarshal(reply)
+}
+
+// Closes idle connections to the XML-RPC endpoint
+func (c *rpcClient) Close() error {
+	c.httpClient.CloseIdleConnections()
+	return nil
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
+	"math"
 	"net/http"
-	"reflect"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kolo/xmlrpc"
 )
@@ -32,6 +38,56 @@ type Torrent struct {
 	Custom3        string `rtw:"d.custom3=" json:"custom3"`
 	Custom4        string `rtw:"d.custom4=" json:"custom4"`
 	Custom5        string `rtw:"d.custom5=" json:"custom5"`
+	BasePath       string `rtw:"d.base_path=" json:"base_path"`
+	Directory      string `rtw:"d.directory=" json:"directory"`
+	IsMultiFile    int64  `rtw:"d.is_multi_file=" json:"is_multi_file"`
+	// Ratio is the upload ratio multiplied by 1000
+	Ratio        int64 `rtw:"d.ratio=" json:"ratio"`
+	CreationDate int64 `rtw:"d.creation_date=" json:"creation_date"`
+	// LoadDate is the unix time the torrent was added, as stored by
+	// ruTorrent and similar clients
+	LoadDate          int64    `rtw:"d.custom=addtime" json:"load_date"`
+	TimestampStarted  int64    `rtw:"d.timestamp.started=" json:"timestamp_started"`
+	TimestampFinished int64    `rtw:"d.timestamp.finished=" json:"timestamp_finished"`
+	IsPrivate         int64    `rtw:"d.is_private=" json:"is_private"`
+	ChunkSize         int64    `rtw:"d.chunk_size=" json:"chunk_size"`
+	SizeChunks        int64    `rtw:"d.size_chunks=" json:"size_chunks"`
+	CompletedChunks   int64    `rtw:"d.completed_chunks=" json:"completed_chunks"`
+	LeftBytes         int64    `rtw:"d.left_bytes=" json:"left_bytes"`
+	ThrottleName      string   `rtw:"d.throttle_name=" json:"throttle_name"`
+	ConnectionCurrent string   `rtw:"d.connection_current=" json:"connection_current"`
+	Views             []string `rtw:"d.views=" json:"views"`
+
+	// Progress is the completed percentage, derived from the sizes
+	Progress float64 `json:"progress"`
+	// ETA is the estimated number of seconds until the download completes
+	// at the current rate, 0 when complete and -1 when not downloading
+	ETA int64 `json:"eta"`
+}
+
+// Fills the fields derived from the fetched ones
+func (t *Torrent) derive() {
+	if t.SizeBytes > 0 {
+		t.Progress = math.Round(float64(t.CompletedBytes)*10000/float64(t.SizeBytes)) / 100
+	}
+
+	left := t.LeftBytes
+	if left == 0 {
+		left = t.SizeBytes - t.CompletedBytes
+	}
+	switch {
+	case left <= 0:
+		t.ETA = 0
+	case t.DownloadRate > 0:
+		t.ETA = (left + t.DownloadRate - 1) / t.DownloadRate
+	default:
+		t.ETA = -1
+	}
+}
+
+// Reports whether all of the torrent's data has been downloaded
+func (t Torrent) complete() bool {
+	return t.SizeBytes > 0 && t.CompletedBytes >= t.SizeBytes
 }
 
 type File struct {
@@ -99,32 +155,167 @@ type SystemCall struct {
 	Params     interface{} `xmlrpc:"params" json:"params"`
 }
 
+// State changing torrent actions by their API name
+var torrentActions = map[string]func(*Rtorrent, context.Context, string) error{
+	"start":      (*Rtorrent).Start,
+	"stop":       (*Rtorrent).Stop,
+	"pause":      (*Rtorrent).Pause,
+	"resume":     (*Rtorrent).Resume,
+	"open":       (*Rtorrent).Open,
+	"close":      (*Rtorrent).Close,
+	"check_hash": (*Rtorrent).CheckHash,
+}
+
+// LoadOptions are applied to a torrent as rTorrent loads it
+type LoadOptions struct {
+	// Paused loads the torrent without starting it
+	Paused bool
+	// Directory sets d.directory
+	Directory string
+	// Label sets d.custom1
+	Label string
+	// Priority sets d.priority (0 off, 1 low, 2 normal, 3 high) when not nil
+	Priority *int64
+	// Commands are extra commands run on load, e.g. "d.custom2.set=tv"
+	Commands []string
+}
+
+// Returns the post-load commands passed after the load target
+func (o LoadOptions) commands() []interface{} {
+	commands := []interface{}{}
+	if o.Directory != "" {
+		commands = append(commands, "d.directory.set="+quoteCommandArg(o.Directory))
+	}
+	if o.Label != "" {
+		commands = append(commands, "d.custom1.set="+quoteCommandArg(o.Label))
+	}
+	if o.Priority != nil {
+		commands = append(commands, fmt.Sprintf("d.priority.set=%d", *o.Priority))
+	}
+	for _, command := range o.Commands {
+		commands = append(commands, command)
+	}
+	return commands
+}
+
+// Quotes a value for use as a command argument so that commas and
+// semicolons in it are not interpreted by rTorrent
+func quoteCommandArg(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
 type RtorrentConfig struct {
+	// Name of the backend, it tags aggregated results and audit entries
+	Name string
+	// URL of the XML-RPC endpoint, either http(s)://host/RPC2 behind a web
+	// server or scgi://host:port and scgi:///path/to/rpc.socket for rTorrent's
+	// own SCGI sockets
 	URL       string
 	Transport http.RoundTripper
+	// Timeout limits the duration of a single XML-RPC call, zero means
+	// calls are only bound by the context passed to them
+	Timeout time.Duration
+	// DownloadRoots are the directories torrent data may be deleted from,
+	// deleting data is refused when empty
+	DownloadRoots []string
+	// EventInterval is how often views with event subscribers are polled,
+	// two seconds when zero
+	EventInterval time.Duration
+	// Cache sets how long read results are shared between callers
+	Cache CacheConfig
+	// Audit records mutating operations when not nil
+	Audit *AuditLog
+	// Metrics selects what /metrics exports, the main view is counted when
+	// it has no views
+	Metrics MetricsConfig
 }
 
 type Rtorrent struct {
-	client *xmlrpc.Client
+	name          string
+	client        *rpcClient
+	downloadRoots []string
+	events        *eventHub
+	cache         *rpcCache
+	audit         *AuditLog
+	// streams is cancelled on shutdown, ending the WebSocket connections
+	streams     context.Context
+	stopStreams context.CancelFunc
+
+	// methods caches system.listMethods for validating commands
+	methods struct {
+		sync.Mutex
+		names map[string]bool
+	}
+
+	// metrics selects what /metrics exports, it changes on reload
+	metrics struct {
+		sync.Mutex
+		config MetricsConfig
+	}
 }
 
 // Creates a new instance of Rtorrent client
 func NewRtorrent(config RtorrentConfig) (*Rtorrent, error) {
-	xmlrpcClient, err := xmlrpc.NewClient(config.URL, config.Transport)
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// scgi endpoints are spoken to directly instead of over http
+	transport := config.Transport
+	if _, ok := transport.(*SCGITransport); u.Scheme == "scgi" && !ok {
+		transport = &SCGITransport{}
+	}
+
+	client, err := newRPCClient(config.URL, transport, config.Timeout)
 	if err != nil {
 		return nil, err
 	}
 
 	rtorrent := &Rtorrent{
-		client: xmlrpcClient,
+		name:          config.Name,
+		client:        client,
+		downloadRoots: config.DownloadRoots,
+		cache:         newRPCCache(config.Cache),
+		audit:         config.Audit,
 	}
+	rtorrent.events = newEventHub(rtorrent, config.EventInterval)
+	rtorrent.streams, rtorrent.stopStreams = context.WithCancel(context.Background())
+	rtorrent.reconfigure(config.Cache, config.Metrics)
 	return rtorrent, nil
 }
 
+// Ends the event streams and WebSocket connections and stops polling, they
+// would otherwise keep a shutdown waiting
+func (rt *Rtorrent) closeStreams() {
+	rt.stopStreams()
+	rt.events.Close()
+}
+
+// Applies the settings that can change while rtw runs
+func (rt *Rtorrent) reconfigure(cache CacheConfig, metrics MetricsConfig) {
+	rt.cache.setConfig(cache)
+
+	if len(metrics.Views) == 0 {
+		metrics.Views = []string{"main"}
+	}
+	rt.metrics.Lock()
+	defer rt.metrics.Unlock()
+	rt.metrics.config = metrics
+}
+
+func (rt *Rtorrent) metricsConfig() MetricsConfig {
+	rt.metrics.Lock()
+	defer rt.metrics.Unlock()
+	return rt.metrics.config
+}
+
 // Lists available XMLRPC methods
-func (rt *Rtorrent) ListMethods() ([]string, error) {
+func (rt *Rtorrent) ListMethods(ctx context.Context) ([]string, error) {
 	var result []string
-	err := rt.client.Call("system.listMethods", nil, &result)
+	err := rt.client.Call(ctx, "system.listMethods", nil, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -132,10 +323,39 @@ func (rt *Rtorrent) ListMethods() ([]string, error) {
 }
 
 // Load and start a torrent
-func (rt *Rtorrent) LoadRawStart(file []byte) error {
+func (rt *Rtorrent) LoadRawStart(ctx context.Context, file []byte) error {
+	return rt.LoadRaw(ctx, file, LoadOptions{})
+}
+
+// Load a torrent from the contents of a .torrent file
+func (rt *Rtorrent) LoadRaw(ctx context.Context, file []byte, options LoadOptions) error {
 	base64 := base64.StdEncoding.EncodeToString(file)
 
-	err := rt.client.Call("load.raw_start_verbose", []interface{}{"", xmlrpc.Base64(base64)}, nil)
+	method := "load.raw_start_verbose"
+	if options.Paused {
+		method = "load.raw_verbose"
+	}
+
+	args := append([]interface{}{"", xmlrpc.Base64(base64)}, options.commands()...)
+	err := rt.client.Call(ctx, method, args, nil)
+	rt.cache.invalidate("")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Load a torrent from a magnet URI or a http(s) URL of a .torrent file,
+// rTorrent fetches the URL itself
+func (rt *Rtorrent) Load(ctx context.Context, uri string, options LoadOptions) error {
+	method := "load.start_verbose"
+	if options.Paused {
+		method = "load.verbose"
+	}
+
+	args := append([]interface{}{"", uri}, options.commands()...)
+	err := rt.client.Call(ctx, method, args, nil)
+	rt.cache.invalidate("")
 	if err != nil {
 		return err
 	}
@@ -143,8 +363,9 @@ func (rt *Rtorrent) LoadRawStart(file []byte) error {
 }
 
 // Stop torrent with the specified hash
-func (rt *Rtorrent) Stop(hash string) error {
-	err := rt.client.Call("d.stop", hash, nil)
+func (rt *Rtorrent) Stop(ctx context.Context, hash string) error {
+	err := rt.client.Call(ctx, "d.stop", hash, nil)
+	rt.cache.invalidate(hash)
 	if err != nil {
 		return err
 	}
@@ -152,119 +373,168 @@ func (rt *Rtorrent) Stop(hash string) error {
 }
 
 // Start torrent with the specified hash
-func (rt *Rtorrent) Start(hash string) error {
-	err := rt.client.Call("d.start", hash, nil)
+func (rt *Rtorrent) Start(ctx context.Context, hash string) error {
+	err := rt.client.Call(ctx, "d.start", hash, nil)
+	rt.cache.invalidate(hash)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (rt *Rtorrent) DMulticall(view string, args interface{}) ([]Torrent, error) {
-	var result interface{}
-	err := rt.client.Call("d.multicall2", args, &result)
+// Pause torrent with the specified hash, it stays started but stops transferring
+func (rt *Rtorrent) Pause(ctx context.Context, hash string) error {
+	err := rt.client.Call(ctx, "d.pause", hash, nil)
+	rt.cache.invalidate(hash)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return nil
+}
 
-	torrents := multicallTags[Torrent](result, args)
-	return torrents, nil
+// Resume paused torrent with the specified hash
+func (rt *Rtorrent) Resume(ctx context.Context, hash string) error {
+	err := rt.client.Call(ctx, "d.resume", hash, nil)
+	rt.cache.invalidate(hash)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
-func (rt *Rtorrent) FMulticall(args interface{}) ([]File, error) {
-	var result interface{}
-	err := rt.client.Call("f.multicall", args, &result)
+// Open torrent with the specified hash
+func (rt *Rtorrent) Open(ctx context.Context, hash string) error {
+	err := rt.client.Call(ctx, "d.open", hash, nil)
+	rt.cache.invalidate(hash)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return nil
+}
 
-	files := multicallTags[File](result, args)
-	return files, nil
+// Close torrent with the specified hash, it has to be stopped first
+func (rt *Rtorrent) Close(ctx context.Context, hash string) error {
+	err := rt.client.Call(ctx, "d.close", hash, nil)
+	rt.cache.invalidate(hash)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
-func (rt *Rtorrent) PMulticall(args interface{}) ([]Peer, error) {
-	var result interface{}
-	err := rt.client.Call("p.multicall", args, &result)
+// Recheck the data of torrent with the specified hash
+func (rt *Rtorrent) CheckHash(ctx context.Context, hash string) error {
+	err := rt.client.Call(ctx, "d.check_hash", hash, nil)
+	rt.cache.invalidate(hash)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return nil
+}
 
-	peers := multicallTags[Peer](result, args)
-	return peers, nil
+// Set the priority of torrent with the specified hash, 0 off, 1 low, 2 normal
+// and 3 high
+func (rt *Rtorrent) SetPriority(ctx context.Context, hash string, priority int64) error {
+	if priority < 0 || priority > 3 {
+		return fmt.Errorf("invalid priority %d, expected 0 to 3", priority)
+	}
+	err := rt.client.Call(ctx, "d.priority.set", []interface{}{hash, priority}, nil)
+	rt.cache.invalidate(hash)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
-func (rt *Rtorrent) TMulticall(args interface{}) ([]Tracker, error) {
-	var result interface{}
-	err := rt.client.Call("t.multicall", args, &result)
+// Remove torrent with the specified hash from the session, data is left on disk
+func (rt *Rtorrent) Erase(ctx context.Context, hash string) error {
+	err := rt.client.Call(ctx, "d.erase", hash, nil)
+	rt.cache.invalidate(hash)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return nil
+}
 
-	trackers := multicallTags[Tracker](result, args)
-	return trackers, nil
+// Reports whether torrent with the specified hash is in the view
+func (rt *Rtorrent) InView(ctx context.Context, view string, hash string) (bool, error) {
+	torrents, err := rt.DMulticall(ctx, view, []interface{}{"", view, "d.hash="})
+	if err != nil {
+		return false, err
+	}
+
+	for _, torrent := range torrents {
+		if strings.EqualFold(torrent.Hash, hash) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func (rt *Rtorrent) SystemMulticall(args interface{}) (System, error) {
-	var result interface{}
-	err := rt.client.Call("system.multicall", args, &result)
+func (rt *Rtorrent) DMulticall(ctx context.Context, view string, args interface{}) ([]Torrent, error) {
+	result, err := rt.cachedCall(ctx, cacheView, "", "d.multicall2", args)
 	if err != nil {
-		return System{}, err
+		return nil, err
 	}
 
-	system := systemTags(result, args)
-	return system, nil
+	torrents, err := multicallTags[Torrent](result, args)
+	if err != nil {
+		return nil, err
+	}
+	for i := range torrents {
+		torrents[i].derive()
+	}
+	return torrents, nil
 }
 
-// Maps XMLRPC result to a struct using fields from args with reflection
-func multicallTags[T File | Torrent | Peer | Tracker](result interface{}, args interface{}) []T {
-	items := make([]T, 0)
-	for _, outer := range result.([]interface{}) {
-		item := new(T)
-		for idx := 2; idx < len(args.([]interface{})); idx++ {
-			ref := outer.([]interface{})[idx-2]
-			fname := args.([]interface{})[idx].(string)
-			vo := reflect.ValueOf(item)
-			el := vo.Elem()
-			for i := 0; i < el.NumField(); i++ {
-				field := el.Type().Field(i)
-				if fname == field.Tag.Get("rtw") {
-					if ref == nil {
-						continue
-					}
-					el.Field(i).Set(reflect.ValueOf(ref))
-				}
-			}
+func (rt *Rtorrent) FMulticall(ctx context.Context, args interface{}) ([]File, error) {
+	result, err := rt.cachedCall(ctx, cacheTorrent, argsHash(args), "f.multicall", args)
+	if err != nil {
+		return nil, err
+	}
 
-		}
-		items = append(items, *item)
+	files, err := multicallTags[File](result, args)
+	if err != nil {
+		return nil, err
 	}
-	return items
+	return files, nil
 }
 
-func systemTags(result interface{}, args interface{}) System {
-	system := &System{}
+func (rt *Rtorrent) PMulticall(ctx context.Context, args interface{}) ([]Peer, error) {
+	result, err := rt.cachedCall(ctx, cacheTorrent, argsHash(args), "p.multicall", args)
+	if err != nil {
+		return nil, err
+	}
 
-	// todo: use proper typing
+	peers, err := multicallTags[Peer](result, args)
+	if err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
 
-	r := result.([]interface{})
-	a := args.([]interface{})
+func (rt *Rtorrent) TMulticall(ctx context.Context, args interface{}) ([]Tracker, error) {
+	result, err := rt.cachedCall(ctx, cacheTorrent, argsHash(args), "t.multicall", args)
+	if err != nil {
+		return nil, err
+	}
 
-	for idx := 0; idx < len(r); idx++ {
-		ref := r[idx].([]interface{})[0]
-		fname := a[0].([]interface{})[idx].(SystemCall).MethodName
+	trackers, err := multicallTags[Tracker](result, args)
+	if err != nil {
+		return nil, err
+	}
+	return trackers, nil
+}
 
-		vo := reflect.ValueOf(system)
-		el := vo.Elem()
-		for i := 0; i < el.NumField(); i++ {
-			field := el.Type().Field(i)
-			if fname == field.Tag.Get("rtw") {
-				if ref == nil {
-					continue
-				}
-				el.Field(i).Set(reflect.ValueOf(ref))
-			}
-		}
+func (rt *Rtorrent) SystemMulticall(ctx context.Context, args interface{}) (System, error) {
+	result, err := rt.cachedCall(ctx, cacheSystem, "", "system.multicall", args)
+	if err != nil {
+		return System{}, err
 	}
 
-	return *system
+	system, err := systemTags(result, args)
+	if err != nil {
+		return System{}, err
+	}
+	return system, nil
 }
@@ -1,28 +1,82 @@
 package main
 
 import (
-	"net/http"
-	"os"
+	"context"
 	"testing"
+
+	"github.com/salimnassim/rtw/internal/rtorrenttest"
 )
 
-func TestMulticallSystem(t *testing.T) {
-	transport := &http.Transport{}
-	if os.Getenv("BASIC_USERNAME") != "" && os.Getenv("BASIC_PASSWORD") != "" {
-		transport.RegisterProtocol("https",
-			newBasicAuthTransport(
-				os.Getenv("BASIC_USERNAME"),
-				os.Getenv("BASIC_PASSWORD"),
-			),
-		)
-	}
+// Creates a client connected to a fake rTorrent that is closed with the test
+func newTestRtorrent(t *testing.T) (*Rtorrent, *rtorrenttest.Server) {
+	t.Helper()
+
+	fake := rtorrenttest.NewServer()
+	t.Cleanup(fake.Close)
+
 	rtorrent, err := NewRtorrent(RtorrentConfig{
-		URL:       os.Getenv("URL"),
-		Transport: transport,
+		URL: fake.URL,
 	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	t.Cleanup(func() { rtorrent.client.Close() })
+
+	return rtorrent, fake
+}
+
+// Creates a torrent in the fake with a file, a peer and a tracker
+func addTestTorrent(fake *rtorrenttest.Server, hash, name string) *rtorrenttest.Torrent {
+	torrent := rtorrenttest.NewTorrent(hash, name)
+	torrent.Fields["d.size_bytes"] = int64(1024)
+	torrent.Files = []rtorrenttest.Item{{
+		"f.path":             name + ".mkv",
+		"f.size_bytes":       int64(1024),
+		"f.size_chunks":      int64(1),
+		"f.completed_chunks": int64(0),
+		"f.frozen_path":      "/downloads/" + name + ".mkv",
+		"f.priority":         int64(1),
+		"f.is_created":       int64(1),
+		"f.is_open":          int64(0),
+	}}
+	torrent.Peers = []rtorrenttest.Item{{
+		"p.id":                "peer",
+		"p.address":           "192.0.2.1",
+		"p.port":              int64(51413),
+		"p.banned":            int64(0),
+		"p.client_version":    "Transmission 4.0.0",
+		"p.completed_percent": int64(50),
+		"p.is_encrypted":      int64(1),
+		"p.is_incoming":       int64(0),
+		"p.is_obfuscated":     int64(1),
+		"p.peer_rate":         int64(0),
+		"p.peer_total":        int64(512),
+		"p.up_rate":           int64(0),
+		"p.up_total":          int64(0),
+	}}
+	torrent.Trackers = []rtorrenttest.Item{{
+		"t.id":                 "tracker",
+		"t.type":               int64(1),
+		"t.url":                "http://tracker.invalid/announce",
+		"t.activity_time_last": int64(0),
+		"t.activity_time_next": int64(0),
+		"t.can_scrape":         int64(1),
+		"t.is_usable":          int64(1),
+		"t.is_enabled":         int64(1),
+		"t.failed_counter":     int64(0),
+		"t.failed_time_last":   int64(0),
+		"t.failed_time_next":   int64(0),
+		"t.is_busy":            int64(0),
+		"t.is_open":            int64(0),
+	}}
+	fake.Add(torrent)
+	return torrent
+}
+
+func TestMulticallSystem(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	fake.SetSystem("throttle.global_down.total", int64(100))
+	fake.SetSystem("throttle.global_up.total", int64(200))
 
 	args := []interface{}{
 		[]interface{}{
@@ -37,10 +91,235 @@ func TestMulticallSystem(t *testing.T) {
 		},
 	}
 
-	result, err := rtorrent.SystemMulticall(args)
+	result, err := rtorrent.SystemMulticall(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.ThrottleGlobalDownTotal != 100 || result.ThrottleGlobalUpTotal != 200 {
+		t.Errorf("unexpected system result: %+v", result)
+	}
+}
+
+func TestListMethods(t *testing.T) {
+	rtorrent, _ := newTestRtorrent(t)
+
+	methods, err := rtorrent.ListMethods(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, method := range methods {
+		if method == "d.multicall2" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("d.multicall2 missing from methods: %v", methods)
+	}
+}
+
+func TestLoadRawStart(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+
+	err := rtorrent.LoadRawStart(context.Background(), rtorrenttest.NewMetainfo("ubuntu.iso", 4096))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+
+	hashes := fake.Hashes()
+	if len(hashes) != 1 {
+		t.Fatalf("expected one torrent, got %v", hashes)
+	}
+	torrent, _ := fake.Torrent(hashes[0])
+	if torrent.Fields["d.name"] != "ubuntu.iso" || torrent.Fields["d.state"] != int64(1) {
+		t.Errorf("unexpected loaded torrent: %v", torrent.Fields)
 	}
 
-	t.Logf("%v", result)
+	err = rtorrent.LoadRawStart(context.Background(), []byte("garbage"))
+	if err == nil {
+		t.Error("expected error loading garbage")
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	priority := int64(3)
+
+	err := rtorrent.Load(context.Background(),
+		"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=debian.iso",
+		LoadOptions{
+			Paused:    true,
+			Directory: "/downloads/linux, isos",
+			Label:     `say "hi"`,
+			Priority:  &priority,
+			Commands:  []string{"d.custom2.set=extra"},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, ok := fake.Torrent("0123456789ABCDEF0123456789ABCDEF01234567")
+	if !ok {
+		t.Fatalf("expected magnet to be loaded, got %v", fake.Hashes())
+	}
+	want := map[string]interface{}{
+		"d.name":      "debian.iso",
+		"d.state":     int64(0),
+		"d.directory": "/downloads/linux, isos",
+		"d.custom1":   `say "hi"`,
+		"d.custom2":   "extra",
+		"d.priority":  int64(3),
+	}
+	for field, value := range want {
+		if torrent.Fields[field] != value {
+			t.Errorf("expected %s to be %v, got %v", field, value, torrent.Fields[field])
+		}
+	}
+	if calls := fake.Calls(); calls[len(calls)-1] != "load.verbose" {
+		t.Errorf("expected a paused load to be verbose, got %s", calls[len(calls)-1])
+	}
+
+	err = rtorrent.LoadRaw(context.Background(), rtorrenttest.NewMetainfo("ubuntu.iso", 4096), LoadOptions{Label: "linux"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := fake.Hashes()
+	torrent, _ = fake.Torrent(hashes[len(hashes)-1])
+	if torrent.Fields["d.custom1"] != "linux" || torrent.Fields["d.state"] != int64(1) {
+		t.Errorf("unexpected raw loaded torrent: %v", torrent.Fields)
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	torrent := addTestTorrent(fake, "abc", "ubuntu")
+
+	err := rtorrent.Start(context.Background(), "ABC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Fields["d.state"] != int64(1) {
+		t.Errorf("expected torrent to be started")
+	}
+
+	err = rtorrent.Stop(context.Background(), "ABC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Fields["d.state"] != int64(0) {
+		t.Errorf("expected torrent to be stopped")
+	}
+
+	err = rtorrent.Start(context.Background(), "missing")
+	if err == nil {
+		t.Error("expected error for unknown hash")
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	torrent := addTestTorrent(fake, "abc", "ubuntu")
+	ctx := context.Background()
+
+	steps := []struct {
+		name  string
+		fn    func(context.Context, string) error
+		field string
+		want  int64
+	}{
+		{"start", rtorrent.Start, "d.state", 1},
+		{"pause", rtorrent.Pause, "d.is_active", 0},
+		{"resume", rtorrent.Resume, "d.is_active", 1},
+		{"stop", rtorrent.Stop, "d.state", 0},
+		{"close", rtorrent.Close, "d.is_open", 0},
+		{"open", rtorrent.Open, "d.is_open", 1},
+		{"check_hash", rtorrent.CheckHash, "d.is_hash_checking", 1},
+	}
+	for _, step := range steps {
+		if err := step.fn(ctx, "ABC"); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if torrent.Fields[step.field] != step.want {
+			t.Errorf("%s: expected %s to be %d, got %v", step.name, step.field, step.want, torrent.Fields[step.field])
+		}
+	}
+
+	if err := rtorrent.Erase(ctx, "ABC"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.Torrent("ABC"); ok {
+		t.Error("expected torrent to be erased")
+	}
+}
+
+func TestDMulticall(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	addTestTorrent(fake, "abc", "ubuntu")
+	addTestTorrent(fake, "def", "debian")
+
+	args := []interface{}{"", "main", "d.hash=", "d.name=", "d.size_bytes="}
+	torrents, err := rtorrent.DMulticall(context.Background(), "main", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(torrents) != 2 {
+		t.Fatalf("expected 2 torrents, got %d", len(torrents))
+	}
+	if torrents[0].Hash != "ABC" || torrents[1].Name != "debian" || torrents[1].SizeBytes != 1024 {
+		t.Errorf("unexpected torrents: %+v", torrents)
+	}
+}
+
+func TestItemMulticalls(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	addTestTorrent(fake, "abc", "ubuntu")
+
+	files, err := rtorrent.FMulticall(context.Background(), []interface{}{"ABC", "", "f.path=", "f.size_bytes="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != "ubuntu.mkv" || files[0].Size != 1024 {
+		t.Errorf("unexpected files: %+v", files)
+	}
+
+	peers, err := rtorrent.PMulticall(context.Background(), []interface{}{"ABC", "", "p.address=", "p.port="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Address != "192.0.2.1" || peers[0].Port != 51413 {
+		t.Errorf("unexpected peers: %+v", peers)
+	}
+
+	trackers, err := rtorrent.TMulticall(context.Background(), []interface{}{"ABC", "", "t.url=", "t.type="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trackers) != 1 || trackers[0].URL != "http://tracker.invalid/announce" || trackers[0].Type != 1 {
+		t.Errorf("unexpected trackers: %+v", trackers)
+	}
+}
+
+func TestTorrentDerive(t *testing.T) {
+	tests := []struct {
+		torrent  Torrent
+		progress float64
+		eta      int64
+	}{
+		{Torrent{}, 0, 0},
+		{Torrent{SizeBytes: 3000, CompletedBytes: 1000, DownloadRate: 300}, 33.33, 7},
+		{Torrent{SizeBytes: 3000, CompletedBytes: 1000, LeftBytes: 1500, DownloadRate: 500}, 33.33, 3},
+		{Torrent{SizeBytes: 3000, CompletedBytes: 1000}, 33.33, -1},
+		{Torrent{SizeBytes: 3000, CompletedBytes: 3000}, 100, 0},
+	}
+
+	for _, tt := range tests {
+		torrent := tt.torrent
+		torrent.derive()
+		if torrent.Progress != tt.progress || torrent.ETA != tt.eta {
+			t.Errorf("%+v: expected progress %v eta %d, got %v %d", tt.torrent, tt.progress, tt.eta, torrent.Progress, torrent.ETA)
+		}
+	}
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCGITransport is a http.RoundTripper that talks SCGI directly to the
+// sockets opened by rTorrent with network.scgi.open_port (scgi://host:port)
+// or network.scgi.open_local (scgi:///path/to/rpc.socket).
+type SCGITransport struct {
+	// DialTimeout limits how long connecting to the socket may take.
+	// Zero means no timeout.
+	DialTimeout time.Duration
+}
+
+// Returns the network and address to dial for a scgi:// URL
+func scgiAddress(req *http.Request) (string, string, error) {
+	if req.URL.Scheme != "scgi" {
+		return "", "", fmt.Errorf("scgi: unsupported protocol scheme %q", req.URL.Scheme)
+	}
+	if req.URL.Host != "" {
+		return "tcp", req.URL.Host, nil
+	}
+	if req.URL.Path != "" {
+		return "unix", req.URL.Path, nil
+	}
+	return "", "", fmt.Errorf("scgi: missing host or socket path in %q", req.URL.String())
+}
+
+func (t *SCGITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	network, address, err := scgiAddress(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := net.Dialer{Timeout: t.DialTimeout}
+	conn, err := dialer.DialContext(req.Context(), network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := req.Context().Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// close the connection if the request is cancelled mid-flight,
+	// this unblocks any pending reads or writes
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-req.Context().Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	_, err = conn.Write(scgiRequest(req, body))
+	if err != nil {
+		close(done)
+		conn.Close()
+		return nil, contextError(req, err)
+	}
+
+	resp, err := scgiResponse(req, conn, done)
+	if err != nil {
+		close(done)
+		conn.Close()
+		return nil, contextError(req, err)
+	}
+	return resp, nil
+}
+
+// Prefers the context error over the network error it caused
+func contextError(req *http.Request, err error) error {
+	if ctxErr := req.Context().Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// Encodes the request as a SCGI netstring header block followed by the body
+func scgiRequest(req *http.Request, body []byte) []byte {
+	path := req.URL.Path
+	if req.URL.Host == "" || path == "" {
+		path = "/RPC2"
+	}
+
+	headers := [][2]string{
+		// CONTENT_LENGTH must be the first header
+		{"CONTENT_LENGTH", strconv.Itoa(len(body))},
+		{"SCGI", "1"},
+		{"REQUEST_METHOD", req.Method},
+		{"REQUEST_URI", path},
+		{"SERVER_PROTOCOL", "HTTP/1.1"},
+	}
+
+	header := bytes.NewBuffer(nil)
+	for _, h := range headers {
+		header.WriteString(h[0])
+		header.WriteByte(0)
+		header.WriteString(h[1])
+		header.WriteByte(0)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	fmt.Fprintf(buffer, "%d:", header.Len())
+	buffer.Write(header.Bytes())
+	buffer.WriteByte(',')
+	buffer.Write(body)
+	return buffer.Bytes()
+}
+
+// Parses the CGI style response (headers, blank line, body) written by rTorrent
+func scgiResponse(req *http.Request, conn net.Conn, done chan struct{}) (*http.Response, error) {
+	reader := bufio.NewReader(conn)
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("scgi: malformed response header: %w", err)
+	}
+
+	statusCode := http.StatusOK
+	status := "200 OK"
+	if s := header.Get("Status"); s != "" {
+		code, _, _ := strings.Cut(s, " ")
+		statusCode, err = strconv.Atoi(code)
+		if err != nil {
+			return nil, fmt.Errorf("scgi: malformed status %q", s)
+		}
+		status = s
+		header.Del("Status")
+	}
+
+	var body io.Reader = reader
+	contentLength := int64(-1)
+	if cl := header.Get("Content-Length"); cl != "" {
+		contentLength, err = strconv.ParseInt(cl, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("scgi: malformed content length %q", cl)
+		}
+		body = io.LimitReader(reader, contentLength)
+	}
+
+	return &http.Response{
+		Status:        status,
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.0",
+		ProtoMajor:    1,
+		ProtoMinor:    0,
+		Header:        http.Header(header),
+		Body:          &scgiBody{Reader: body, conn: conn, done: done},
+		ContentLength: contentLength,
+		Close:         true,
+		Request:       req,
+	}, nil
+}
+
+// scgiBody closes the underlying connection once the response has been read
+type scgiBody struct {
+	io.Reader
+	conn net.Conn
+	done chan struct{}
+}
+
+func (b *scgiBody) Close() error {
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+	return b.conn.Close()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const listMethodsResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<methodResponse><params><param><value><array><data>
+<value><string>system.listMethods</string></value>
+<value><string>d.multicall2</string></value>
+</data></array></value></param></params></methodResponse>`
+
+// Serves a single canned XML-RPC response per connection over SCGI and
+// records the parsed request headers
+func serveSCGI(t *testing.T, l net.Listener, headers chan<- map[string]string) {
+	t.Helper()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			size, err := reader.ReadString(':')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(size, ":"))
+			if err != nil {
+				return
+			}
+			block := make([]byte, n+1)
+			if _, err := io.ReadFull(reader, block); err != nil {
+				return
+			}
+
+			parsed := map[string]string{}
+			pieces := bytes.Split(bytes.TrimSuffix(block[:n], []byte{0}), []byte{0})
+			for i := 0; i+1 < len(pieces); i += 2 {
+				parsed[string(pieces[i])] = string(pieces[i+1])
+			}
+			length, _ := strconv.Atoi(parsed["CONTENT_LENGTH"])
+			body := make([]byte, length)
+			if _, err := io.ReadFull(reader, body); err != nil {
+				return
+			}
+			parsed["BODY"] = string(body)
+			headers <- parsed
+
+			fmt.Fprintf(conn, "Status: 200 OK\r\nContent-Type: text/xml\r\nContent-Length: %d\r\n\r\n%s",
+				len(listMethodsResponse), listMethodsResponse)
+		}(conn)
+	}
+}
+
+func TestSCGITransport(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	unix, err := net.Listen("unix", filepath.Join(t.TempDir(), "rpc.socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+
+	tests := []struct {
+		name     string
+		listener net.Listener
+		url      string
+	}{
+		{"tcp", tcp, "scgi://" + tcp.Addr().String()},
+		{"unix", unix, "scgi://" + unix.Addr().String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := make(chan map[string]string, 1)
+			go serveSCGI(t, tt.listener, headers)
+
+			rtorrent, err := NewRtorrent(RtorrentConfig{URL: tt.url})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rtorrent.client.Close()
+
+			methods, err := rtorrent.ListMethods(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(methods) != 2 || methods[1] != "d.multicall2" {
+				t.Errorf("unexpected methods: %v", methods)
+			}
+
+			h := <-headers
+			if h["SCGI"] != "1" || h["REQUEST_METHOD"] != "POST" {
+				t.Errorf("unexpected scgi headers: %v", h)
+			}
+			if !strings.Contains(h["BODY"], "<methodName>system.listMethods</methodName>") {
+				t.Errorf("unexpected scgi body: %s", h["BODY"])
+			}
+		})
+	}
+}
+
+func TestSCGITransportBadURL(t *testing.T) {
+	rtorrent, err := NewRtorrent(RtorrentConfig{URL: "scgi://"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtorrent.client.Close()
+
+	_, err = rtorrent.ListMethods(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "missing host or socket path") {
+		t.Errorf("expected missing host error, got %v", err)
+	}
+}
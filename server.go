@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "net/http/pprof"
@@ -12,77 +18,229 @@ import (
 )
 
 func main() {
+	source, printConfig, err := ParseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	config, err := source.Load()
+	if printConfig {
+		out, err := config.redacted()
+		if err != nil {
+			log.Fatalf("unable to print the configuration: %s", err)
+		}
+		os.Stdout.Write(out)
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%s", err)
+	}
+	if printConfig {
+		return
+	}
 
-	transport := &http.Transport{}
+	var audit *AuditLog
+	if config.Audit.Path != "" {
+		audit, err = NewAuditLog(config.Audit)
+		if err != nil {
+			log.Fatalf("unable to open the audit log: %v", err)
+			return
+		}
+	}
 
-	// enable basic auth if env is set
-	if os.Getenv("BASIC_USERNAME") != "" && os.Getenv("BASIC_PASSWORD") != "" {
-		transport.RegisterProtocol("https",
-			newBasicAuthTransport(
-				os.Getenv("BASIC_USERNAME"),
-				os.Getenv("BASIC_PASSWORD"),
-			),
-		)
+	instances := []*Rtorrent{}
+	for _, backend := range config.backends() {
+		transport, err := newUpstreamTransport(backend.UpstreamConfig)
+		if err != nil {
+			log.Fatalf("unable to set up the connection to rtorrent instance %s: %v", backend.Name, err)
+			return
+		}
+		rtorrent, err := NewRtorrent(RtorrentConfig{
+			Name:      backend.Name,
+			URL:       backend.URL,
+			Transport: transport,
+			Timeout:   backend.Timeout,
+			// data can only be deleted inside these directories
+			DownloadRoots: backend.DownloadRoots,
+			EventInterval: config.EventInterval,
+			Cache:         config.Cache,
+			Audit:         audit,
+			Metrics:       config.Metrics,
+		})
+		if err != nil {
+			log.Fatalf("unable to create rtorrent client instance %s: %v", backend.Name, err)
+			return
+		}
+		instances = append(instances, rtorrent)
 	}
+	backends := NewBackends(instances...)
 
-	rtorrent, err := NewRtorrent(RtorrentConfig{
-		URL:       os.Getenv("URL"),
-		Transport: transport,
-	})
+	SetCORS(config.CORS)
 
+	auth, err := newAuthFromConfig(config.Auth)
 	if err != nil {
-		log.Fatalf("unable to create rtorrent client instance: %v", err)
+		log.Fatalf("unable to set up authentication: %v", err)
 		return
 	}
+	if auth == nil {
+		log.Printf("API_KEYS_FILE, USERS_FILE and CLIENT_CERT_PRINCIPAL are not set, the API is open to anyone who can reach it")
+	}
 
-	defer rtorrent.client.Close()
+	r := newBackendsRouter(backends, auth)
 
-	r := mux.NewRouter()
-	r.HandleFunc("/", TemplateViewHandler(rtorrent))
-
-	// enable pprof if env is set
-	if _, ok := os.LookupEnv("PPROF"); ok {
+	// enable pprof if configured
+	if config.PProf {
 		r.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
 	}
 
-	s := r.PathPrefix("/api").Subrouter()
-	s.HandleFunc("/hello", HelloHandler(rtorrent))
-	s.HandleFunc("/system", SystemHandler(rtorrent))
-	s.HandleFunc("/load", LoadHandler(rtorrent)).Methods("POST")
-	s.HandleFunc("/methods", MethodsHandler(rtorrent))
-	s.HandleFunc("/view/{view}", ViewHandler(rtorrent))
-	s.HandleFunc("/torrent/{hash}/{action}", TorrentHandler(rtorrent))
-	s.Use(CorsMiddleware)
+	go reloadOnHangup(source, config, backends, auth)
 
 	srv := &http.Server{
 		ReadHeaderTimeout: 10 * time.Second,
 		ReadTimeout:       15 * time.Second,
 		WriteTimeout:      10 * time.Second,
-		Addr:              os.Getenv("BIND_ADDRESS"),
+		Addr:              config.BindAddress,
 		Handler:           r,
 	}
 
-	log.Printf("listen address: http://%s", srv.Addr)
-	err = srv.ListenAndServe()
+	scheme := "http"
+	if config.TLS.enabled() {
+		srv.TLSConfig, err = newTLSConfig(config.TLS)
+		if err != nil {
+			log.Fatalf("unable to set up TLS: %s", err)
+		}
+		scheme = "https"
+	}
+
+	listener, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
 		log.Fatalf("server failure: %s", err)
 	}
+	log.Printf("listen address: %s://%s", scheme, srv.Addr)
+
+	// plain HTTP is only answered with redirects, it is closed as the
+	// shutdown starts
+	if config.TLS.RedirectAddress != "" {
+		redirectListener, err := net.Listen("tcp", config.TLS.RedirectAddress)
+		if err != nil {
+			log.Fatalf("server failure: %s", err)
+		}
+		redirect := &http.Server{
+			ReadHeaderTimeout: 10 * time.Second,
+			Handler:           RedirectHandler(config.BindAddress),
+		}
+		go redirect.Serve(redirectListener)
+		srv.RegisterOnShutdown(func() { redirect.Close() })
+		log.Printf("redirect address: http://%s", config.TLS.RedirectAddress)
+	}
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	err = serve(srv, listener, signals, config.ShutdownTimeout, backends)
+	if err != nil {
+		log.Printf("server failure: %s", err)
+	}
+
+	backends.Close()
+	if closeErr := audit.Close(); closeErr != nil {
+		log.Printf("error closing the audit log: %s", closeErr)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	log.Printf("shutdown complete")
+}
+
+// Serves on l, over TLS when srv has a TLS configuration, until a signal is
+// received. Then stops accepting connections and waits up to timeout for
+// the requests in flight before closing their connections. Event streams
+// and WebSocket connections are ended as the shutdown starts.
+func serve(srv *http.Server, l net.Listener, signals <-chan os.Signal, timeout time.Duration, backends *Backends) error {
+	srv.RegisterOnShutdown(backends.closeStreams)
+
+	served := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// the certificate comes from the configuration
+			served <- srv.ServeTLS(l, "", "")
+			return
+		}
+		served <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("requests still in flight after %s, closing their connections", timeout)
+		srv.Close()
+	}
+	<-served
+	return nil
 }
 
-type basicAuthTransport struct {
-	Username string
-	Password string
+// Registers the index and API routes of a single rTorrent
+func newRouter(rtorrent *Rtorrent, auth *Auth) *mux.Router {
+	return newBackendsRouter(NewBackends(rtorrent), auth)
 }
 
-func newBasicAuthTransport(username, password string) *basicAuthTransport {
-	return &basicAuthTransport{
-		Username: username,
-		Password: password,
+// Registers the index and API routes, every route but the login page
+// requires authentication unless auth is nil. Routes require a scope, the
+// handlers whose scope depends on the request check it themselves. The
+// default backend is served on /api and /metrics, and every backend on
+// /api/backends/{name} and /api/backends/{name}/metrics.
+func newBackendsRouter(backends *Backends, auth *Auth) *mux.Router {
+	rtorrent := backends.Default()
+
+	r := mux.NewRouter()
+	r.Handle("/", auth.UI(scoped(ScopeRead, TemplateViewHandler(rtorrent))))
+	r.HandleFunc("/login", LoginHandler(auth)).Methods("GET", "POST")
+	r.HandleFunc("/logout", LogoutHandler(auth)).Methods("POST")
+
+	s := r.PathPrefix("/api").Subrouter()
+	// matches preflight requests to routes of other methods, without turning
+	// unknown paths into 405s as a Methods matcher would
+	s.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return r.Method == http.MethodOptions
+	}).HandlerFunc(PreflightHandler)
+	s.Handle("/audit", scoped(ScopeAdmin, AuditHandler(rtorrent))).Methods("GET")
+	s.Handle("/backends", scoped(ScopeRead, BackendsHandler(backends))).Methods("GET")
+	s.Handle("/aggregate/view/{view}", scoped(ScopeRead, AggregateViewHandler(backends))).Methods("GET")
+	s.Handle("/aggregate/system", scoped(ScopeRead, AggregateSystemHandler(backends))).Methods("GET")
+	for _, backend := range backends.list {
+		if backend.name != "" {
+			registerAPI(s.PathPrefix("/backends/"+backend.name).Subrouter(), backend)
+			s.Handle("/backends/"+backend.name+"/metrics", scoped(ScopeAdmin, MetricsHandler(backend))).Methods("GET")
+		}
 	}
+	registerAPI(s, rtorrent)
+	s.Use(CorsMiddleware)
+	s.Use(auth.API)
+
+	r.Handle("/metrics", auth.API(scoped(ScopeAdmin, MetricsHandler(rtorrent)))).Methods("GET")
+
+	return r
 }
 
-func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.SetBasicAuth(t.Username, t.Password)
-	return http.DefaultTransport.RoundTrip(req)
+// Registers the API routes of one backend
+func registerAPI(s *mux.Router, rtorrent *Rtorrent) {
+	s.Handle("/hello", scoped(ScopeRead, HelloHandler(rtorrent)))
+	s.Handle("/system", scoped(ScopeRead, SystemHandler(rtorrent)))
+	s.Handle("/load", scoped(ScopeLoad, LoadHandler(rtorrent))).Methods("POST")
+	s.Handle("/methods", scoped(ScopeRead, MethodsHandler(rtorrent)))
+	s.Handle("/view/{view}", scoped(ScopeRead, ViewHandler(rtorrent)))
+	s.Handle("/events", scoped(ScopeRead, EventsHandler(rtorrent))).Methods("GET")
+	s.Handle("/ws", scoped(ScopeRead, WebSocketHandler(rtorrent))).Methods("GET")
+	s.HandleFunc("/torrents/actions", BulkHandler(rtorrent)).Methods("POST")
+	s.Handle("/torrent/{hash}", scoped(ScopeDelete, EraseHandler(rtorrent))).Methods("DELETE")
+	s.HandleFunc("/torrent/{hash}/{action}", TorrentHandler(rtorrent))
 }
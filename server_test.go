@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeShutdown(t *testing.T) {
+	rtorrent, fake := newTestEvents(t)
+	addTestTorrent(fake, "A", "a")
+	stopping := make(chan struct{})
+	fake.Handle("d.stop", func(params []interface{}) (interface{}, error) {
+		close(stopping)
+		time.Sleep(200 * time.Millisecond)
+		return 0, nil
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + l.Addr().String()
+	srv := &http.Server{Handler: newRouter(rtorrent, nil)}
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, l, signals, 5*time.Second, NewBackends(rtorrent))
+	}()
+
+	stream, err := http.Get(base + "/api/events?view=main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	stopped := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(base+"/api/torrent/A/stop", "", nil)
+		if err != nil {
+			stopped <- 0
+			return
+		}
+		resp.Body.Close()
+		stopped <- resp.StatusCode
+	}()
+
+	<-stopping
+	start := time.Now()
+	signals <- syscall.SIGTERM
+
+	if code := <-stopped; code != http.StatusOK {
+		t.Errorf("expected the request in flight to complete, got %d", code)
+	}
+	scanner := bufio.NewScanner(stream.Body)
+	for scanner.Scan() {
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the event stream not to hold the shutdown")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the shutdown to take the in-flight request, took %s", elapsed)
+	}
+	if _, err := http.Get(base + "/api/hello"); err == nil {
+		t.Error("expected new connections to be refused")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	rtorrent, fake := newTestRtorrent(t)
+	addTestTorrent(fake, "A", "a")
+	stopping := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	fake.Handle("d.stop", func(params []interface{}) (interface{}, error) {
+		close(stopping)
+		<-release
+		return 0, nil
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: newRouter(rtorrent, nil)}
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, l, signals, 50*time.Millisecond, NewBackends(rtorrent))
+	}()
+
+	go http.Post("http://"+l.Addr().String()+"/api/torrent/A/stop", "", nil)
+	<-stopping
+	signals <- os.Interrupt
+
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the shutdown to give up after the timeout")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most once per handshake
+const certCheckInterval = time.Second
+
+// TLSConfig enables HTTPS on the listener when a certificate is set
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files, reloaded when they change
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile is a PEM bundle client certificates are verified against
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuth is require, refusing connections without a certificate, or
+	// optional, verifying the certificates that are presented
+	ClientAuth string `yaml:"client_auth"`
+	// RedirectAddress is an IP:port answering plain HTTP with a redirect to
+	// HTTPS
+	RedirectAddress string `yaml:"redirect_address"`
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != ""
+}
+
+// certReloader serves a certificate, loading it again when its files change.
+// A certificate that fails to load is logged and the previous one kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// modTime is the newest modification time of the loaded files
+	modTime time.Time
+	checked time.Time
+}
+
+// Loads the certificate, failing when it cannot be
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Loads the certificate when its files are newer than the loaded one
+func (c *certReloader) reload() error {
+	modTime := time.Time{}
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		log.Printf("reloaded the TLS certificate %s", c.certFile)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		err := c.reload()
+		if err != nil {
+			log.Printf("error reloading the TLS certificate, keeping the previous one: %s", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// Returns the TLS configuration of the listener
+func newTLSConfig(config TLSConfig) (*tls.Config, error) {
+	reloader, err := newCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+	bundle, err := os.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the client CA bundle: %w", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("the client CA bundle has no PEM certificates")
+	}
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if config.ClientAuth == "optional" {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// Redirects requests to the same URL over HTTPS on the port of address
+func RedirectHandler(address string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(address)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	}
+}
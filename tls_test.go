@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate signed by a test CA, or the CA itself
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// Creates a certificate for name, signed by parent or self-signed when
+// parent is nil, and writes it and its key to dir
+func newTestCert(t *testing.T, dir, name string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"rtw"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return c
+}
+
+// Returns a client trusting ca and presenting client when it is not nil
+func newTestTLSClient(t *testing.T, ca, client *testCert) *http.Client {
+	t.Helper()
+
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	config.RootCAs.AddCert(ca.cert)
+	if client != nil {
+		pair, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+// Serves the router over TLS until the test ends and returns its URL
+func serveTestTLS(t *testing.T, config TLSConfig, auth *Auth) string {
+	t.Helper()
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtorrent, fake := newTestRtorrent(t)
+	addTestTorrent(fake, "A", "a")
+	srv := &http.Server{Handler: newRouter(rtorrent, auth), TLSConfig: tlsConfig}
+
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, l, signals, time.Second, NewBackends(rtorrent))
+	}()
+	t.Cleanup(func() {
+		signals <- os.Interrupt
+		<-served
+	})
+	return "https://" + l.Addr().String()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, dir, "server", 1, nil)
+	reloader, err := newCertReloader(first.certFile, first.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestCert(t, dir, "server", 2, nil)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(first.certFile, later, later)
+	reloader.checked = time.Time{}
+	cert, _ := reloader.GetCertificate(nil)
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.SerialNumber.Int64() != 2 {
+		t.Errorf("expected the changed certificate, got serial %d", leaf.SerialNumber)
+	}
+
+	os.WriteFile(first.keyFile, []byte("not a key"), 0600)
+	later = later.Add(time.Hour)
+	os.Chtimes(first.keyFile, later, later)
+	reloader.checked = time.Time{}
+	if again, _ := reloader.GetCertificate(nil); again != cert {
+		t.Error("expected the previous certificate to be kept when the new one is invalid")
+	}
+
+	if _, err := newCertReloader(first.certFile, first.keyFile); err == nil {
+		t.Error("expected an invalid certificate to fail at startup")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", 1, nil)
+	server := newTestCert(t, dir, "server", 2, ca)
+	backup := newTestCert(t, dir, "backup", 3, ca)
+	other := newTestCert(t, dir, "other", 4, ca)
+	stranger := newTestCert(t, dir, "stranger", 5, nil)
+
+	permissions := filepath.Join(dir, "permissions.json")
+	os.WriteFile(permissions, []byte(`{"principals": {"backup": {"roles": ["viewer"]}}}`), 0600)
+	auth, err := newAuthFromConfig(AuthConfig{ClientCertPrincipal: "common_name", PermissionsFile: permissions})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := serveTestTLS(t, TLSConfig{
+		CertFile:     server.certFile,
+		KeyFile:      server.keyFile,
+		ClientCAFile: ca.certFile,
+		ClientAuth:   "require",
+	}, auth)
+
+	tests := []struct {
+		name   string
+		client *testCert
+		method string
+		path   string
+		code   int
+	}{
+		{"viewer", backup, "GET", "/api/view/main", http.StatusOK},
+		{"viewer action", backup, "POST", "/api/torrent/A/stop", http.StatusForbidden},
+		{"no grant", other, "GET", "/api/view/main", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, base+tt.path, nil)
+		resp, err := newTestTLSClient(t, ca, tt.client).Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, resp.StatusCode)
+		}
+	}
+
+	for name, client := range map[string]*testCert{"no certificate": nil, "unknown CA": stranger} {
+		resp, err := newTestTLSClient(t, ca, client).Get(base + "/api/hello")
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("%s: expected the connection to be refused, got %d", name, resp.StatusCode)
+		}
+	}
+}
+
+func TestOptionalClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", 1, nil)
+	server := newTestCert(t, dir, "server", 2, ca)
+	backup := newTestCert(t, dir, "backup", 3, ca)
+
+	keys := filepath.Join(dir, "keys")
+	os.WriteFile(keys, []byte("scripts:key1\n"), 0600)
+	auth, err := newAuthFromConfig(AuthConfig{APIKeysFile: keys, ClientCertPrincipal: "subject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := serveTestTLS(t, TLSConfig{
+		CertFile:     server.certFile,
+		KeyFile:      server.keyFile,
+		ClientCAFile: ca.certFile,
+		ClientAuth:   "optional",
+	}, auth)
+
+	resp, err := newTestTLSClient(t, ca, backup).Get(base + "/api/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the certificate to authenticate, got %d", resp.StatusCode)
+	}
+
+	for key, code := range map[string]int{"": http.StatusUnauthorized, "key1": http.StatusOK} {
+		req, _ := http.NewRequest("GET", base+"/api/hello", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := newTestTLSClient(t, ca, nil).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("%q: expected %d without a certificate, got %d", key, code, resp.StatusCode)
+		}
+	}
+}
+
+func TestClientCertsSubject(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", 1, nil)
+	backup := newTestCert(t, dir, "backup", 2, ca)
+
+	r := httptest.NewRequest("GET", "/api/hello", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{backup.cert, ca.cert}}}
+
+	for subject, want := range map[bool]string{false: "backup", true: "CN=backup,O=rtw"} {
+		principal, err := (&ClientCerts{Subject: subject}).Authenticate(r)
+		if err != nil || principal.Name != want || principal.Method != "client_cert" {
+			t.Errorf("expected %s, got %+v %v", want, principal, err)
+		}
+	}
+
+	r.TLS = &tls.ConnectionState{}
+	if principal, err := (&ClientCerts{}).Authenticate(r); principal != nil || err != nil {
+		t.Errorf("expected an unverified connection to carry no credentials, got %+v %v", principal, err)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		address string
+		host    string
+		want    string
+	}{
+		{"0.0.0.0:8443", "example.com:8080", "https://example.com:8443/api/view/main?limit=1"},
+		{":443", "example.com", "https://example.com/api/view/main?limit=1"},
+		{"[::]:8443", "[::1]:8080", "https://[::1]:8443/api/view/main?limit=1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://"+tt.host+"/api/view/main?limit=1", nil)
+		w := httptest.NewRecorder()
+		RedirectHandler(tt.address)(w, r)
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s: expected a redirect to %s, got %d %s", tt.address, tt.want, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
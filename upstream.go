@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// proxyDirect disables the proxy of the environment
+const proxyDirect = "direct"
+
+// Returns the transport reaching an instance over the scheme of its URL.
+// Credentials, headers, TLS and proxy settings apply to http:// and
+// https:// alike, scgi:// sockets are spoken to directly.
+func newUpstreamTransport(upstream UpstreamConfig) (http.RoundTripper, error) {
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "scgi" {
+		return &SCGITransport{}, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch upstream.Proxy {
+	case "":
+		transport.Proxy = http.ProxyFromEnvironment
+	case proxyDirect:
+		transport.Proxy = nil
+	default:
+		proxy, err := url.Parse(upstream.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	transport.TLSClientConfig, err = upstream.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var rt http.RoundTripper = transport
+	headers := http.Header{}
+	for name, value := range upstream.Headers {
+		headers.Set(name, value)
+	}
+	if upstream.BearerToken != "" {
+		headers.Set("Authorization", "Bearer "+upstream.BearerToken)
+	}
+	if len(headers) > 0 {
+		rt = &headerTransport{next: rt, headers: headers}
+	}
+
+	if upstream.Username != "" && upstream.Password != "" {
+		if upstream.Auth == "digest" {
+			return newDigestAuthTransport(rt, upstream.Username, upstream.Password), nil
+		}
+		return newBasicAuthTransport(rt, upstream.Username, upstream.Password), nil
+	}
+	return rt, nil
+}
+
+// Returns the TLS configuration of https:// connections to an instance
+func (u UpstreamConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+
+	if u.CAFile != "" {
+		bundle, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA bundle: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("the CA bundle has no PEM certificates")
+		}
+	}
+
+	if u.ClientCertFile != "" {
+		reloader, err := newCertReloader(u.ClientCertFile, u.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate: %w", err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.GetCertificate(nil)
+		}
+	}
+	return config, nil
+}
+
+// headerTransport sets headers on every request
+type headerTransport struct {
+	next    http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		req.Header[name] = values
+	}
+	return t.next.RoundTrip(req)
+}
+
+type basicAuthTransport struct {
+	next     http.RoundTripper
+	Username string
+	Password string
+}
+
+func newBasicAuthTransport(next http.RoundTripper, username, password string) *basicAuthTransport {
+	return &basicAuthTransport{
+		next:     next,
+		Username: username,
+		Password: password,
+	}
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.Username, t.Password)
+	return t.next.RoundTrip(req)
+}
+
+// digestChallenge is a WWW-Authenticate: Digest header
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	// qop is auth when the server offers it, empty for RFC 2069 servers
+	qop string
+}
+
+// digestAuthTransport answers HTTP digest challenges (RFC 7616). The last
+// challenge is reused so that only the first request and those after the
+// nonce expires take two round trips.
+type digestAuthTransport struct {
+	next     http.RoundTripper
+	Username string
+	Password string
+
+	mu        sync.Mutex
+	challenge *digestChallenge
+	// nc counts the requests made with the nonce of challenge
+	nc uint32
+}
+
+func newDigestAuthTransport(next http.RoundTripper, username, password string) *digestAuthTransport {
+	return &digestAuthTransport{
+		next:     next,
+		Username: username,
+		Password: password,
+	}
+}
+
+func (t *digestAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	challenge := t.challenge
+	t.mu.Unlock()
+
+	resp, err := t.send(req, challenge)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	next, err := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+	// the request cannot be sent again without its body
+	if err != nil || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.mu.Lock()
+	t.challenge = next
+	t.nc = 0
+	t.mu.Unlock()
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.send(req, next)
+}
+
+// Sends the request, answering challenge when it is not nil
+func (t *digestAuthTransport) send(req *http.Request, challenge *digestChallenge) (*http.Response, error) {
+	if challenge == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	t.nc++
+	nc := fmt.Sprintf("%08x", t.nc)
+	t.mu.Unlock()
+
+	cnonce := make([]byte, 16)
+	_, err := rand.Read(cnonce)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", challenge.authorization(t.Username, t.Password, req.Method, req.URL.RequestURI(), nc, hex.EncodeToString(cnonce)))
+	return t.next.RoundTrip(req)
+}
+
+// Parses a digest challenge, failing for other schemes and for algorithms
+// and qops that are not supported
+func parseDigestChallenge(header string) (*digestChallenge, error) {
+	scheme, rest, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, fmt.Errorf("not a digest challenge: %q", header)
+	}
+
+	params := map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		var key, value string
+		key, rest, _ = strings.Cut(rest, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if strings.HasPrefix(rest, `"`) {
+			// quoted strings may hold commas and escaped quotes
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			if i >= len(rest) {
+				return nil, errors.New("unterminated quoted string in digest challenge")
+			}
+			_, rest, _ = strings.Cut(rest[i+1:], ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+		rest = strings.TrimSpace(rest)
+	}
+
+	challenge := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		algorithm: params["algorithm"],
+	}
+	if challenge.nonce == "" {
+		return nil, errors.New("digest challenge without a nonce")
+	}
+	if challenge.algorithm == "" {
+		challenge.algorithm = "MD5"
+	}
+	if challenge.hash() == nil {
+		return nil, fmt.Errorf("unsupported digest algorithm %s", challenge.algorithm)
+	}
+	if qop, ok := params["qop"]; ok {
+		for _, offered := range strings.Split(qop, ",") {
+			if strings.TrimSpace(offered) == "auth" {
+				challenge.qop = "auth"
+			}
+		}
+		if challenge.qop == "" {
+			return nil, fmt.Errorf("unsupported digest qop %s", qop)
+		}
+	}
+	return challenge, nil
+}
+
+// Returns the hash of the algorithm, nil when it is not supported
+func (c *digestChallenge) hash() func() hash.Hash {
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(c.algorithm), "-sess")) {
+	case "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// Returns the Authorization header answering the challenge
+func (c *digestChallenge) authorization(username, password, method, uri, nc, cnonce string) string {
+	newHash := c.hash()
+	h := func(s string) string {
+		sum := newHash()
+		io.WriteString(sum, s)
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	ha1 := h(username + ":" + c.realm + ":" + password)
+	if strings.HasSuffix(strings.ToLower(c.algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	response := h(ha1 + ":" + c.nonce + ":" + ha2)
+	if c.qop != "" {
+		response = h(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":" + c.qop + ":" + ha2)
+	}
+
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	fields := []string{
+		"username=" + quote(username),
+		"realm=" + quote(c.realm),
+		"nonce=" + quote(c.nonce),
+		"uri=" + quote(uri),
+		"algorithm=" + c.algorithm,
+		"response=" + quote(response),
+	}
+	if c.opaque != "" {
+		fields = append(fields, "opaque="+quote(c.opaque))
+	}
+	if c.qop != "" {
+		fields = append(fields, "qop="+c.qop, "nc="+nc, "cnonce="+quote(cnonce))
+	}
+	return "Digest " + strings.Join(fields, ", ")
+}
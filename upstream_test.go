@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Makes a request with the transport of upstream and returns the status code
+func doUpstream(t *testing.T, upstream UpstreamConfig) (int, error) {
+	t.Helper()
+
+	transport, err := newUpstreamTransport(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	resp, err := client.Post(upstream.URL, "text/xml", strings.NewReader("<methodCall/>"))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestUpstreamCredentials(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		upstream UpstreamConfig
+		header   string
+		want     string
+	}{
+		{"basic over http", UpstreamConfig{Username: "u", Password: "p"}, "Authorization", "Basic dTpw"},
+		{"bearer", UpstreamConfig{BearerToken: "t0k"}, "Authorization", "Bearer t0k"},
+		{"headers", UpstreamConfig{Headers: map[string]string{"x-api-key": "k"}}, "X-Api-Key", "k"},
+	}
+	for _, tt := range tests {
+		tt.upstream.URL = srv.URL + "/RPC2"
+		code, err := doUpstream(t, tt.upstream)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("%s: %d %v", tt.name, code, err)
+		}
+		if got.Get(tt.header) != tt.want {
+			t.Errorf("%s: expected %s: %s, got %q", tt.name, tt.header, tt.want, got.Get(tt.header))
+		}
+	}
+}
+
+func TestDigestResponse(t *testing.T) {
+	// the examples of RFC 7616 section 3.9.1
+	for algorithm, want := range map[string]string{
+		"MD5":     "8ca523f5e9506fed4657c9700eebdbec",
+		"SHA-256": "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	} {
+		challenge, err := parseDigestChallenge(`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=` + algorithm + `, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := challenge.authorization("Mufasa", "Circle of Life", "GET", "/dir/index.html", "00000001", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+		if !strings.Contains(header, `response="`+want+`"`) || !strings.Contains(header, `opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`) {
+			t.Errorf("%s: unexpected header %s", algorithm, header)
+		}
+	}
+
+	for _, header := range []string{
+		`Basic realm="x"`,
+		`Digest realm="x"`,
+		`Digest nonce="n", algorithm=SHA-512-256`,
+		`Digest nonce="n", qop="auth-int"`,
+		`Digest nonce="n`,
+	} {
+		if _, err := parseDigestChallenge(header); err == nil {
+			t.Errorf("expected %s to be refused", header)
+		}
+	}
+}
+
+func TestUpstreamDigestAuth(t *testing.T) {
+	var requests, challenges int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := io.ReadAll(r.Body)
+
+		challenge := &digestChallenge{realm: "rtorrent", nonce: "abc", algorithm: "SHA-256", qop: "auth"}
+		params := map[string]string{}
+		for _, field := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Digest "), ", ") {
+			key, value, _ := strings.Cut(field, "=")
+			params[key] = strings.Trim(value, `"`)
+		}
+		want := challenge.authorization("u", "p", r.Method, r.URL.RequestURI(), params["nc"], params["cnonce"])
+		if r.Header.Get("Authorization") != want || string(body) != "<methodCall/>" {
+			atomic.AddInt32(&challenges, 1)
+			w.Header().Set("WWW-Authenticate", `Digest realm="rtorrent", nonce="abc", algorithm=SHA-256, qop="auth"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	upstream := UpstreamConfig{URL: srv.URL + "/RPC2", Username: "u", Password: "p", Auth: "digest"}
+	transport, err := newUpstreamTransport(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(upstream.URL, "text/xml", strings.NewReader("<methodCall/>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%d: expected the challenge to be answered, got %d", i, resp.StatusCode)
+		}
+	}
+	if requests != 3 || challenges != 1 {
+		t.Errorf("expected the challenge to be reused, got %d requests and %d challenges", requests, challenges)
+	}
+
+	upstream.Password = "wrong"
+	if code, _ := doUpstream(t, upstream); code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be refused, got %d", code)
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", 1, nil)
+	client := newTestCert(t, dir, "rtw", 2, ca)
+
+	var peer string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			peer = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(dir, "upstream-ca.crt")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	tests := []struct {
+		name     string
+		upstream UpstreamConfig
+		ok       bool
+	}{
+		{"system roots", UpstreamConfig{}, false},
+		{"ca bundle", UpstreamConfig{CAFile: caFile}, true},
+		{"insecure", UpstreamConfig{InsecureSkipVerify: true}, true},
+	}
+	for _, tt := range tests {
+		tt.upstream.URL = srv.URL + "/RPC2"
+		_, err := doUpstream(t, tt.upstream)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: expected success %t, got %v", tt.name, tt.ok, err)
+		}
+	}
+
+	_, err := doUpstream(t, UpstreamConfig{
+		URL:            srv.URL + "/RPC2",
+		CAFile:         caFile,
+		ClientCertFile: client.certFile,
+		ClientKeyFile:  client.keyFile,
+	})
+	if err != nil || peer != "rtw" {
+		t.Errorf("expected the client certificate to be presented, got %q %v", peer, err)
+	}
+
+	if _, err := newUpstreamTransport(UpstreamConfig{URL: srv.URL, CAFile: client.keyFile}); err == nil {
+		t.Error("expected a CA bundle without certificates to be refused")
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	var host, authorization string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.URL.Host
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer proxy.Close()
+
+	code, err := doUpstream(t, UpstreamConfig{
+		URL:      "http://rtorrent.invalid/RPC2",
+		Username: "u",
+		Password: "p",
+		Proxy:    proxy.URL,
+	})
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("expected the request to go through the proxy, got %d %v", code, err)
+	}
+	if host != "rtorrent.invalid" || authorization != "Basic dTpw" {
+		t.Errorf("expected the credentials to be sent through the proxy, got %s %q", host, authorization)
+	}
+
+	transport, _ := newUpstreamTransport(UpstreamConfig{URL: "scgi://localhost:5000"})
+	if _, ok := transport.(*SCGITransport); !ok {
+		t.Errorf("expected scgi:// to be spoken directly, got %T", transport)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = 30 * time.Second
+	// wsMaxMessage limits the size of a client message
+	wsMaxMessage = 64 << 10
+	// wsSendBuffer is the number of messages a client can fall behind
+	// before it is disconnected
+	wsSendBuffer = 256
+	// wsMaxSubscriptions limits the subscriptions of one connection
+	wsMaxSubscriptions = 64
+	// wsMaxCommands limits the commands of one connection running at once
+	wsMaxCommands = 8
+)
+
+// WSRequest is a message from a WebSocket client
+type WSRequest struct {
+	// ID is echoed in the result of the request
+	ID string `json:"id"`
+	// Type is subscribe, unsubscribe or command
+	Type string `json:"type"`
+
+	// Topic of a subscription: view, files, peers or trackers
+	Topic string `json:"topic"`
+	// View and Hashes select the events of a view subscription
+	View   string   `json:"view"`
+	Hashes []string `json:"hashes"`
+	// LastEventID resumes a view subscription after the event
+	LastEventID *uint64 `json:"last_event_id"`
+	// Subscription to end with unsubscribe
+	Subscription string `json:"subscription"`
+
+	// Command is a torrent action, erase or set_priority
+	Command  string `json:"command"`
+	Hash     string `json:"hash"`
+	Priority *int64 `json:"priority"`
+	WithData bool   `json:"with_data"`
+}
+
+// WSMessage is a message to a WebSocket client. Results carry the ID of
+// their request, subscription updates the ID of their subscription.
+type WSMessage struct {
+	ID string `json:"id,omitempty"`
+	// Type is result, event, files, peers, trackers or unsubscribed
+	Type         string      `json:"type"`
+	Status       string      `json:"status,omitempty"`
+	Message      string      `json:"message,omitempty"`
+	Subscription string      `json:"subscription,omitempty"`
+	Hash         string      `json:"hash,omitempty"`
+	Data         interface{} `json:"data,omitempty"`
+}
+
+func WebSocketHandler(rt *Rtorrent) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: checkOrigin,
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has responded
+			log.Printf("error in websocket handler: %s", err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(rt.streams)
+		c := &wsConn{
+			rt:            rt,
+			principal:     PrincipalFrom(r.Context()),
+			audit:         rt.auditorFor(r),
+			conn:          conn,
+			ctx:           ctx,
+			cancel:        cancel,
+			send:          make(chan WSMessage, wsSendBuffer),
+			commands:      make(chan struct{}, wsMaxCommands),
+			subscriptions: map[string]context.CancelFunc{},
+		}
+		c.serve()
+	}
+}
+
+// Allows requests without an origin, from the same host or from the CORS
+// origin
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if allowed := currentCORS().Origin; allowed == "*" || origin == allowed {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// wsConn is a WebSocket client, one goroutine reads requests and one writes
+// the queued messages
+type wsConn struct {
+	rt *Rtorrent
+	// principal is who the connection was authenticated as
+	principal *Principal
+	// audit records the connection's commands
+	audit  auditor
+	conn   *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	send   chan WSMessage
+	// commands bounds the commands running at once
+	commands chan struct{}
+
+	mu            sync.Mutex
+	lastID        int
+	subscriptions map[string]context.CancelFunc
+}
+
+func (c *wsConn) serve() {
+	go c.writeLoop()
+	c.readLoop()
+
+	c.cancel()
+	c.mu.Lock()
+	for _, cancel := range c.subscriptions {
+		cancel()
+	}
+	c.mu.Unlock()
+}
+
+func (c *wsConn) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req WSRequest
+		err = json.Unmarshal(data, &req)
+		if err != nil {
+			c.reply(WSMessage{
+				Type:    "result",
+				Status:  "error",
+				Message: fmt.Sprintf("invalid message: %s", err),
+			})
+			continue
+		}
+		c.handle(req)
+	}
+}
+
+func (c *wsConn) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	defer c.conn.Close()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			code := websocket.CloseNormalClosure
+			if c.rt.streams.Err() != nil {
+				code = websocket.CloseGoingAway
+			}
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(code, ""),
+				time.Now().Add(wsWriteTimeout))
+			return
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err := c.conn.WriteJSON(msg)
+			if err != nil {
+				c.cancel()
+				return
+			}
+		case <-ping.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			if err != nil {
+				c.cancel()
+				return
+			}
+		}
+	}
+}
+
+// Queues a message, a client that does not keep up is disconnected
+func (c *wsConn) reply(msg WSMessage) {
+	select {
+	case c.send <- msg:
+	case <-c.ctx.Done():
+	default:
+		log.Printf("closing websocket connection, the client fell behind")
+		c.cancel()
+	}
+}
+
+// Replies with the result of request id
+func (c *wsConn) result(id string, err error, data interface{}) {
+	msg := WSMessage{
+		ID:     id,
+		Type:   "result",
+		Status: "ok",
+		Data:   data,
+	}
+	if err != nil {
+		msg.Status = "error"
+		msg.Message = err.Error()
+	}
+	c.reply(msg)
+}
+
+func (c *wsConn) handle(req WSRequest) {
+	switch req.Type {
+	case "subscribe":
+		id, run, err := c.subscribe(req)
+		if err != nil {
+			c.result(req.ID, err, nil)
+			return
+		}
+		c.reply(WSMessage{
+			ID:           req.ID,
+			Type:         "result",
+			Status:       "ok",
+			Subscription: id,
+		})
+		go run()
+	case "unsubscribe":
+		c.mu.Lock()
+		cancel, ok := c.subscriptions[req.Subscription]
+		delete(c.subscriptions, req.Subscription)
+		c.mu.Unlock()
+
+		if !ok {
+			c.result(req.ID, fmt.Errorf("unknown subscription: %s", req.Subscription), nil)
+			return
+		}
+		cancel()
+		c.result(req.ID, nil, nil)
+	case "command":
+		select {
+		case c.commands <- struct{}{}:
+		case <-c.ctx.Done():
+			return
+		}
+		go func() {
+			defer func() { <-c.commands }()
+			data, err := c.command(req)
+			if err != nil {
+				log.Printf("error in websocket command %s: %s", req.Command, err)
+			}
+			c.result(req.ID, err, data)
+		}()
+	default:
+		c.result(req.ID, fmt.Errorf("unknown message type: %s", req.Type), nil)
+	}
+}
+
+// Runs a command through the same methods as the REST handlers
+func (c *wsConn) command(req WSRequest) (interface{}, error) {
+	if req.Hash == "" {
+		return nil, errors.New("hash is required")
+	}
+
+	scope := ScopeControl
+	if req.Command == "erase" {
+		scope = ScopeDelete
+	}
+	if !c.principal.Can(scope) {
+		return nil, fmt.Errorf("%w: requires the %s scope", ErrForbidden, scope)
+	}
+	err := authorizeTorrent(c.ctx, c.rt, c.principal, req.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := torrentActions[req.Command]; !ok && req.Command != "erase" && req.Command != "set_priority" {
+		return nil, fmt.Errorf("unknown command: %s", req.Command)
+	}
+	if req.Command == "set_priority" && req.Priority == nil {
+		return nil, errors.New("priority is required")
+	}
+
+	name := c.audit.names(c.ctx, req.Hash)[strings.ToUpper(req.Hash)]
+	data, err := c.run(req)
+	c.audit.record(req.Command, req.Hash, name, req.auditParams(), err)
+	return data, err
+}
+
+// Runs a validated command
+func (c *wsConn) run(req WSRequest) (interface{}, error) {
+	if action, ok := torrentActions[req.Command]; ok {
+		return nil, action(c.rt, c.ctx, req.Hash)
+	}
+
+	switch req.Command {
+	case "erase":
+		if !req.WithData {
+			return nil, c.rt.Erase(c.ctx, req.Hash)
+		}
+		removal, err := c.rt.EraseWithData(c.ctx, req.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return removal, nil
+	case "set_priority":
+		return nil, c.rt.SetPriority(c.ctx, req.Hash, *req.Priority)
+	}
+	return nil, fmt.Errorf("unknown command: %s", req.Command)
+}
+
+// Returns the parameters of a command for the audit log
+func (req WSRequest) auditParams() map[string]interface{} {
+	switch req.Command {
+	case "erase":
+		return map[string]interface{}{"with_data": req.WithData}
+	case "set_priority":
+		return map[string]interface{}{"priority": *req.Priority}
+	}
+	return nil
+}
+
+// Sets up a subscription and returns its ID and the function that runs it,
+// which is started after the client has the ID
+func (c *wsConn) subscribe(req WSRequest) (string, func(), error) {
+	view := req.View
+	switch req.Topic {
+	case "view":
+		if view == "" {
+			view = "main"
+		}
+		if !c.principal.CanView(view) {
+			return "", nil, fmt.Errorf("%w: view %s is not allowed", ErrForbidden, view)
+		}
+		err := checkView(c.ctx, c.rt, view)
+		if err != nil {
+			return "", nil, err
+		}
+	case "files", "peers", "trackers":
+		if req.Hash == "" {
+			return "", nil, errors.New("hash is required")
+		}
+		err := authorizeTorrent(c.ctx, c.rt, c.principal, req.Hash)
+		if err != nil {
+			return "", nil, err
+		}
+	default:
+		return "", nil, fmt.Errorf("unknown topic: %s", req.Topic)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.subscriptions) >= wsMaxSubscriptions {
+		return "", nil, fmt.Errorf("too many subscriptions, at most %d are allowed", wsMaxSubscriptions)
+	}
+	c.lastID++
+	id := fmt.Sprintf("s%d", c.lastID)
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.subscriptions[id] = cancel
+
+	if req.Topic != "view" {
+		return id, func() { c.pollTorrent(ctx, id, req.Topic, req.Hash) }, nil
+	}
+
+	hashes := make([]string, 0, len(req.Hashes))
+	for _, hash := range req.Hashes {
+		hashes = append(hashes, strings.ToUpper(hash))
+	}
+	var lastID uint64
+	if req.LastEventID != nil {
+		lastID = *req.LastEventID
+	}
+	sub, first := c.rt.events.Subscribe(view, hashes, req.LastEventID != nil, lastID)
+	return id, func() { c.forwardEvents(ctx, id, sub, first) }, nil
+}
+
+// Ends a subscription from the server side
+func (c *wsConn) unsubscribed(id string, reason string) {
+	c.mu.Lock()
+	cancel, ok := c.subscriptions[id]
+	delete(c.subscriptions, id)
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	cancel()
+	c.reply(WSMessage{
+		Type:         "unsubscribed",
+		Subscription: id,
+		Message:      reason,
+	})
+}
+
+func (c *wsConn) forwardEvents(ctx context.Context, id string, sub *Subscription, first []Event) {
+	defer c.rt.events.Unsubscribe(sub)
+
+	gate := newEventGate(c.principal)
+	for _, e := range first {
+		if gate.pass(e) {
+			c.reply(WSMessage{Type: "event", Subscription: id, Data: e})
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-sub.Events:
+			if !ok && c.ctx.Err() != nil {
+				return
+			}
+			if !ok {
+				c.unsubscribed(id, "events fell behind, resubscribe with the last event id")
+				return
+			}
+			if gate.pass(e) {
+				c.reply(WSMessage{Type: "event", Subscription: id, Data: e})
+			}
+		}
+	}
+}
+
+// Sends the files, peers or trackers of a torrent whenever they change
+func (c *wsConn) pollTorrent(ctx context.Context, id string, topic string, hash string) {
+	ticker := time.NewTicker(c.rt.events.interval)
+	defer ticker.Stop()
+
+	var last interface{}
+	for {
+		var data interface{}
+		var err error
+		switch topic {
+		case "files":
+			data, err = c.rt.FMulticall(ctx, fileArgs(hash))
+		case "peers":
+			data, err = c.rt.PMulticall(ctx, peerArgs(hash))
+		case "trackers":
+			data, err = c.rt.TMulticall(ctx, trackerArgs(hash))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.unsubscribed(id, err.Error())
+			return
+		}
+
+		if !reflect.DeepEqual(data, last) {
+			last = data
+			c.reply(WSMessage{Type: topic, Subscription: id, Hash: hash, Data: data})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsTestClient keeps the messages skipped while waiting for another one
+type wsTestClient struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	pending []WSMessage
+}
+
+// Connects a WebSocket client to rtw in front of a fake rTorrent
+func newTestWebSocket(t *testing.T) (*wsTestClient, *Rtorrent, func() string) {
+	t.Helper()
+
+	rtorrent, fake := newTestEvents(t)
+	addTestTorrent(fake, "A", "a")
+
+	srv := httptest.NewServer(newRouter(rtorrent, nil))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	state := func() string {
+		torrent, _ := fake.Torrent("A")
+		data, _ := json.Marshal(torrent.Fields)
+		return string(data)
+	}
+	return &wsTestClient{t: t, conn: conn}, rtorrent, state
+}
+
+// Returns the first message that matches
+func (c *wsTestClient) next(match func(WSMessage) bool) WSMessage {
+	c.t.Helper()
+
+	for i, msg := range c.pending {
+		if match(msg) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return msg
+		}
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg WSMessage
+		err := c.conn.ReadJSON(&msg)
+		if err != nil {
+			c.t.Fatalf("no matching message: %v", err)
+		}
+		if match(msg) {
+			return msg
+		}
+		c.pending = append(c.pending, msg)
+	}
+}
+
+// Sends a request and returns its result
+func (c *wsTestClient) request(req WSRequest) WSMessage {
+	c.t.Helper()
+
+	err := c.conn.WriteJSON(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.next(func(msg WSMessage) bool {
+		return msg.Type == "result" && msg.ID == req.ID
+	})
+}
+
+// Returns the next message of a subscription
+func (c *wsTestClient) update(subscription string) WSMessage {
+	c.t.Helper()
+
+	return c.next(func(msg WSMessage) bool {
+		return msg.Subscription == subscription && msg.Type != "result"
+	})
+}
+
+func TestWebSocketCommands(t *testing.T) {
+	client, _, state := newTestWebSocket(t)
+
+	result := client.request(WSRequest{ID: "1", Type: "command", Command: "start", Hash: "A"})
+	if result.Status != "ok" || !strings.Contains(state(), `"d.state":1`) {
+		t.Errorf("unexpected start result %+v, torrent %s", result, state())
+	}
+
+	priority := int64(3)
+	result = client.request(WSRequest{ID: "2", Type: "command", Command: "set_priority", Hash: "A", Priority: &priority})
+	if result.Status != "ok" || !strings.Contains(state(), `"d.priority":3`) {
+		t.Errorf("unexpected set_priority result %+v, torrent %s", result, state())
+	}
+
+	tests := []WSRequest{
+		{ID: "3", Type: "command", Command: "explode", Hash: "A"},
+		{ID: "4", Type: "command", Command: "start"},
+		{ID: "5", Type: "command", Command: "set_priority", Hash: "A"},
+		{ID: "6", Type: "command", Command: "stop", Hash: "MISSING"},
+		{ID: "7", Type: "bogus"},
+		{ID: "8", Type: "unsubscribe", Subscription: "s99"},
+		{ID: "9", Type: "subscribe", Topic: "peers"},
+		{ID: "10", Type: "subscribe", Topic: "view", View: "nonexistent"},
+	}
+	for _, req := range tests {
+		result := client.request(req)
+		if result.Status != "error" || result.Message == "" {
+			t.Errorf("%+v: expected error, got %+v", req, result)
+		}
+	}
+
+	client.conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	result = client.next(func(msg WSMessage) bool { return msg.Type == "result" && msg.ID == "" })
+	if result.Status != "error" {
+		t.Errorf("expected error for invalid message, got %+v", result)
+	}
+}
+
+func TestWebSocketSubscriptions(t *testing.T) {
+	client, rtorrent, _ := newTestWebSocket(t)
+
+	result := client.request(WSRequest{ID: "1", Type: "subscribe", Topic: "view"})
+	if result.Status != "ok" || result.Subscription == "" {
+		t.Fatalf("unexpected subscribe result %+v", result)
+	}
+	view := result.Subscription
+
+	msg := client.update(view)
+	if msg.Type != "event" || msg.Data.(map[string]interface{})["type"] != EventStreamOpen {
+		t.Fatalf("expected stream.open, got %+v", msg)
+	}
+	waitForBaseline(t, rtorrent.events, "main")
+
+	result = client.request(WSRequest{ID: "2", Type: "command", Command: "start", Hash: "A"})
+	if result.Status != "ok" {
+		t.Fatalf("unexpected start result %+v", result)
+	}
+	msg = client.update(view)
+	if event := msg.Data.(map[string]interface{}); event["type"] != EventTorrentStateChanged || event["hash"] != "A" {
+		t.Errorf("unexpected event %+v", msg)
+	}
+
+	result = client.request(WSRequest{ID: "3", Type: "subscribe", Topic: "peers", Hash: "A"})
+	if result.Status != "ok" {
+		t.Fatalf("unexpected subscribe result %+v", result)
+	}
+	peers := result.Subscription
+	msg = client.update(peers)
+	if msg.Type != "peers" || msg.Hash != "A" || len(msg.Data.([]interface{})) != 1 {
+		t.Errorf("unexpected peers message %+v", msg)
+	}
+
+	result = client.request(WSRequest{ID: "4", Type: "unsubscribe", Subscription: peers})
+	if result.Status != "ok" {
+		t.Errorf("unexpected unsubscribe result %+v", result)
+	}
+
+	// erasing the torrent ends subscriptions to it
+	result = client.request(WSRequest{ID: "5", Type: "subscribe", Topic: "files", Hash: "A"})
+	files := result.Subscription
+	client.update(files)
+	client.request(WSRequest{ID: "6", Type: "command", Command: "erase", Hash: "A"})
+	msg = client.update(files)
+	if msg.Type != "unsubscribed" || msg.Message == "" {
+		t.Errorf("expected subscription to end, got %+v", msg)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	rtorrent, _ := newTestEvents(t)
+	srv := httptest.NewServer(newRouter(rtorrent, nil))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected cross origin connection to be refused, got %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatalf("expected same origin connection, got %v", err)
+	}
+	conn.Close()
+}